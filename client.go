@@ -2,75 +2,5274 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/neovim/go-client/msgpack/rpc"
+	"github.com/neovim/go-client/nvim"
 )
 
-type NvimClient struct {
-	socketPath string
+// namespacePrefix marks Neovim namespaces created by this server so they can
+// be found again after a restart
+const namespacePrefix = "neovim-mcp."
+
+type NvimClient struct {
+	*clientState
+
+	// ctx bounds every call made through this client alongside timeout;
+	// nil means no bound beyond timeout
+	ctx context.Context
+}
+
+// clientState is the connection state shared by a client and the views of it
+// returned by WithContext
+type clientState struct {
+	socketPath string
+
+	// detection explains why socketPath was chosen
+	detection string
+
+	// rpc is the persistent msgpack-RPC connection to socketPath, dialed on
+	// first use and redialed after the instance drops it. rpcUsers counts
+	// the calls in flight on each connection, so that one is only shut
+	// once its last call returns.
+	rpcMu    sync.Mutex
+	rpc      *nvim.Nvim
+	rpcUsers map[*nvim.Nvim]int
+	closed   bool
+
+	// dropped is set when a connection is dropped under a call, so the next
+	// dial knows the watches attached to the old one are gone
+	dropped bool
+
+	// handlers receives what Neovim pushes for watches; it is registered on
+	// every connection when it is dialed
+	handlers WatchHandlers
+
+	// timeout bounds each RPC call; zero waits indefinitely
+	timeout time.Duration
+
+	// namespaces maps owned namespace names (without prefix) to their ids
+	nsMu       sync.Mutex
+	namespaces map[string]int
+}
+
+func NewNvimClient(socketFlag string) (*NvimClient, error) {
+	// An explicit socket always wins over auto-detection
+	if socketFlag != "" {
+		client := newNvimClientForSocket(socketFlag)
+		client.detection = "--socket flag"
+		return client, nil
+	}
+	if socketPath := os.Getenv("NVIM_MCP_SOCKET"); socketPath != "" {
+		client := newNvimClientForSocket(socketPath)
+		client.detection = "$NVIM_MCP_SOCKET"
+		return client, nil
+	}
+
+	// Use auto-detection
+	socketPath, reason, err := findNvimSocket()
+	if err != nil {
+		return nil, err
+	}
+	if socketPath == "" {
+		return nil, fmt.Errorf("no Neovim instance found for current directory (checked in order: --socket, $NVIM_MCP_SOCKET, an instance hosting this process, an instance whose working directory matches, $NVIM, $NVIM_LISTEN_ADDRESS, %s)", projectSocketPath("{directory-name}"))
+	}
+
+	client := newNvimClientForSocket(socketPath)
+	client.detection = reason
+	return client, nil
+}
+
+// defaultRPCTimeout is how long a call waits for a blocked Neovim
+const defaultRPCTimeout = 5 * time.Second
+
+// newNvimClientForSocket creates a client for a known socket path
+func newNvimClientForSocket(socketPath string) *NvimClient {
+	return &NvimClient{clientState: &clientState{
+		socketPath: socketPath,
+		timeout:    defaultRPCTimeout,
+		namespaces: make(map[string]int),
+	}}
+}
+
+// WithContext returns a view of c that shares its connection but also stops
+// waiting for Neovim once ctx is done, e.g. when a tool request is cancelled
+func (c *NvimClient) WithContext(ctx context.Context) *NvimClient {
+	return &NvimClient{clientState: c.clientState, ctx: ctx}
+}
+
+// SocketCandidate is a live Neovim instance that may belong to this project
+type SocketCandidate struct {
+	Path         string `json:"path"`
+	Cwd          string `json:"cwd"`
+	Pid          int    `json:"pid"`
+	TerminalPids []int  `json:"terminal_pids,omitempty"`
+}
+
+// AmbiguousSocketError is returned when several live instances could be the
+// user's editor for the current directory
+type AmbiguousSocketError struct {
+	Candidates []SocketCandidate
+}
+
+func (e *AmbiguousSocketError) Error() string {
+	var parts []string
+	for _, candidate := range e.Candidates {
+		parts = append(parts, fmt.Sprintf("%s (cwd: %s)", candidate.Path, candidate.Cwd))
+	}
+	return fmt.Sprintf("multiple Neovim instances match the current directory, use resolve_instance to pick one: %s", strings.Join(parts, ", "))
+}
+
+// findNvimSocket returns the socket of the instance this server most likely
+// belongs to, along with a human-readable reason for the choice
+func findNvimSocket() (string, string, error) {
+	candidates := FindSocketCandidates()
+
+	// An instance whose terminal (or whose own process) is an ancestor of
+	// this server hosts it; the nearest one is the innermost when Neovim
+	// runs inside another Neovim's terminal
+	ancestors := processAncestors(os.Getpid())
+	var host *SocketCandidate
+	hostDepth, hostPid := 0, 0
+	for i := range candidates {
+		candidate := &candidates[i]
+		for _, pid := range append([]int{candidate.Pid}, candidate.TerminalPids...) {
+			depth, ok := ancestors[pid]
+			if ok && (host == nil || depth < hostDepth) {
+				host, hostDepth, hostPid = candidate, depth, pid
+			}
+		}
+	}
+	if host != nil {
+		if hostPid != host.Pid {
+			return host.Path, fmt.Sprintf("innermost instance hosting this process (pid %d, via terminal job %d)", host.Pid, hostPid), nil
+		}
+		return host.Path, fmt.Sprintf("innermost instance hosting this process (pid %d)", host.Pid), nil
+	}
+
+	// $NVIM and $NVIM_LISTEN_ADDRESS are inherited, so inside tmux they can
+	// point at whichever instance the tmux server was started from. They
+	// are only trusted when no instance matches the working directory.
+	var envSocket, envName string
+	for _, name := range []string{"NVIM", "NVIM_LISTEN_ADDRESS"} {
+		if path := os.Getenv(name); path != "" && isLiveCandidate(candidates, path) {
+			envSocket, envName = path, name
+			break
+		}
+	}
+
+	// Otherwise, try to find the socket for the current working directory
+	pwd, err := os.Getwd()
+	if err != nil {
+		if envSocket != "" {
+			return envSocket, fmt.Sprintf("$%s", envName), nil
+		}
+		return "", "", nil
+	}
+
+	// Prefer instances whose working directory is exactly ours
+	var exact []SocketCandidate
+	for _, candidate := range candidates {
+		if candidate.Cwd == pwd {
+			exact = append(exact, candidate)
+		}
+	}
+	if len(exact) == 1 {
+		if envSocket != "" && envSocket != exact[0].Path {
+			return exact[0].Path, fmt.Sprintf("working directory matches %s ($%s points at %s, which does not host this process)", pwd, envName, envSocket), nil
+		}
+		return exact[0].Path, fmt.Sprintf("working directory matches %s", pwd), nil
+	}
+	if envSocket != "" {
+		return envSocket, fmt.Sprintf("$%s", envName), nil
+	}
+	if len(exact) > 1 {
+		return "", "", &AmbiguousSocketError{Candidates: exact}
+	}
+
+	// Fall back to the socket named after the directory, as long as it is
+	// the only live instance that could be meant
+	socketPath := projectSocketPath(pwd)
+	for _, candidate := range candidates {
+		if candidate.Path == socketPath {
+			if len(candidates) > 1 {
+				return "", "", &AmbiguousSocketError{Candidates: candidates}
+			}
+			return socketPath, "socket named after the working directory", nil
+		}
+	}
+
+	return "", "", nil
+}
+
+func isLiveCandidate(candidates []SocketCandidate, path string) bool {
+	for _, candidate := range candidates {
+		if candidate.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// processAncestors maps each ancestor of pid (including pid itself) to its
+// distance from pid
+func processAncestors(pid int) map[int]int {
+	ancestors := make(map[int]int)
+	for depth := 0; pid > 1 && depth < 64; depth++ {
+		if _, seen := ancestors[pid]; seen {
+			break
+		}
+		ancestors[pid] = depth
+		ppid, err := parentPid(pid)
+		if err != nil {
+			break
+		}
+		pid = ppid
+	}
+	return ancestors
+}
+
+func parentPid(pid int) (int, error) {
+	// /proc is only available on Linux; ps covers macOS and the BSDs
+	if stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid)); err == nil {
+		// The command name is parenthesised and may contain spaces
+		fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+		if len(fields) > 1 {
+			return strconv.Atoi(fields[1])
+		}
+	}
+
+	out, err := exec.Command("ps", "-o", "ppid=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(out)))
+}
+
+// projectSocketPath is the conventional socket for a project directory:
+// $XDG_CACHE_HOME/nvim/<directory-name>.sock
+func projectSocketPath(pwd string) string {
+	// Generate socket path using working directory name
+	projBase := filepath.Base(pwd)
+	return filepath.Join(socketCacheDir(), fmt.Sprintf("%s.sock", projBase))
+}
+
+// socketCacheDir is where project sockets live: $XDG_CACHE_HOME/nvim
+func socketCacheDir() string {
+	cacheDir := os.Getenv("XDG_CACHE_HOME")
+	if cacheDir == "" {
+		homeDir, _ := os.UserHomeDir()
+		cacheDir = filepath.Join(homeDir, ".cache")
+	}
+	return filepath.Join(cacheDir, "nvim")
+}
+
+// FindSocketCandidates lists live Neovim instances: the sockets named by
+// $NVIM and $NVIM_LISTEN_ADDRESS, the project socket for the current
+// directory, and the default sockets Neovim creates in its runtime
+// directory, each with the instance's working directory and process ids
+func FindSocketCandidates() []SocketCandidate {
+	return probeSocketCandidates(candidateSocketPaths())
+}
+
+// ListNvimInstances lists every live Neovim instance on this machine: the
+// detection candidates plus every project socket in $XDG_CACHE_HOME/nvim,
+// whichever directory it belongs to
+func ListNvimInstances() []SocketCandidate {
+	paths := candidateSocketPaths()
+	matches, _ := filepath.Glob(filepath.Join(socketCacheDir(), "*.sock"))
+	paths = append(paths, matches...)
+	return probeSocketCandidates(paths)
+}
+
+// candidateSocketPaths lists the sockets auto-detection considers, live or
+// not
+func candidateSocketPaths() []string {
+	var paths []string
+	for _, name := range []string{"NVIM", "NVIM_LISTEN_ADDRESS"} {
+		if path := os.Getenv(name); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	if pwd, err := os.Getwd(); err == nil {
+		paths = append(paths, projectSocketPath(pwd))
+	}
+
+	var patterns []string
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		patterns = append(patterns, filepath.Join(runtimeDir, "nvim.*.0"))
+	}
+	patterns = append(patterns, filepath.Join(os.TempDir(), fmt.Sprintf("nvim.%s", os.Getenv("USER")), "*", "nvim.*.0"))
+	for _, pattern := range patterns {
+		matches, _ := filepath.Glob(pattern)
+		paths = append(paths, matches...)
+	}
+
+	return paths
+}
+
+// probeSocketCandidates connects to each distinct path and returns the ones
+// that answer
+func probeSocketCandidates(paths []string) []SocketCandidate {
+	// terminal_job_pid lets detection tell which instance's terminal this
+	// server is running in
+	probe := `
+		local terminals = {}
+		for _, buf in ipairs(vim.api.nvim_list_bufs()) do
+			if vim.bo[buf].buftype == 'terminal' then
+				local ok, pid = pcall(vim.api.nvim_buf_get_var, buf, 'terminal_job_pid')
+				if ok then
+					table.insert(terminals, pid)
+				end
+			end
+		end
+		return {cwd = vim.fn.getcwd(), pid = vim.fn.getpid(), terminal_pids = #terminals > 0 and terminals or vim.NIL}`
+
+	seen := make(map[string]bool)
+	var candidates []SocketCandidate
+	for _, path := range paths {
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+
+		// TCP addresses have no file to check; the probe finds out
+		if !isTCPAddress(path) {
+			if _, err := os.Stat(path); err != nil {
+				continue
+			}
+		}
+		client := newNvimClientForSocket(path)
+		output, err := client.luaJSON(probe, map[string]any{})
+		client.Close()
+		if err != nil {
+			// Stale socket left behind by an instance that exited
+			continue
+		}
+		candidate := SocketCandidate{Path: path}
+		if err := json.Unmarshal([]byte(output), &candidate); err != nil {
+			continue
+		}
+		candidate.Path = path
+		candidates = append(candidates, candidate)
+	}
+
+	return candidates
+}
+
+// quickfixActions maps populate_quickfix actions to setqflist() action flags
+var quickfixActions = map[string]string{
+	"":        "r",
+	"replace": "r",
+	"append":  "a",
+	"new":     " ",
+}
+
+func (c *NvimClient) SetQuickfixList(items []QuickfixItem, action, title string, loclist bool) error {
+	flag, ok := quickfixActions[action]
+	if !ok {
+		return fmt.Errorf("invalid action %q (expected replace, append or new)", action)
+	}
+
+	// Convert items to Vim dictionary format
+	vimList := c.quickfixItemsToVimList(items)
+
+	// The dictionary form sets the title along with the items, so runs
+	// can be told apart in :chistory
+	if title == "" {
+		title = fmt.Sprintf("MCP: %d items", len(items))
+	}
+	what := fmt.Sprintf("{'title': \"%s\", 'items': %s}", c.escapeVimString(title), vimList)
+
+	// Use setqflist() function, or setloclist() for the current window
+	command := fmt.Sprintf("call setqflist([], '%s', %s)", flag, what)
+	if loclist {
+		command = fmt.Sprintf("call setloclist(0, [], '%s', %s)", flag, what)
+	}
+	_, err := c.ExecuteCommand(command)
+	return err
+}
+
+func (c *NvimClient) OpenQuickfixWindow() error {
+	_, err := c.ExecuteCommand("copen")
+	return err
+}
+
+// quickfixPositions maps window positions to the modifiers placed before copen
+var quickfixPositions = map[string]string{
+	"":       "",
+	"bottom": "botright ",
+	"top":    "topleft ",
+	"left":   "vertical topleft ",
+	"right":  "vertical botright ",
+}
+
+func (c *NvimClient) QuickfixWindow(position string, height int) (string, error) {
+	modifier, ok := quickfixPositions[position]
+	if !ok {
+		return "", fmt.Errorf("invalid position %q (expected bottom, top, left or right)", position)
+	}
+	if height < 0 {
+		return "", fmt.Errorf("invalid height %d", height)
+	}
+
+	// An open quickfix window is only focused by copen, so it is closed
+	// first when it has to move or change size
+	expr := `
+		local info = vim.fn.getqflist({winid = 0})
+		if info.winid ~= 0 and (args.modifier ~= '' or args.height > 0) then
+			vim.cmd('cclose')
+		end
+		vim.cmd(args.modifier .. 'copen' .. (args.height > 0 and (' ' .. args.height) or ''))
+		local win = vim.fn.getqflist({winid = 0}).winid
+		if win == 0 then
+			error('quickfix window did not open')
+		end
+		local pos = vim.api.nvim_win_get_position(win)
+		return {
+			winid = win,
+			width = vim.api.nvim_win_get_width(win),
+			height = vim.api.nvim_win_get_height(win),
+			row = pos[1],
+			col = pos[2],
+			position = args.position ~= '' and args.position or 'default',
+		}`
+
+	output, err := c.luaJSON(expr, map[string]any{
+		"modifier": modifier,
+		"position": position,
+		"height":   height,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to open quickfix window: %v", err)
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) SetLocationList(winid int, items []QuickfixItem) error {
+	if err := c.checkWindow(winid); err != nil {
+		return err
+	}
+
+	vimList := c.quickfixItemsToVimList(items)
+
+	command := fmt.Sprintf("call setloclist(%d, %s)", winid, vimList)
+	_, err := c.ExecuteCommand(command)
+	return err
+}
+
+// OpenLocationListWindow opens the location list window of winid, or of the
+// current window when winid is 0, which win_execute() does not accept
+func (c *NvimClient) OpenLocationListWindow(winid int) error {
+	command := "lopen"
+	if winid != 0 {
+		command = fmt.Sprintf("call win_execute(%d, 'lopen')", winid)
+	}
+	_, err := c.ExecuteCommand(command)
+	return err
+}
+
+func (c *NvimClient) GetLocationList(winid int, absolutePaths bool) (string, error) {
+	if err := c.checkWindow(winid); err != nil {
+		return "", err
+	}
+
+	expr := projectPathsLua + `
+		local info = vim.fn.getloclist(args.winid, {items = 1, title = 1, idx = 1, size = 1})
+		local root = project_root(vim.api.nvim_win_get_buf(args.winid))
+		local items = {}
+		for i, item in ipairs(info.items or {}) do
+			local filename = item.bufnr > 0 and vim.api.nvim_buf_get_name(item.bufnr) or ''
+			table.insert(items, {
+				index = i,
+				filename = args.absolute_paths and filename or relative_to(filename, root),
+				line = item.lnum,
+				column = item.col,
+				text = item.text,
+				type = item.type,
+			})
+		end
+		return {
+			winid = args.winid ~= 0 and args.winid or vim.api.nvim_get_current_win(),
+			title = info.title or '',
+			current_index = info.idx or 0,
+			size = info.size or 0,
+			items = items,
+		}`
+
+	output, err := c.luaJSON(expr, map[string]any{"winid": winid, "absolute_paths": absolutePaths})
+	if err != nil {
+		return "", fmt.Errorf("failed to get location list: %v", err)
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) NavigateLocationList(winid int, direction string, index int) (string, error) {
+	if err := c.checkWindow(winid); err != nil {
+		return "", err
+	}
+
+	var command string
+	switch {
+	case index > 0:
+		command = fmt.Sprintf("ll %d", index)
+	case direction == "next":
+		command = "lnext"
+	case direction == "prev":
+		command = "lprevious"
+	case direction == "first":
+		command = "lfirst"
+	case direction == "last":
+		command = "llast"
+	default:
+		return "", fmt.Errorf("invalid direction %q (expected next, prev, first or last)", direction)
+	}
+
+	// Run the navigation inside the target window so its location list is
+	// used, then report where that window ended up
+	expr := `
+		local win = args.winid ~= 0 and args.winid or vim.api.nvim_get_current_win()
+		local ok, err = pcall(vim.api.nvim_win_call, win, function()
+			vim.cmd(args.command)
+		end)
+		if not ok then
+			error(err)
+		end
+		local cursor = vim.api.nvim_win_get_cursor(win)
+		local info = vim.fn.getloclist(win, {idx = 0, items = 1, size = 1})
+		local current = info.items and info.items[info.idx] or {}
+		return {
+			winid = win,
+			current_index = info.idx or 0,
+			size = info.size or 0,
+			filename = vim.api.nvim_buf_get_name(vim.api.nvim_win_get_buf(win)),
+			line = cursor[1],
+			column = cursor[2] + 1,
+			text = current.text or '',
+		}`
+
+	output, err := c.luaJSON(expr, map[string]any{"winid": winid, "command": command})
+	if err != nil {
+		return "", fmt.Errorf("failed to navigate location list: %v", err)
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) JobStatus(jobID, maxLines int) (string, error) {
+	// jobwait() with a zero timeout polls without blocking: -1 means still
+	// running and -3 means the id is not a known job, which is also what it
+	// returns once a finished job's channel has been freed. Exit codes are
+	// therefore also taken from TermClose, recorded from the first call on,
+	// and from the "[Process exited N]" line a terminal ends with.
+	expr := `
+		_G.neovim_mcp_job_exits = _G.neovim_mcp_job_exits or {}
+		local exits = _G.neovim_mcp_job_exits
+		vim.api.nvim_create_autocmd('TermClose', {
+			group = vim.api.nvim_create_augroup('` + namespacePrefix + `jobs', {clear = true}),
+			callback = function(ev)
+				local id = vim.b[ev.buf].terminal_job_id
+				if id then
+					exits[id] = vim.v.event.status
+				end
+			end,
+		})
+
+		-- Terminal jobs keep their accumulated output in the terminal buffer
+		local terminal, lines
+		for _, buf in ipairs(vim.api.nvim_list_bufs()) do
+			if vim.b[buf].terminal_job_id == args.job_id then
+				local count = vim.api.nvim_buf_line_count(buf)
+				terminal = buf
+				lines = vim.api.nvim_buf_get_lines(buf, math.max(count - args.max_lines, 0), count, false)
+				while #lines > 0 and lines[#lines] == '' do
+					table.remove(lines)
+				end
+				break
+			end
+		end
+
+		local code = vim.fn.jobwait({args.job_id}, 0)[1]
+		if code == -3 then
+			code = exits[args.job_id]
+			if code == nil and lines and #lines > 0 then
+				code = tonumber(lines[#lines]:match('^%[Process exited (%-?%d+)%]$'))
+			end
+			if code == nil and not terminal then
+				error('job ' .. args.job_id .. ' does not exist, or exited without a terminal buffer that kept its status')
+			end
+		end
+
+		local result = {job_id = args.job_id}
+		if code == -1 then
+			result.status = 'running'
+			local ok, pid = pcall(vim.fn.jobpid, args.job_id)
+			if ok then
+				result.pid = pid
+			end
+		elseif code == nil then
+			-- The terminal outlived its job but not its exit status
+			result.status = 'exited'
+		else
+			result.status = code == 0 and 'exited' or 'failed'
+			result.exit_code = code
+		end
+		if terminal then
+			result.bufnr = terminal
+			result.output = table.concat(lines, '\n')
+		end
+		return result`
+
+	output, err := c.luaJSON(expr, map[string]any{"job_id": jobID, "max_lines": maxLines})
+	if err != nil {
+		return "", fmt.Errorf("failed to get job status: %v", err)
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) SpellErrors(bufnr, startLine, endLine int) (string, error) {
+	// spellbadword() only reports the first bad word of its argument, so each
+	// line is rescanned from just past the previous hit
+	expr := `
+		local buf = args.bufnr ~= 0 and args.bufnr or vim.api.nvim_get_current_buf()
+		if not vim.api.nvim_buf_is_loaded(buf) then
+			error('buffer ' .. buf .. ' is not loaded')
+		end
+		local result = {bufnr = buf, spell = false, errors = {}}
+		vim.api.nvim_buf_call(buf, function()
+			if not vim.wo.spell then
+				return
+			end
+			result.spell = true
+			result.spelllang = vim.bo.spelllang
+			local count = vim.api.nvim_buf_line_count(buf)
+			local first = math.max(args.start_line, 1)
+			local last = args.end_line > 0 and math.min(args.end_line, count) or count
+			local lines = vim.api.nvim_buf_get_lines(buf, first - 1, last, false)
+			for i, line in ipairs(lines) do
+				local col = 1
+				while col <= #line and #result.errors < args.max_errors do
+					local rest = line:sub(col)
+					local bad = vim.fn.spellbadword(rest)
+					local word, kind = bad[1], bad[2]
+					if word == '' then
+						break
+					end
+					local s = rest:find('%f[%w]' .. vim.pesc(word) .. '%f[%W]') or rest:find(word, 1, true)
+					if not s then
+						break
+					end
+					table.insert(result.errors, {
+						line = first + i - 1,
+						column = col + s - 1,
+						word = word,
+						kind = kind,
+						suggestions = vim.fn.spellsuggest(word, args.max_suggestions),
+					})
+					col = col + s - 1 + #word
+				end
+			end
+			result.truncated = #result.errors >= args.max_errors
+		end)
+		return result`
+
+	output, err := c.luaJSON(expr, map[string]any{
+		"bufnr":           bufnr,
+		"start_line":      startLine,
+		"end_line":        endLine,
+		"max_errors":      200,
+		"max_suggestions": 5,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get spelling errors: %v", err)
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) GetArglist() (string, error) {
+	expr := `
+		return {
+			files = vim.fn.argv(),
+			count = vim.fn.argc(),
+			current_index = vim.fn.argc() > 0 and vim.fn.argidx() + 1 or 0,
+		}`
+
+	output, err := c.luaJSON(expr, map[string]any{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get arglist: %v", err)
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) SetArglist(files []string) (string, error) {
+	// Rebuild the list with argdelete/argadd rather than :args so the current
+	// window is not switched to the first file
+	expr := `
+		vim.cmd('silent! %argdelete')
+		for _, file in ipairs(args.files) do
+			vim.cmd('argadd ' .. vim.fn.fnameescape(file))
+		end
+		return {
+			files = vim.fn.argv(),
+			count = vim.fn.argc(),
+			current_index = vim.fn.argc() > 0 and vim.fn.argidx() + 1 or 0,
+		}`
+
+	if files == nil {
+		files = []string{}
+	}
+
+	output, err := c.luaJSON(expr, map[string]any{"files": files})
+	if err != nil {
+		return "", fmt.Errorf("failed to set arglist: %v", err)
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) Snapshot() (string, error) {
+	// Everything is gathered in a single evaluation so the fields are
+	// consistent with each other and cost one round-trip
+	expr := `
+		local win = vim.api.nvim_get_current_win()
+		local buf = vim.api.nvim_get_current_buf()
+		local cursor = vim.api.nvim_win_get_cursor(win)
+		local row, col = cursor[1], cursor[2]
+		local result = {
+			bufnr = buf,
+			file_path = vim.api.nvim_buf_get_name(buf),
+			filetype = vim.bo[buf].filetype,
+			modified = vim.bo[buf].modified,
+			cursor = {line = row, col = col + 1},
+			mode = vim.api.nvim_get_mode().mode,
+			visible_range = {start_line = vim.fn.line('w0'), end_line = vim.fn.line('w$')},
+			line_count = vim.api.nvim_buf_line_count(buf),
+			current_line = vim.api.nvim_get_current_line(),
+		}
+
+		local ok, node = pcall(vim.treesitter.get_node)
+		while ok and node do
+			local kind = node:type()
+			if (kind:match('function') or kind:match('method')) and not kind:match('call') then
+				local start_row, _, end_row = node:range()
+				local name = node:field('name')[1]
+				result.enclosing_function = {
+					type = kind,
+					name = name and vim.treesitter.get_node_text(name, buf) or '',
+					start_line = start_row + 1,
+					end_line = end_row + 1,
+				}
+				break
+			end
+			node = node:parent()
+		end
+
+		local severity_map = {'ERROR', 'WARN', 'INFO', 'HINT'}
+		local under_cursor = {}
+		for _, diag in ipairs(vim.diagnostic.get(buf, {lnum = row - 1})) do
+			local end_col = diag.end_col or diag.col
+			local spans_line = (diag.end_lnum or diag.lnum) > diag.lnum
+			if diag.col <= col and (col < end_col or spans_line or diag.col == end_col) then
+				table.insert(under_cursor, {
+					line = diag.lnum + 1,
+					col = diag.col + 1,
+					severity = severity_map[diag.severity] or 'UNKNOWN',
+					source = diag.source,
+					message = diag.message,
+				})
+			end
+		end
+		result.diagnostics_under_cursor = under_cursor
+		return result`
+
+	output, err := c.luaJSON(expr, map[string]any{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get snapshot: %v", err)
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) MultiBufferEdit(edits map[int][]TextEdit, changedticks map[int]int) (string, error) {
+	if len(edits) == 0 {
+		return "", fmt.Errorf("no edits provided")
+	}
+
+	type bufferEdits struct {
+		Bufnr       int        `json:"bufnr"`
+		Changedtick int        `json:"changedtick"`
+		Edits       []TextEdit `json:"edits"`
+	}
+	var buffers []bufferEdits
+	for bufnr, bufEdits := range edits {
+		buffers = append(buffers, bufferEdits{
+			Bufnr:       bufnr,
+			Changedtick: changedticks[bufnr],
+			Edits:       bufEdits,
+		})
+	}
+
+	// All buffers are validated before anything is touched. If applying
+	// fails part way, every buffer already changed is undone back to the
+	// undo sequence it had before the call.
+	expr := `
+		local function validate(entry)
+			local buf = entry.bufnr
+			if not vim.api.nvim_buf_is_loaded(buf) then
+				return 'buffer is not loaded'
+			end
+			if not vim.bo[buf].modifiable then
+				return 'buffer is not modifiable'
+			end
+			if entry.changedtick > 0 and vim.api.nvim_buf_get_changedtick(buf) ~= entry.changedtick then
+				return 'buffer changed since changedtick ' .. entry.changedtick
+			end
+			local count = vim.api.nvim_buf_line_count(buf)
+			table.sort(entry.edits, function(a, b)
+				return a.start_line < b.start_line or (a.start_line == b.start_line and a.start_col < b.start_col)
+			end)
+			for i, e in ipairs(entry.edits) do
+				if e.start_line < 1 or e.end_line > count or e.start_line > e.end_line then
+					return string.format('edit %d: line range %d-%d outside buffer (1-%d)', i, e.start_line, e.end_line, count)
+				end
+				local start_text = vim.api.nvim_buf_get_lines(buf, e.start_line - 1, e.start_line, false)[1]
+				local end_text = vim.api.nvim_buf_get_lines(buf, e.end_line - 1, e.end_line, false)[1]
+				if e.start_col < 1 or e.start_col > #start_text + 1 or e.end_col < 1 or e.end_col > #end_text + 1 then
+					return string.format('edit %d: column outside line bounds', i)
+				end
+				if e.start_line == e.end_line and e.start_col > e.end_col then
+					return string.format('edit %d: start is after end', i)
+				end
+				local prev = entry.edits[i - 1]
+				if prev and (prev.end_line > e.start_line or (prev.end_line == e.start_line and prev.end_col > e.start_col)) then
+					return string.format('edits %d and %d overlap', i - 1, i)
+				end
+			end
+			return nil
+		end
+
+		local results = {}
+		local invalid = false
+		for _, entry in ipairs(args.buffers) do
+			local problem = validate(entry)
+			if problem then
+				invalid = true
+				table.insert(results, {bufnr = entry.bufnr, status = 'invalid', error = problem})
+			else
+				table.insert(results, {bufnr = entry.bufnr, status = 'pending', edits = #entry.edits})
+			end
+		end
+		if invalid then
+			return {applied = false, results = results}
+		end
+
+		local applied = {}
+		for i, entry in ipairs(args.buffers) do
+			local buf = entry.bufnr
+			local seq = vim.api.nvim_buf_call(buf, function()
+				return vim.fn.undotree().seq_cur
+			end)
+			table.insert(applied, {bufnr = buf, seq = seq})
+			local ok, err = pcall(function()
+				for j = #entry.edits, 1, -1 do
+					local e = entry.edits[j]
+					vim.api.nvim_buf_set_text(buf, e.start_line - 1, e.start_col - 1, e.end_line - 1, e.end_col - 1,
+						vim.split(e.new_text, '\n', {plain = true}))
+				end
+			end)
+			if not ok then
+				for _, done in ipairs(applied) do
+					pcall(vim.api.nvim_buf_call, done.bufnr, function()
+						vim.cmd('silent undo ' .. done.seq)
+					end)
+				end
+				for k, r in ipairs(results) do
+					r.status = k == i and 'failed' or 'rolled_back'
+					if k == i then
+						r.error = tostring(err)
+					end
+				end
+				return {applied = false, results = results}
+			end
+			results[i].status = 'applied'
+			results[i].changedtick = vim.api.nvim_buf_get_changedtick(buf)
+		end
+		return {applied = true, results = results}`
+
+	output, err := c.luaJSON(expr, map[string]any{"buffers": buffers})
+	if err != nil {
+		return "", fmt.Errorf("failed to apply multi-buffer edit: %v", err)
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) GetView(winid int) (string, error) {
+	if err := c.checkWindow(winid); err != nil {
+		return "", err
+	}
+
+	expr := `
+		local win = args.winid ~= 0 and args.winid or vim.api.nvim_get_current_win()
+		return {
+			winid = win,
+			view = vim.api.nvim_win_call(win, vim.fn.winsaveview),
+		}`
+
+	output, err := c.luaJSON(expr, map[string]any{"winid": winid})
+	if err != nil {
+		return "", fmt.Errorf("failed to get view: %v", err)
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) SetView(winid int, view map[string]any) (string, error) {
+	if err := c.checkWindow(winid); err != nil {
+		return "", err
+	}
+	if len(view) == 0 {
+		return "", fmt.Errorf("view cannot be empty")
+	}
+
+	expr := `
+		local win = args.winid ~= 0 and args.winid or vim.api.nvim_get_current_win()
+		vim.api.nvim_win_call(win, function()
+			vim.fn.winrestview(args.view)
+		end)
+		return {
+			winid = win,
+			view = vim.api.nvim_win_call(win, vim.fn.winsaveview),
+		}`
+
+	output, err := c.luaJSON(expr, map[string]any{"winid": winid, "view": view})
+	if err != nil {
+		return "", fmt.Errorf("failed to set view: %v", err)
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) SelectionDiff(replacement string) (string, error) {
+	// Uses the live selection when still in visual mode, otherwise the last
+	// one recorded by the '< and '> marks
+	expr := `
+		local mode = vim.api.nvim_get_mode().mode
+		local live = mode:sub(1, 1) == 'v' or mode:sub(1, 1) == 'V' or mode:sub(1, 1) == '\22'
+		local start_pos, end_pos, vmode
+		if live then
+			start_pos, end_pos, vmode = vim.fn.getpos('v'), vim.fn.getpos('.'), mode:sub(1, 1)
+		else
+			start_pos, end_pos, vmode = vim.fn.getpos("'<"), vim.fn.getpos("'>"), vim.fn.visualmode()
+		end
+		if start_pos[2] == 0 or end_pos[2] == 0 then
+			error('no visual selection in the current buffer')
+		end
+		if start_pos[2] > end_pos[2] or (start_pos[2] == end_pos[2] and start_pos[3] > end_pos[3]) then
+			start_pos, end_pos = end_pos, start_pos
+		end
+
+		local lines
+		if vim.fn.exists('*getregion') == 1 then
+			lines = vim.fn.getregion(start_pos, end_pos, {type = vmode ~= '' and vmode or 'v'})
+		else
+			lines = vim.api.nvim_buf_get_lines(0, start_pos[2] - 1, end_pos[2], false)
+		end
+		local original = table.concat(lines, '\n')
+
+		local diff_fn = (vim.text and vim.text.diff) or vim.diff
+		local a, b = original .. '\n', args.replacement .. '\n'
+		local diff = diff_fn(a, b, {result_type = 'unified', ctxlen = 3})
+		return {
+			live = live,
+			mode = vmode,
+			range = {
+				start_line = start_pos[2],
+				start_col = start_pos[3],
+				end_line = end_pos[2],
+				end_col = end_pos[3],
+			},
+			original = original,
+			changed = original ~= args.replacement,
+			diff = diff,
+		}`
+
+	output, err := c.luaJSON(expr, map[string]any{"replacement": replacement})
+	if err != nil {
+		return "", fmt.Errorf("failed to diff selection: %v", err)
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) TestResults() (string, error) {
+	// neotest only exposes aggregate status counts publicly, so per-entry
+	// outcomes come from the quickfix list that :make and test runners fill
+	expr := `
+		local result = {source = 'quickfix', adapters = {}, tests = {}}
+		local ok, neotest = pcall(require, 'neotest')
+		if ok and neotest.state and neotest.state.adapter_ids then
+			for _, adapter_id in ipairs(neotest.state.adapter_ids()) do
+				local adapter = {id = adapter_id, counts = neotest.state.status_counts(adapter_id) or {}, tests = {}}
+				local tree = neotest.state.positions(adapter_id)
+				if tree then
+					for _, pos in tree:iter() do
+						if pos.type == 'test' then
+							table.insert(adapter.tests, {
+								name = pos.name,
+								file = pos.path,
+								line = pos.range and pos.range[1] + 1 or 0,
+							})
+						end
+					end
+				end
+				table.insert(result.adapters, adapter)
+			end
+			if #result.adapters > 0 then
+				result.source = 'neotest'
+			end
+		end
+
+		local qf = vim.fn.getqflist({items = 1, title = 1})
+		result.quickfix_title = qf.title or ''
+		local status_map = {E = 'fail', W = 'fail', I = 'info', N = 'info'}
+		for _, item in ipairs(qf.items or {}) do
+			if item.valid == 1 then
+				table.insert(result.tests, {
+					status = status_map[item.type] or 'fail',
+					file = item.bufnr > 0 and vim.api.nvim_buf_get_name(item.bufnr) or '',
+					line = item.lnum,
+					column = item.col,
+					message = item.text,
+				})
+			end
+		end
+		return result`
+
+	output, err := c.luaJSON(expr, map[string]any{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get test results: %v", err)
+	}
+
+	return output, nil
+}
+
+// Namespace returns the id of the server-owned namespace with the given name,
+// creating it in Neovim on first use
+func (c *NvimClient) Namespace(name string) (int, error) {
+	c.nsMu.Lock()
+	defer c.nsMu.Unlock()
+
+	if id, ok := c.namespaces[name]; ok {
+		return id, nil
+	}
+
+	output, err := c.remoteExpr(fmt.Sprintf("nvim_create_namespace(\"%s\")", c.escapeVimString(namespacePrefix+name)))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create namespace: %v", err)
+	}
+
+	var id int
+	if _, err := fmt.Sscanf(output, "%d", &id); err != nil {
+		return 0, fmt.Errorf("unexpected namespace id %q", output)
+	}
+
+	if c.namespaces == nil {
+		c.namespaces = make(map[string]int)
+	}
+	c.namespaces[name] = id
+	return id, nil
+}
+
+// OwnedNamespace describes a namespace created by this server
+type OwnedNamespace struct {
+	Name string `json:"name"`
+	ID   int    `json:"id"`
+}
+
+func (c *NvimClient) ListOwnedNamespaces() ([]OwnedNamespace, error) {
+	// Namespaces from earlier server runs are only known to Neovim, so they
+	// are discovered by prefix and merged with the ones tracked here
+	expr := `
+		local owned = {}
+		for name, id in pairs(vim.api.nvim_get_namespaces()) do
+			if vim.startswith(name, args.prefix) then
+				table.insert(owned, {name = name:sub(#args.prefix + 1), id = id})
+			end
+		end
+		return owned`
+
+	output, err := c.luaJSON(expr, map[string]any{"prefix": namespacePrefix})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list namespaces: %v", err)
+	}
+
+	var namespaces []OwnedNamespace
+	// An empty Lua table encodes as {} rather than []
+	if output != "{}" {
+		if err := json.Unmarshal([]byte(output), &namespaces); err != nil {
+			return nil, fmt.Errorf("failed to decode namespaces: %v", err)
+		}
+	}
+
+	c.nsMu.Lock()
+	defer c.nsMu.Unlock()
+	if c.namespaces == nil {
+		c.namespaces = make(map[string]int)
+	}
+	for _, ns := range namespaces {
+		c.namespaces[ns.Name] = ns.ID
+	}
+
+	sort.Slice(namespaces, func(i, j int) bool {
+		return namespaces[i].Name < namespaces[j].Name
+	})
+	return namespaces, nil
+}
+
+// ClearNamespace removes highlights, extmarks and diagnostics of an owned
+// namespace from every buffer. An empty name clears all owned namespaces.
+func (c *NvimClient) ClearNamespace(name string) ([]string, error) {
+	namespaces, err := c.ListOwnedNamespaces()
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []int
+	var cleared []string
+	for _, ns := range namespaces {
+		if name == "" || ns.Name == name {
+			ids = append(ids, ns.ID)
+			cleared = append(cleared, ns.Name)
+		}
+	}
+	if name != "" && len(ids) == 0 {
+		return nil, fmt.Errorf("namespace %q is not owned by this server", name)
+	}
+	if len(ids) == 0 {
+		return cleared, nil
+	}
+
+	expr := `
+		for _, ns in ipairs(args.ids) do
+			for _, buf in ipairs(vim.api.nvim_list_bufs()) do
+				if vim.api.nvim_buf_is_loaded(buf) then
+					vim.api.nvim_buf_clear_namespace(buf, ns, 0, -1)
+				end
+			end
+			vim.diagnostic.reset(ns)
+		end
+		return true`
+
+	if _, err := c.luaJSON(expr, map[string]any{"ids": ids}); err != nil {
+		return nil, fmt.Errorf("failed to clear namespace: %v", err)
+	}
+
+	return cleared, nil
+}
+
+func (c *NvimClient) FiletypeProfile(bufnr int) (string, error) {
+	expr := `
+		local buf = args.bufnr ~= 0 and args.bufnr or vim.api.nvim_get_current_buf()
+		if not vim.api.nvim_buf_is_valid(buf) then
+			error('buffer ' .. buf .. ' does not exist')
+		end
+		local bo = vim.bo[buf]
+		local shiftwidth = bo.shiftwidth ~= 0 and bo.shiftwidth or bo.tabstop
+		return {
+			bufnr = buf,
+			filetype = bo.filetype,
+			commentstring = bo.commentstring,
+			comments = bo.comments,
+			indent = {
+				expandtab = bo.expandtab,
+				shiftwidth = bo.shiftwidth,
+				effective_shiftwidth = shiftwidth,
+				tabstop = bo.tabstop,
+				softtabstop = bo.softtabstop,
+				autoindent = bo.autoindent,
+				smartindent = bo.smartindent,
+				cindent = bo.cindent,
+				indentexpr = bo.indentexpr,
+				indentkeys = bo.indentkeys,
+			},
+			textwidth = bo.textwidth,
+			formatoptions = bo.formatoptions,
+			matchpairs = bo.matchpairs,
+			fileformat = bo.fileformat,
+			fixendofline = bo.fixendofline,
+		}`
+
+	output, err := c.luaJSON(expr, map[string]any{"bufnr": bufnr})
+	if err != nil {
+		return "", fmt.Errorf("failed to get filetype profile: %v", err)
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) LocalRename(line, col int, newName string, preview bool) (string, error) {
+	// Treesitter scopes the rename to the enclosing function and only touches
+	// nodes of the same type as the symbol, so fields or keys that happen to
+	// share the name are left alone. Without a parser, whole-word matches are
+	// renamed between the nearest function-like lines.
+	expr := `
+		local buf = vim.api.nvim_get_current_buf()
+		local row, col = args.line, args.col
+		if row == 0 then
+			local cursor = vim.api.nvim_win_get_cursor(0)
+			row, col = cursor[1], cursor[2] + 1
+		end
+		col = math.max(col, 1)
+		local count = vim.api.nvim_buf_line_count(buf)
+		if row < 1 or row > count then
+			error(string.format('line %d outside buffer (1-%d)', row, count))
+		end
+
+		local matches = {}
+		local name, method, scope_start, scope_end
+		local ok, node = pcall(vim.treesitter.get_node, {bufnr = buf, pos = {row - 1, col - 1}})
+		if ok and node and node:child_count() == 0 then
+			name = vim.treesitter.get_node_text(node, buf)
+			local target_type = node:type()
+			local scope = node:parent()
+			while scope do
+				local kind = scope:type()
+				if (kind:match('function') or kind:match('method')) and not kind:match('call') then
+					break
+				end
+				scope = scope:parent()
+			end
+			scope = scope or node:tree():root()
+			local sr, _, er = scope:range()
+			scope_start, scope_end = sr + 1, er + 1
+			local function collect(n)
+				for child in n:iter_children() do
+					if child:child_count() == 0 then
+						if child:type() == target_type and vim.treesitter.get_node_text(child, buf) == name then
+							local r, c1, _, c2 = child:range()
+							table.insert(matches, {line = r + 1, start_col = c1 + 1, end_col = c2 + 1})
+						end
+					else
+						collect(child)
+					end
+				end
+			end
+			collect(scope)
+			method = 'treesitter'
+		else
+			local text = vim.api.nvim_buf_get_lines(buf, row - 1, row, false)[1]
+			local s = col
+			while s > 1 and text:sub(s - 1, s - 1):match('[%w_]') do
+				s = s - 1
+			end
+			name = text:sub(s):match('^[%w_]+')
+			if not name then
+				error('no identifier at the given position')
+			end
+			local function is_function_line(l)
+				return l:match('%f[%w]function%f[%W]') or l:match('%f[%w]func%f[%W]')
+					or l:match('%f[%w]def%f[%W]') or l:match('%f[%w]fn%f[%W]')
+			end
+			local lines = vim.api.nvim_buf_get_lines(buf, 0, -1, false)
+			scope_start, scope_end = 1, #lines
+			for i = row, 1, -1 do
+				if is_function_line(lines[i]) then
+					scope_start = i
+					break
+				end
+			end
+			local indent = #lines[scope_start]:match('^%s*')
+			for i = math.max(row, scope_start) + 1, #lines do
+				if is_function_line(lines[i]) and #lines[i]:match('^%s*') <= indent then
+					scope_end = i - 1
+					break
+				end
+			end
+			local pattern = '%f[%w_]' .. vim.pesc(name) .. '%f[^%w_]'
+			for i = scope_start, scope_end do
+				local init = 1
+				while true do
+					local ms, me = lines[i]:find(pattern, init)
+					if not ms then
+						break
+					end
+					table.insert(matches, {line = i, start_col = ms, end_col = me + 1})
+					init = me + 1
+				end
+			end
+			method = 'word'
+		end
+
+		if #matches == 0 then
+			error('no references to ' .. name .. ' found')
+		end
+
+		local before = {}
+		for _, m in ipairs(matches) do
+			before[m.line] = before[m.line] or vim.api.nvim_buf_get_lines(buf, m.line - 1, m.line, false)[1]
+		end
+		local after = {}
+		for lnum, text in pairs(before) do
+			after[lnum] = text
+		end
+		for i = #matches, 1, -1 do
+			local m = matches[i]
+			after[m.line] = after[m.line]:sub(1, m.start_col - 1) .. args.new_name .. after[m.line]:sub(m.end_col)
+		end
+
+		local changes = {}
+		for lnum, text in pairs(before) do
+			table.insert(changes, {line = lnum, before = text, after = after[lnum]})
+		end
+		table.sort(changes, function(a, b) return a.line < b.line end)
+
+		if not args.preview then
+			for i = #matches, 1, -1 do
+				local m = matches[i]
+				vim.api.nvim_buf_set_text(buf, m.line - 1, m.start_col - 1, m.line - 1, m.end_col - 1, {args.new_name})
+			end
+		end
+
+		return {
+			name = name,
+			new_name = args.new_name,
+			method = method,
+			scope = {start_line = scope_start, end_line = scope_end},
+			references = #matches,
+			applied = not args.preview,
+			changes = changes,
+		}`
+
+	output, err := c.luaJSON(expr, map[string]any{
+		"line":     line,
+		"col":      col,
+		"new_name": newName,
+		"preview":  preview,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to rename: %v", err)
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) ModelineSettings(bufnr int) (string, error) {
+	// Neovim does not record which options a modeline set, so the modeline is
+	// re-parsed from the first and last 'modelines' lines and each option is
+	// reported with its effective and global values
+	expr := `
+		local buf = args.bufnr ~= 0 and args.bufnr or vim.api.nvim_get_current_buf()
+		if not vim.api.nvim_buf_is_loaded(buf) then
+			error('buffer ' .. buf .. ' is not loaded')
+		end
+		local result = {bufnr = buf, modeline = vim.bo[buf].modeline, modelines = vim.o.modelines, lines = {}, options = {}}
+		local count = vim.api.nvim_buf_line_count(buf)
+		local n = vim.o.modelines
+		local candidates = {}
+		for lnum = 1, math.min(n, count) do
+			candidates[lnum] = true
+		end
+		for lnum = math.max(count - n + 1, 1), count do
+			candidates[lnum] = true
+		end
+
+		local markers = {'vim[<=>]?%d*:', 'Vim:', 'vi:', 'ex:'}
+		local function options_from(text)
+			for _, marker in ipairs(markers) do
+				local s, e = text:find('^' .. marker)
+				if not s then
+					s, e = text:find('%s' .. marker)
+				end
+				if s then
+					local rest = text:sub(e + 1)
+					local set_form = rest:match('^%s*se?t?%s+(.*)$')
+					local opts = {}
+					if set_form then
+						local body = set_form:gsub('\\:', '\1'):match('^([^:]*):') or ''
+						for opt in body:gmatch('%S+') do
+							table.insert(opts, (opt:gsub('\1', ':')))
+						end
+					else
+						for opt in rest:gmatch('[^%s:]+') do
+							table.insert(opts, opt)
+						end
+					end
+					return opts
+				end
+			end
+			return nil
+		end
+
+		local win = vim.fn.bufwinid(buf)
+		local lnums = vim.tbl_keys(candidates)
+		table.sort(lnums)
+		for _, lnum in ipairs(lnums) do
+			local text = vim.api.nvim_buf_get_lines(buf, lnum - 1, lnum, false)[1]
+			local opts = options_from(text)
+			if opts and #opts > 0 then
+				table.insert(result.lines, {line = lnum, text = text})
+				for _, raw in ipairs(opts) do
+					local name = raw:match('^([%w_]+)')
+					local bare = name and name:gsub('^no', ''):gsub('^inv', '')
+					local entry = {raw = raw, name = name}
+					local info_fn = vim.api.nvim_get_option_info2 or function(o) return vim.api.nvim_get_option_info(o) end
+					local ok, info = pcall(info_fn, name, {})
+					if not ok and bare ~= name then
+						ok, info = pcall(info_fn, bare, {})
+					end
+					if ok then
+						local opt_scope = info.scope == 'win' and (win ~= -1 and {win = win} or nil) or {buf = buf}
+						entry.full_name = info.name
+						entry.scope = info.scope
+						if opt_scope then
+							entry.value = vim.api.nvim_get_option_value(info.name, opt_scope)
+						end
+						entry.global_value = vim.api.nvim_get_option_value(info.name, {scope = 'global'})
+						entry.differs = entry.value ~= nil and entry.value ~= entry.global_value
+					else
+						entry.error = 'unknown option'
+					end
+					table.insert(result.options, entry)
+				end
+			end
+		end
+		result.found = #result.lines > 0
+		return result`
+
+	output, err := c.luaJSON(expr, map[string]any{"bufnr": bufnr})
+	if err != nil {
+		return "", fmt.Errorf("failed to get modeline settings: %v", err)
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) OpenQuickfixEntry(index int, split string) (string, error) {
+	var command string
+	switch split {
+	case "", "none":
+		command = ""
+	case "horizontal":
+		command = "belowright sbuffer"
+	case "vertical":
+		command = "vertical belowright sbuffer"
+	case "tab":
+		command = "tab sbuffer"
+	case "preview":
+		command = "pedit"
+	default:
+		return "", fmt.Errorf("invalid split %q (expected none, horizontal, vertical, tab or preview)", split)
+	}
+
+	// The preview window is opened without leaving the current window; the
+	// other modes focus the window showing the entry
+	expr := `
+		local qf = vim.fn.getqflist({items = 1, size = 1})
+		if args.index < 1 or args.index > qf.size then
+			error(string.format('quickfix entry %d does not exist (list has %d entries)', args.index, qf.size))
+		end
+		local item = qf.items[args.index]
+		if item.bufnr == 0 then
+			error('quickfix entry ' .. args.index .. ' has no file')
+		end
+		vim.fn.setqflist({}, 'a', {idx = args.index})
+
+		local win
+		if args.command == '' then
+			if vim.bo.buftype == 'quickfix' then
+				vim.cmd('wincmd p')
+			end
+			vim.api.nvim_win_set_buf(0, item.bufnr)
+			win = vim.api.nvim_get_current_win()
+		elseif args.command == 'pedit' then
+			vim.cmd('pedit ' .. vim.fn.fnameescape(vim.api.nvim_buf_get_name(item.bufnr)))
+			for _, w in ipairs(vim.api.nvim_tabpage_list_wins(0)) do
+				if vim.wo[w].previewwindow then
+					win = w
+				end
+			end
+			if not win then
+				error('preview window could not be opened')
+			end
+		else
+			vim.cmd(args.command .. ' ' .. item.bufnr)
+			win = vim.api.nvim_get_current_win()
+		end
+
+		local line = math.min(math.max(item.lnum, 1), vim.api.nvim_buf_line_count(item.bufnr))
+		vim.api.nvim_win_set_cursor(win, {line, math.max(item.col - 1, 0)})
+		vim.api.nvim_win_call(win, function()
+			vim.cmd('normal! zv')
+		end)
+		local cursor = vim.api.nvim_win_get_cursor(win)
+		return {
+			index = args.index,
+			winid = win,
+			bufnr = item.bufnr,
+			file = vim.api.nvim_buf_get_name(item.bufnr),
+			cursor = {line = cursor[1], col = cursor[2] + 1},
+			focused = win == vim.api.nvim_get_current_win(),
+			text = item.text,
+		}`
+
+	output, err := c.luaJSON(expr, map[string]any{"index": index, "command": command})
+	if err != nil {
+		return "", fmt.Errorf("failed to open quickfix entry: %v", err)
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) DiagnosticConfig() (string, error) {
+	// vim.diagnostic.config() returns the merged configuration, so values the
+	// user never customized come back as Neovim's defaults
+	expr := `
+		local config = vim.diagnostic.config() or {}
+		local function enabled(value)
+			if type(value) == 'table' then
+				return true
+			end
+			return value == true
+		end
+		local function severity_names(value)
+			if type(value) ~= 'table' or type(value.severity) == 'nil' then
+				return nil
+			end
+			local names = {}
+			local sev = value.severity
+			if type(sev) == 'number' then
+				sev = {sev}
+			end
+			for k, v in pairs(sev) do
+				names[k] = type(v) == 'number' and vim.diagnostic.severity[v] or v
+			end
+			return names
+		end
+		-- Callbacks such as format functions cannot be encoded and are dropped
+		local function details(value)
+			if type(value) ~= 'table' then
+				return nil
+			end
+			local result = {}
+			for k, v in pairs(value) do
+				if type(v) == 'table' then
+					result[k] = details(v)
+				elseif type(v) ~= 'function' and type(v) ~= 'userdata' then
+					result[k] = v
+				end
+			end
+			return result
+		end
+		return {
+			virtual_text = enabled(config.virtual_text),
+			virtual_text_options = details(config.virtual_text),
+			virtual_lines = enabled(config.virtual_lines),
+			signs = enabled(config.signs),
+			underline = enabled(config.underline),
+			update_in_insert = config.update_in_insert == true,
+			severity_sort = enabled(config.severity_sort),
+			severity_sort_reverse = type(config.severity_sort) == 'table' and config.severity_sort.reverse == true,
+			float = details(config.float),
+			severity_filters = {
+				virtual_text = severity_names(config.virtual_text),
+				signs = severity_names(config.signs),
+				underline = severity_names(config.underline),
+			},
+		}`
+
+	output, err := c.luaJSON(expr, map[string]any{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get diagnostic config: %v", err)
+	}
+
+	return output, nil
+}
+
+// lspCompatLua defines Lua helpers that paper over the LSP client API change
+// in Neovim 0.11, where client functions became methods taking self
+const lspCompatLua = `
+	local nvim_011 = vim.fn.has('nvim-0.11') == 1
+	local function lsp_clients(filter)
+		return (vim.lsp.get_clients or vim.lsp.get_active_clients)(filter)
+	end
+	local function lsp_supports(client, method, buf)
+		if nvim_011 then
+			return client:supports_method(method, buf)
+		end
+		return client.supports_method(method, {bufnr = buf})
+	end
+	local function lsp_request_sync(client, method, params, timeout, buf)
+		if nvim_011 then
+			return client:request_sync(method, params, timeout, buf)
+		end
+		return client.request_sync(method, params, timeout, buf)
+	end
+`
+
+// projectPathsLua defines Lua helpers shared by tools that report paths:
+// project_root(buf) finds the root from the buffer's LSP clients, then the
+// nearest .git ancestor, then the cwd; relative_to(path, root) strips it.
+const projectPathsLua = `
+	local function project_root(buf)
+		for _, client in ipairs((vim.lsp.get_clients or vim.lsp.get_active_clients)({bufnr = buf})) do
+			if client.config.root_dir then
+				return client.config.root_dir, 'lsp'
+			end
+		end
+		local name = vim.api.nvim_buf_get_name(buf)
+		local start = name ~= '' and vim.fs.dirname(name) or vim.fn.getcwd()
+		local git = vim.fs.find('.git', {path = start, upward = true})[1]
+		if git then
+			return vim.fs.dirname(git), 'git'
+		end
+		return vim.fn.getcwd(), 'cwd'
+	end
+
+	local function relative_to(path, root)
+		if path == '' or not root then
+			return path
+		end
+		local normalized = vim.fs.normalize(path)
+		local prefix = vim.fs.normalize(root):gsub('/$', '') .. '/'
+		if normalized:sub(1, #prefix) == prefix then
+			return normalized:sub(#prefix + 1)
+		end
+		return path
+	end
+`
+
+func (c *NvimClient) RelativeToRoot(path string) (string, error) {
+	expr := projectPathsLua + `
+		local buf = vim.api.nvim_get_current_buf()
+		local path = args.path ~= '' and vim.fn.fnamemodify(args.path, ':p') or vim.api.nvim_buf_get_name(buf)
+		local existing = vim.fn.bufnr(path)
+		if existing > 0 then
+			buf = existing
+		end
+		local root, method = project_root(buf)
+		local relative = relative_to(path, root)
+		return {
+			path = path,
+			relative = relative,
+			root = root,
+			root_method = method,
+			inside_root = relative ~= path,
+		}`
+
+	output, err := c.luaJSON(expr, map[string]any{"path": path})
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve relative path: %v", err)
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) QuickfixDo(command string) (string, error) {
+	if strings.TrimSpace(command) == "" {
+		return "", fmt.Errorf("command cannot be empty")
+	}
+
+	// This walks the entries the way :cdo does, but one at a time so each
+	// entry gets its own result. Changes after the first one in a buffer are
+	// joined with undojoin, leaving a single undo step per buffer.
+	expr := `
+		local qf = vim.fn.getqflist({items = 1})
+		local results = {}
+		local changed_bufs = {}
+		local hidden = vim.o.hidden
+		vim.o.hidden = true
+		local ok_all, err_all = pcall(function()
+			for i, item in ipairs(qf.items or {}) do
+				if item.valid == 1 and item.bufnr > 0 then
+					local entry = {index = i, file = vim.api.nvim_buf_get_name(item.bufnr), line = item.lnum}
+					local ok, err = pcall(vim.cmd, 'silent cc ' .. i)
+					if ok then
+						local buf = vim.api.nvim_get_current_buf()
+						local tick = vim.api.nvim_buf_get_changedtick(buf)
+						if changed_bufs[buf] then
+							pcall(vim.cmd, 'undojoin')
+						end
+						ok, err = pcall(vim.cmd, args.command)
+						entry.changed = vim.api.nvim_buf_get_changedtick(buf) ~= tick
+						if entry.changed then
+							changed_bufs[buf] = true
+						end
+					end
+					entry.status = ok and 'ok' or 'error'
+					if not ok then
+						entry.error = tostring(err)
+					end
+					table.insert(results, entry)
+				end
+			end
+		end)
+		vim.o.hidden = hidden
+		if not ok_all then
+			error(err_all)
+		end
+
+		local modified = {}
+		for buf in pairs(changed_bufs) do
+			table.insert(modified, vim.api.nvim_buf_get_name(buf))
+		end
+		table.sort(modified)
+		return {command = args.command, entries = #results, results = results, modified_buffers = modified}`
+
+	output, err := c.luaJSON(expr, map[string]any{"command": strings.TrimPrefix(command, ":")})
+	if err != nil {
+		return "", fmt.Errorf("failed to run command over quickfix entries: %v", err)
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) SyntaxTree(bufnr, startLine, endLine, maxNodes int) (string, error) {
+	// Mirrors the :InspectTree layout: named nodes with field names and
+	// 0-based [row, col] ranges, limited to nodes overlapping the range
+	expr := `
+		local buf = args.bufnr ~= 0 and args.bufnr or vim.api.nvim_get_current_buf()
+		if not vim.api.nvim_buf_is_loaded(buf) then
+			error('buffer ' .. buf .. ' is not loaded')
+		end
+		local ok, parser = pcall(vim.treesitter.get_parser, buf)
+		if not ok or not parser then
+			error('no treesitter parser available for filetype ' .. vim.bo[buf].filetype)
+		end
+		local root = parser:parse()[1]:root()
+		local first, last = args.start_line - 1, args.end_line - 1
+
+		local out = {}
+		local nodes = 0
+		local truncated = false
+		local function emit(node, field, depth)
+			if nodes >= args.max_nodes then
+				truncated = true
+				return
+			end
+			local sr, sc, er, ec = node:range()
+			if er < first or sr > last then
+				return
+			end
+			nodes = nodes + 1
+			local prefix = string.rep('  ', depth) .. (field and (field .. ': ') or '')
+			table.insert(out, string.format('%s(%s [%d, %d] - [%d, %d]', prefix, node:type(), sr, sc, er, ec))
+			for child, child_field in node:iter_children() do
+				if child:named() then
+					emit(child, child_field, depth + 1)
+				end
+			end
+			out[#out] = out[#out] .. ')'
+		end
+		emit(root, nil, 0)
+
+		return {
+			bufnr = buf,
+			language = parser:lang(),
+			start_line = args.start_line,
+			end_line = args.end_line,
+			nodes = nodes,
+			truncated = truncated,
+			tree = table.concat(out, '\n'),
+		}`
+
+	output, err := c.luaJSON(expr, map[string]any{
+		"bufnr":      bufnr,
+		"start_line": startLine,
+		"end_line":   endLine,
+		"max_nodes":  maxNodes,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get syntax tree: %v", err)
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) CounterpartFile(bufnr int, open bool) (string, error) {
+	// Candidates come from projectionist and clangd when available, then
+	// from common naming conventions; the first existing one is chosen
+	expr := lspCompatLua + `
+		local buf = args.bufnr ~= 0 and args.bufnr or vim.api.nvim_get_current_buf()
+		local path = vim.api.nvim_buf_get_name(buf)
+		if path == '' then
+			error('buffer ' .. buf .. ' has no file name')
+		end
+		local dir, file = vim.fs.dirname(path), vim.fs.basename(path)
+		local stem, ext = file:match('^(.-)%.([^.]+)$')
+		stem, ext = stem or file, ext or ''
+		local candidates = {}
+		local seen = {}
+		local function add(candidate, source)
+			if candidate and candidate ~= path and not seen[candidate] then
+				seen[candidate] = true
+				table.insert(candidates, {path = candidate, source = source, exists = (vim.uv or vim.loop).fs_stat(candidate) ~= nil})
+			end
+		end
+
+		if vim.fn.exists('*projectionist#query_file') == 1 then
+			local ok, alternates = pcall(vim.api.nvim_buf_call, buf, function()
+				return vim.fn['projectionist#query_file']('alternate')
+			end)
+			if ok then
+				for _, alt in ipairs(alternates) do
+					add(alt, 'projectionist')
+				end
+			end
+		end
+
+		for _, client in ipairs(lsp_clients({bufnr = buf, name = 'clangd'})) do
+			local response = lsp_request_sync(client, 'textDocument/switchSourceHeader', {uri = vim.uri_from_bufnr(buf)}, 1000, buf)
+			if response and response.result then
+				add(vim.uri_to_fname(response.result), 'clangd')
+			end
+		end
+
+		local function join(...)
+			return table.concat({...}, '/')
+		end
+		local test_stem = stem:match('^(.*)_test$') or stem:match('^(.*)[._]spec$') or stem:match('^(.*)%.test$')
+			or stem:match('^test_(.*)$') or stem:match('^(.*)_spec$')
+		if ext == 'go' then
+			add(join(dir, test_stem and (test_stem .. '.go') or (stem .. '_test.go')), 'convention')
+		elseif ext == 'py' then
+			if test_stem then
+				add(join(dir, test_stem .. '.py'), 'convention')
+			else
+				add(join(dir, 'test_' .. stem .. '.py'), 'convention')
+				add(join(dir, stem .. '_test.py'), 'convention')
+			end
+		elseif ext == 'rb' then
+			add(join(dir, test_stem and (test_stem .. '.rb') or (stem .. '_spec.rb')), 'convention')
+		elseif vim.tbl_contains({'js', 'jsx', 'ts', 'tsx', 'mjs', 'cjs'}, ext) then
+			if test_stem then
+				add(join(dir, test_stem .. '.' .. ext), 'convention')
+			else
+				add(join(dir, stem .. '.test.' .. ext), 'convention')
+				add(join(dir, stem .. '.spec.' .. ext), 'convention')
+			end
+		end
+		local header_pairs = {
+			h = {'c', 'cpp', 'cc', 'm'}, hpp = {'cpp', 'cc'}, hh = {'cc', 'cpp'},
+			c = {'h'}, cpp = {'hpp', 'h', 'hh'}, cc = {'hh', 'h', 'hpp'}, m = {'h'},
+		}
+		for _, other in ipairs(header_pairs[ext] or {}) do
+			add(join(dir, stem .. '.' .. other), 'convention')
+		end
+
+		-- src/ <-> test/ directory swaps keep the rest of the relative path
+		local swaps = {{'/src/', '/test/'}, {'/src/', '/tests/'}, {'/lib/', '/test/'}, {'/test/', '/src/'}, {'/tests/', '/src/'}}
+		local current = #candidates
+		local mirrored = {path}
+		for i = 1, current do
+			table.insert(mirrored, candidates[i].path)
+		end
+		for _, base in ipairs(mirrored) do
+			for _, swap in ipairs(swaps) do
+				local s, e = base:find(swap[1], 1, true)
+				if s then
+					add(base:sub(1, s - 1) .. swap[2] .. base:sub(e + 1), 'directory')
+				end
+			end
+		end
+
+		local chosen
+		for _, candidate in ipairs(candidates) do
+			if candidate.exists then
+				chosen = candidate
+				break
+			end
+		end
+		chosen = chosen or candidates[1]
+
+		local opened = false
+		if args.open and chosen then
+			if not chosen.exists then
+				error('counterpart ' .. chosen.path .. ' does not exist')
+			end
+			vim.cmd('edit ' .. vim.fn.fnameescape(chosen.path))
+			opened = true
+		end
+
+		return {
+			file = path,
+			counterpart = chosen and chosen.path or '',
+			exists = chosen and chosen.exists or false,
+			source = chosen and chosen.source or '',
+			opened = opened,
+			candidates = candidates,
+		}`
+
+	output, err := c.luaJSON(expr, map[string]any{"bufnr": bufnr, "open": open})
+	if err != nil {
+		return "", fmt.Errorf("failed to find counterpart file: %v", err)
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) DetectIndent(bufnr int) (string, error) {
+	// Like guess-indent plugins, this looks at how indentation changes
+	// between consecutive non-blank lines rather than at absolute indents,
+	// which keeps deeply nested files from skewing the width
+	expr := `
+		local buf = args.bufnr ~= 0 and args.bufnr or vim.api.nvim_get_current_buf()
+		if not vim.api.nvim_buf_is_loaded(buf) then
+			error('buffer ' .. buf .. ' is not loaded')
+		end
+		local lines = vim.api.nvim_buf_get_lines(buf, 0, math.min(vim.api.nvim_buf_line_count(buf), args.max_lines), false)
+		local tabs, spaces = 0, 0
+		local deltas = {}
+		local prev = 0
+		for _, line in ipairs(lines) do
+			if line:match('%S') then
+				local lead = line:match('^[ \t]*')
+				if lead:sub(1, 1) == '\t' then
+					tabs = tabs + 1
+					prev = 0
+				elseif #lead > 0 and not line:match('^%s*%*') then
+					spaces = spaces + 1
+					local delta = math.abs(#lead - prev)
+					if delta > 0 and delta <= 8 then
+						deltas[delta] = (deltas[delta] or 0) + 1
+					end
+					prev = #lead
+				else
+					prev = #lead
+				end
+			end
+		end
+
+		local result = {bufnr = buf, sampled_lines = #lines}
+		local indented = tabs + spaces
+		if indented == 0 then
+			result.style = 'unknown'
+			result.confidence = 0
+		elseif tabs > spaces then
+			result.style = 'tabs'
+			result.confidence = tabs / indented
+		else
+			local best, best_count, total = 0, 0, 0
+			for width, n in pairs(deltas) do
+				total = total + n
+				if n > best_count then
+					best, best_count = width, n
+				end
+			end
+			result.style = 'spaces'
+			result.width = best > 0 and best or nil
+			result.confidence = (spaces / indented) * (total > 0 and best_count / total or 0)
+		end
+		result.lines_with_tabs = tabs
+		result.lines_with_spaces = spaces
+
+		local bo = vim.bo[buf]
+		result.options = {
+			expandtab = bo.expandtab,
+			shiftwidth = bo.shiftwidth,
+			tabstop = bo.tabstop,
+			softtabstop = bo.softtabstop,
+		}
+		local effective_width = bo.shiftwidth ~= 0 and bo.shiftwidth or bo.tabstop
+		result.matches_options = result.style == 'unknown'
+			or (result.style == 'tabs' and not bo.expandtab)
+			or (result.style == 'spaces' and bo.expandtab and (result.width == nil or result.width == effective_width))
+		return result`
+
+	output, err := c.luaJSON(expr, map[string]any{"bufnr": bufnr, "max_lines": 2000})
+	if err != nil {
+		return "", fmt.Errorf("failed to detect indentation: %v", err)
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) SetCmdline(text string, execute bool) (string, error) {
+	text = strings.TrimPrefix(text, ":")
+	if strings.ContainsAny(text, "\r\n") {
+		return "", fmt.Errorf("command line text must be a single line")
+	}
+
+	if execute {
+		if _, err := c.remoteExpr(fmt.Sprintf("histadd('cmd', \"%s\")", c.escapeVimString(text))); err != nil {
+			return "", fmt.Errorf("failed to add to command history: %v", err)
+		}
+		return c.ExecuteCommand(text)
+	}
+
+	// Leave insert/visual mode first so ':' opens the command line; the text
+	// is fed without a trailing <CR> so the user reviews it before running
+	expr := `
+		local esc = vim.api.nvim_replace_termcodes('<C-\\><C-n>', true, false, true)
+		vim.api.nvim_feedkeys(esc .. ':' .. args.text, 'n', false)
+		return true`
+
+	if _, err := c.luaJSON(expr, map[string]any{"text": text}); err != nil {
+		return "", fmt.Errorf("failed to set command line: %v", err)
+	}
+
+	return fmt.Sprintf("Command line pre-filled with: :%s", text), nil
+}
+
+func (c *NvimClient) FunctionSignatures(bufnr int) (string, error) {
+	// Declarations are cut at their body node so only the signature is kept.
+	// Buffers without a parser fall back to LSP document symbols, whose
+	// detail field usually holds the signature.
+	expr := `
+		local buf = args.bufnr ~= 0 and args.bufnr or vim.api.nvim_get_current_buf()
+		if not vim.api.nvim_buf_is_loaded(buf) then
+			error('buffer ' .. buf .. ' is not loaded')
+		end
+		local ft = vim.bo[buf].filetype
+		local functions = {}
+
+		local function field_text(node, names)
+			for _, name in ipairs(names) do
+				local child = node:field(name)[1]
+				if child then
+					return (vim.treesitter.get_node_text(child, buf):gsub('%s+', ' '))
+				end
+			end
+			return nil
+		end
+
+		local function visibility(node, name)
+			for child in node:iter_children() do
+				local kind = child:type()
+				if kind == 'visibility_modifier' or kind == 'accessibility_modifier' or kind == 'modifiers' then
+					return vim.treesitter.get_node_text(child, buf)
+				end
+			end
+			if ft == 'go' and name then
+				return name:match('^%u') and 'exported' or 'unexported'
+			end
+			if ft == 'python' and name then
+				return name:match('^_') and not name:match('^__.*__$') and 'private' or 'public'
+			end
+			return nil
+		end
+
+		local ok, parser = pcall(vim.treesitter.get_parser, buf)
+		if ok and parser then
+			local function walk(node)
+				for child in node:iter_children() do
+					local kind = child:type()
+					local is_function = (kind:match('function') or kind:match('method') or kind == 'constructor_declaration')
+						and (kind:match('declaration') or kind:match('definition') or kind:match('item') or kind == 'arrow_function')
+					if is_function then
+						local sr, sc = child:range()
+						local body = child:field('body')[1]
+						local er, ec
+						if body then
+							er, ec = body:range()
+						else
+							_, _, er, ec = child:range()
+						end
+						local text = table.concat(vim.api.nvim_buf_get_text(buf, sr, sc, er, ec, {}), ' ')
+						local name = field_text(child, {'name'})
+						table.insert(functions, {
+							name = name or '',
+							kind = kind,
+							line = sr + 1,
+							signature = vim.trim((text:gsub('%s+', ' '))),
+							parameters = field_text(child, {'parameters'}),
+							return_type = field_text(child, {'result', 'return_type', 'type'}),
+							receiver = field_text(child, {'receiver'}),
+							visibility = visibility(child, name),
+						})
+					end
+					walk(child)
+				end
+			end
+			walk(parser:parse()[1]:root())
+			return {bufnr = buf, source = 'treesitter', functions = functions}
+		end
+
+		local params = {textDocument = vim.lsp.util.make_text_document_params(buf)}
+		local responses = vim.lsp.buf_request_sync(buf, 'textDocument/documentSymbol', params, 2000) or {}
+		local wanted = {[6] = 'method', [9] = 'constructor', [12] = 'function'}
+		local function collect(symbols, container)
+			for _, sym in ipairs(symbols or {}) do
+				if wanted[sym.kind] then
+					local range = sym.range or (sym.location and sym.location.range)
+					table.insert(functions, {
+						name = sym.name,
+						kind = wanted[sym.kind],
+						line = range and range.start.line + 1 or 0,
+						signature = sym.detail or sym.name,
+						receiver = container or sym.containerName,
+					})
+				end
+				collect(sym.children, sym.name)
+			end
+		end
+		for _, response in pairs(responses) do
+			collect(response.result)
+		end
+		if #functions == 0 and next(responses) == nil then
+			error('no treesitter parser or LSP client available for filetype ' .. ft)
+		end
+		table.sort(functions, function(a, b) return a.line < b.line end)
+		return {bufnr = buf, source = 'lsp', functions = functions}`
+
+	output, err := c.luaJSON(expr, map[string]any{"bufnr": bufnr})
+	if err != nil {
+		return "", fmt.Errorf("failed to get function signatures: %v", err)
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) LspRequest(method string, params json.RawMessage, bufnr int) (string, error) {
+	if strings.TrimSpace(method) == "" {
+		return "", fmt.Errorf("method cannot be empty")
+	}
+
+	// Params travel as a JSON string so an empty object stays an object
+	// instead of becoming an empty Lua table
+	paramsJSON := ""
+	if len(params) > 0 {
+		if !json.Valid(params) {
+			return "", fmt.Errorf("params is not valid JSON")
+		}
+		paramsJSON = string(params)
+	}
+
+	expr := lspCompatLua + `
+		local buf = args.bufnr ~= 0 and args.bufnr or vim.api.nvim_get_current_buf()
+		local clients = lsp_clients({bufnr = buf})
+		if #clients == 0 then
+			error('no LSP clients attached to buffer ' .. buf)
+		end
+		local supporting = {}
+		for _, client in ipairs(clients) do
+			if lsp_supports(client, args.method, buf) then
+				table.insert(supporting, client)
+			end
+		end
+		if #supporting == 0 then
+			local names = {}
+			for _, client in ipairs(clients) do
+				table.insert(names, client.name)
+			end
+			error('no attached LSP client supports ' .. args.method .. ' (attached: ' .. table.concat(names, ', ') .. ')')
+		end
+
+		local results = {}
+		for _, client in ipairs(supporting) do
+			local params
+			if args.params ~= '' then
+				params = vim.json.decode(args.params)
+			else
+				local win = vim.fn.bufwinid(buf)
+				params = vim.lsp.util.make_position_params(win ~= -1 and win or 0, client.offset_encoding)
+			end
+			local response, err = lsp_request_sync(client, args.method, params, args.timeout_ms, buf)
+			local entry = {client = client.name, client_id = client.id}
+			if not response then
+				entry.error = err or 'request failed'
+			elseif response.err then
+				entry.error = response.err.message or vim.inspect(response.err)
+			else
+				entry.result = response.result == nil and vim.NIL or response.result
+			end
+			table.insert(results, entry)
+		end
+		return {method = args.method, bufnr = buf, responses = results}`
+
+	output, err := c.luaJSON(expr, map[string]any{
+		"method":     method,
+		"params":     paramsJSON,
+		"bufnr":      bufnr,
+		"timeout_ms": 5000,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to send LSP request: %v", err)
+	}
+
+	return output, nil
+}
+
+// undoStateLua reports a buffer's position in its undo tree
+const undoStateLua = `
+	local function undo_state(buf)
+		local tree = vim.api.nvim_buf_call(buf, vim.fn.undotree)
+		return {
+			bufnr = buf,
+			seq_cur = tree.seq_cur,
+			seq_last = tree.seq_last,
+			changedtick = vim.api.nvim_buf_get_changedtick(buf),
+			line_count = vim.api.nvim_buf_line_count(buf),
+			modified = vim.bo[buf].modified,
+		}
+	end
+`
+
+func (c *NvimClient) Checkpoint(bufnr int) (string, error) {
+	expr := undoStateLua + `
+		local buf = args.bufnr ~= 0 and args.bufnr or vim.api.nvim_get_current_buf()
+		if not vim.api.nvim_buf_is_loaded(buf) then
+			error('buffer ' .. buf .. ' is not loaded')
+		end
+		return undo_state(buf)`
+
+	output, err := c.luaJSON(expr, map[string]any{"bufnr": bufnr})
+	if err != nil {
+		return "", fmt.Errorf("failed to create checkpoint: %v", err)
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) RestoreCheckpoint(bufnr, seq int) (string, error) {
+	if seq < 0 {
+		return "", fmt.Errorf("invalid undo sequence number %d", seq)
+	}
+
+	// :undo N moves through the undo tree to the state right after change N,
+	// so edits made before the checkpoint are kept
+	expr := undoStateLua + `
+		local buf = args.bufnr ~= 0 and args.bufnr or vim.api.nvim_get_current_buf()
+		if not vim.api.nvim_buf_is_loaded(buf) then
+			error('buffer ' .. buf .. ' is not loaded')
+		end
+		local before = undo_state(buf)
+		if args.seq > before.seq_last then
+			error(string.format('undo sequence %d does not exist (latest is %d)', args.seq, before.seq_last))
+		end
+		vim.api.nvim_buf_call(buf, function()
+			vim.cmd('silent undo ' .. args.seq)
+		end)
+		local after = undo_state(buf)
+		after.restored_from = before.seq_cur
+		return after`
+
+	output, err := c.luaJSON(expr, map[string]any{"bufnr": bufnr, "seq": seq})
+	if err != nil {
+		return "", fmt.Errorf("failed to restore checkpoint: %v", err)
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) GroupDiagnostics(bufnr int) (string, error) {
+	// Diagnostics without a code are grouped by message instead, so
+	// unlabelled repeats of the same problem still cluster together
+	expr := `
+		local buf = args.bufnr ~= 0 and args.bufnr or vim.api.nvim_get_current_buf()
+		if not vim.api.nvim_buf_is_valid(buf) then
+			error('buffer ' .. buf .. ' does not exist')
+		end
+		local severity_map = {'ERROR', 'WARN', 'INFO', 'HINT'}
+		local groups = {}
+		local order = {}
+		for _, diag in ipairs(vim.diagnostic.get(buf)) do
+			local code = diag.code ~= nil and tostring(diag.code) or nil
+			local key = (diag.source or '') .. '\0' .. (code or diag.message)
+			local group = groups[key]
+			if not group then
+				group = {
+					source = diag.source or '',
+					code = code or '',
+					message = diag.message,
+					severity = severity_map[diag.severity] or 'UNKNOWN',
+					count = 0,
+					lines = {},
+					examples = {},
+				}
+				groups[key] = group
+				table.insert(order, key)
+			end
+			group.count = group.count + 1
+			table.insert(group.lines, diag.lnum + 1)
+			if #group.examples < args.max_examples then
+				table.insert(group.examples, {line = diag.lnum + 1, col = diag.col + 1, message = diag.message})
+			end
+			if diag.severity < ({ERROR = 1, WARN = 2, INFO = 3, HINT = 4})[group.severity] then
+				group.severity = severity_map[diag.severity]
+			end
+		end
+
+		local result = {}
+		for _, key in ipairs(order) do
+			local group = groups[key]
+			table.sort(group.lines)
+			table.insert(result, group)
+		end
+		table.sort(result, function(a, b)
+			if a.count ~= b.count then
+				return a.count > b.count
+			end
+			return a.lines[1] < b.lines[1]
+		end)
+		return {bufnr = buf, file = vim.api.nvim_buf_get_name(buf), groups = result}`
+
+	output, err := c.luaJSON(expr, map[string]any{"bufnr": bufnr, "max_examples": 3})
+	if err != nil {
+		return "", fmt.Errorf("failed to group diagnostics: %v", err)
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) ReadBufferDisplay(startLine, endLine int) (string, error) {
+	// The gutter follows Vim's own layout: with both 'number' and
+	// 'relativenumber' set the cursor line shows its absolute number
+	// left-aligned, every other line its distance from the cursor
+	expr := `
+		local win = vim.api.nvim_get_current_win()
+		local buf = vim.api.nvim_win_get_buf(win)
+		local wo = vim.wo[win]
+		local count = vim.api.nvim_buf_line_count(buf)
+		local cursor = vim.api.nvim_win_get_cursor(win)[1]
+		local first = math.max(args.start_line, 1)
+		local last = args.end_line > 0 and math.min(args.end_line, count) or count
+		last = math.min(last, first + args.max_lines - 1)
+		if first > count then
+			error(string.format('start line %d is past the end of the buffer (%d lines)', first, count))
+		end
+
+		local numbered = wo.number or wo.relativenumber
+		local width = 0
+		if numbered then
+			width = math.max(wo.numberwidth - 1, #tostring(wo.relativenumber and math.max(count, vim.api.nvim_win_get_height(win)) or count))
+		end
+
+		local signs = {}
+		local show_signs = wo.signcolumn ~= 'no' and wo.signcolumn ~= 'number'
+		if show_signs then
+			for _, placed in ipairs(vim.fn.sign_getplaced(buf, {group = '*'})[1].signs) do
+				local def = vim.fn.sign_getdefined(placed.name)[1]
+				if def and def.text and not signs[placed.lnum] then
+					signs[placed.lnum] = def.text
+				end
+			end
+			local ok, marks = pcall(vim.api.nvim_buf_get_extmarks, buf, -1, {first - 1, 0}, {last - 1, -1}, {details = true, type = 'sign'})
+			if ok then
+				for _, mark in ipairs(marks) do
+					local lnum = mark[2] + 1
+					if mark[4].sign_text and not signs[lnum] then
+						signs[lnum] = mark[4].sign_text
+					end
+				end
+			end
+		end
+
+		if show_signs and wo.signcolumn:match('^auto') and next(signs) == nil then
+			show_signs = false
+		end
+
+		local lines = vim.api.nvim_buf_get_lines(buf, first - 1, last, false)
+		local out = {}
+		for i, text in ipairs(lines) do
+			local lnum = first + i - 1
+			local gutter = ''
+			if show_signs then
+				local sign = signs[lnum] or ''
+				gutter = sign .. string.rep(' ', 2 - vim.fn.strdisplaywidth(sign))
+			end
+			if numbered then
+				local num
+				if wo.relativenumber and lnum ~= cursor then
+					num = string.format('%' .. width .. 'd', math.abs(lnum - cursor))
+				elseif wo.relativenumber and wo.number then
+					num = string.format('%-' .. width .. 'd', lnum)
+				elseif wo.relativenumber then
+					num = string.format('%' .. width .. 'd', 0)
+				else
+					num = string.format('%' .. width .. 'd', lnum)
+				end
+				gutter = gutter .. num .. ' '
+			end
+			table.insert(out, gutter .. text)
+		end
+
+		local result = {
+			bufnr = buf,
+			file = vim.api.nvim_buf_get_name(buf),
+			cursor_line = cursor,
+			number = wo.number,
+			relativenumber = wo.relativenumber,
+			signcolumn = wo.signcolumn,
+			start_line = first,
+			end_line = last,
+			line_count = count,
+			text = table.concat(out, '\n'),
+		}
+		return result`
+
+	output, err := c.luaJSON(expr, map[string]any{
+		"start_line": startLine,
+		"end_line":   endLine,
+		"max_lines":  maxDisplayLines,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to read buffer display: %v", err)
+	}
+
+	var display struct {
+		Bufnr          int    `json:"bufnr"`
+		File           string `json:"file"`
+		CursorLine     int    `json:"cursor_line"`
+		Number         bool   `json:"number"`
+		RelativeNumber bool   `json:"relativenumber"`
+		SignColumn     string `json:"signcolumn"`
+		StartLine      int    `json:"start_line"`
+		EndLine        int    `json:"end_line"`
+		LineCount      int    `json:"line_count"`
+		Text           string `json:"text"`
+	}
+	if err := json.Unmarshal([]byte(output), &display); err != nil {
+		return "", fmt.Errorf("failed to parse buffer display: %v", err)
+	}
+
+	var result strings.Builder
+	result.WriteString(fmt.Sprintf("Buffer %d: %s (lines %d-%d of %d, cursor on line %d)\n",
+		display.Bufnr, display.File, display.StartLine, display.EndLine, display.LineCount, display.CursorLine))
+	result.WriteString(fmt.Sprintf("Gutter: number=%t relativenumber=%t signcolumn=%s\n\n",
+		display.Number, display.RelativeNumber, display.SignColumn))
+	result.WriteString(display.Text)
+	if display.EndLine < display.LineCount {
+		result.WriteString(fmt.Sprintf("\n\n(truncated; continue from line %d)", display.EndLine+1))
+	}
+
+	return result.String(), nil
+}
+
+// maxDisplayLines caps how many lines a single read_buffer_display call returns
+const maxDisplayLines = 1000
+
+func (c *NvimClient) DetectRuntime(bufnr int) (string, error) {
+	// A shebang is the strongest signal since it is what the OS would run;
+	// project files only decide the command when they match the filetype
+	expr := projectPathsLua + `
+		local buf = args.bufnr ~= 0 and args.bufnr or vim.api.nvim_get_current_buf()
+		if not vim.api.nvim_buf_is_loaded(buf) then
+			error('buffer ' .. buf .. ' is not loaded')
+		end
+		local name = vim.api.nvim_buf_get_name(buf)
+		local ft = vim.bo[buf].filetype
+		local evidence = {}
+
+		local filetype_runtimes = {
+			python = 'python3', javascript = 'node', typescript = 'node', go = 'go', rust = 'rust',
+			lua = 'lua', sh = 'sh', bash = 'bash', zsh = 'zsh', fish = 'fish', ruby = 'ruby',
+			perl = 'perl', php = 'php', java = 'java', c = 'c', cpp = 'c++',
+		}
+		local markers = {
+			{file = 'package.json', runtime = 'node', filetypes = {javascript = true, typescript = true}},
+			{file = 'deno.json', runtime = 'deno', filetypes = {javascript = true, typescript = true}},
+			{file = 'go.mod', runtime = 'go', filetypes = {go = true}},
+			{file = 'Cargo.toml', runtime = 'rust', filetypes = {rust = true}},
+			{file = 'pyproject.toml', runtime = 'python3', filetypes = {python = true}},
+			{file = 'requirements.txt', runtime = 'python3', filetypes = {python = true}},
+			{file = 'setup.py', runtime = 'python3', filetypes = {python = true}},
+			{file = 'Gemfile', runtime = 'ruby', filetypes = {ruby = true}},
+		}
+
+		local result = {bufnr = buf, file = name, filetype = ft}
+
+		local first_line = vim.api.nvim_buf_get_lines(buf, 0, 1, false)[1] or ''
+		local shebang = first_line:match('^#!%s*(.+)$')
+		if shebang then
+			local parts = vim.split(vim.trim(shebang), '%s+')
+			local interpreter = parts[1]
+			local i = 2
+			if vim.fs.basename(interpreter) == 'env' then
+				while parts[i] and parts[i]:sub(1, 1) == '-' do
+					i = i + 1
+				end
+				interpreter = parts[i] or interpreter
+			end
+			result.shebang = first_line
+			result.interpreter = vim.fs.basename(interpreter)
+			table.insert(evidence, 'shebang: ' .. first_line)
+		end
+
+		local executable = name ~= '' and vim.fn.getfperm(name):sub(3, 3) == 'x'
+		result.executable = executable
+		if executable then
+			table.insert(evidence, 'file has the executable bit set')
+		end
+		if ft ~= '' then
+			table.insert(evidence, 'filetype: ' .. ft)
+		end
+
+		local root, method = project_root(buf)
+		result.project_root = root
+		result.project_root_method = method
+		local start = name ~= '' and vim.fs.dirname(name) or vim.fn.getcwd()
+		local project_files = {}
+		local project_runtime, project_dir
+		for _, marker in ipairs(markers) do
+			local found = vim.fs.find(marker.file, {path = start, upward = true, stop = vim.fs.dirname(root)})[1]
+			if found then
+				table.insert(project_files, found)
+				table.insert(evidence, 'project file: ' .. found)
+				if not project_runtime and marker.filetypes[ft] then
+					project_runtime = marker.runtime
+					project_dir = vim.fs.dirname(found)
+				end
+			end
+		end
+		result.project_files = project_files
+
+		local target = name ~= '' and vim.fn.shellescape(relative_to(name, vim.fn.getcwd())) or nil
+		local runtime = result.interpreter or project_runtime or filetype_runtimes[ft]
+		result.runtime = runtime or ''
+
+		local run
+		if not target then
+			run = nil
+		elseif result.shebang and executable then
+			local rel = relative_to(name, vim.fn.getcwd())
+			run = vim.fn.shellescape(rel == name and name or './' .. rel)
+		elseif result.interpreter then
+			run = result.interpreter .. ' ' .. target
+		elseif project_runtime == 'go' then
+			run = 'go run ' .. vim.fn.shellescape(vim.fs.dirname(name))
+		elseif project_runtime == 'rust' then
+			run = 'cargo run --manifest-path ' .. vim.fn.shellescape(project_dir .. '/Cargo.toml')
+		elseif project_runtime == 'deno' then
+			run = 'deno run ' .. target
+		elseif ft == 'typescript' then
+			run = 'npx tsx ' .. target
+		elseif runtime == 'go' then
+			run = 'go run ' .. target
+		elseif runtime == 'rust' then
+			run = 'rustc ' .. target .. ' -o /tmp/a.out && /tmp/a.out'
+		elseif runtime == 'c' or runtime == 'c++' then
+			run = (runtime == 'c' and 'cc ' or 'c++ ') .. target .. ' -o /tmp/a.out && /tmp/a.out'
+		elseif runtime == 'java' then
+			run = 'java ' .. target
+		elseif runtime then
+			run = runtime .. ' ' .. target
+		end
+		result.run_command = run or ''
+		local executables = {rust = 'cargo', c = 'cc'}
+		result.available = runtime ~= nil and vim.fn.executable(executables[runtime] or runtime) == 1
+		result.evidence = evidence
+		return result`
+
+	output, err := c.luaJSON(expr, map[string]any{"bufnr": bufnr})
+	if err != nil {
+		return "", fmt.Errorf("failed to detect runtime: %v", err)
+	}
+
+	return output, nil
+}
+
+// WatchHandlers receive the notifications Neovim sends over the RPC channel
+// for watches. They run one at a time on the connection's notification
+// goroutine, so they must not wait on Neovim themselves. Any may be nil.
+type WatchHandlers struct {
+	// BufferChanged is called for every nvim_buf_lines_event and
+	// nvim_buf_changedtick_event of an attached buffer
+	BufferChanged func(bufnr int)
+
+	// BufferDetached is called when Neovim ends an attachment, e.g. because
+	// the buffer was unloaded
+	BufferDetached func(bufnr int)
+
+	// EventFired is called for every autocommand event of a watch_event
+	// watch
+	EventFired func(event FiredEvent)
+
+	// Reconnected is called after a dropped connection is redialed; the
+	// attachments made on the old one have to be made again and event
+	// watches pointed at the new one with RedirectEvents
+	Reconnected func()
+}
+
+// eventFiredMethod is the rpcnotify method event watches report through
+const eventFiredMethod = "neovim_mcp_event"
+
+// registerHandlers routes the watch notifications arriving on v to handlers
+func (c *NvimClient) registerHandlers(v *nvim.Nvim) error {
+	h := c.handlers
+	bufferEvent := func(fn func(int)) func(nvim.Buffer) {
+		return func(buffer nvim.Buffer) {
+			if fn != nil {
+				fn(int(buffer))
+			}
+		}
+	}
+	for method, fn := range map[string]func(nvim.Buffer){
+		nvim.EventBufLines:       bufferEvent(h.BufferChanged),
+		nvim.EventBufChangedtick: bufferEvent(h.BufferChanged),
+		nvim.EventBufDetach:      bufferEvent(h.BufferDetached),
+	} {
+		if err := v.RegisterHandler(method, fn); err != nil {
+			return err
+		}
+	}
+	return v.RegisterHandler(eventFiredMethod, func(payload string) {
+		var event FiredEvent
+		if err := json.Unmarshal([]byte(payload), &event); err != nil {
+			slog.Warn("could not parse autocommand event", "err", err)
+			return
+		}
+		if h.EventFired != nil {
+			h.EventFired(event)
+		}
+	})
+}
+
+// channelID returns Neovim's id for the RPC connection, which Lua code passes
+// to rpcnotify to reach this client
+func (c *NvimClient) channelID() (int, error) {
+	var id int
+	if err := c.call(func(v *nvim.Nvim) error {
+		id = v.ChannelID()
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	if id == 0 {
+		return 0, fmt.Errorf("could not get the RPC channel id")
+	}
+	return id, nil
+}
+
+// WatchBuffer attaches to a loaded buffer (0 for the current one) so that its
+// changes arrive through handlers. Attaching an attached buffer again is a
+// no-op.
+func (c *NvimClient) WatchBuffer(bufnr int) (int, error) {
+	buffer := nvim.Buffer(bufnr)
+	var attached bool
+	err := c.call(func(v *nvim.Nvim) error {
+		var err error
+		if buffer == 0 {
+			if buffer, err = v.CurrentBuffer(); err != nil {
+				return err
+			}
+		}
+		loaded, err := v.IsBufferLoaded(buffer)
+		if err != nil {
+			return err
+		}
+		if !loaded {
+			return fmt.Errorf("buffer %d is not loaded", buffer)
+		}
+		attached, err = v.AttachBuffer(buffer, false, map[string]interface{}{})
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to watch buffer: %v", err)
+	}
+	if !attached {
+		return 0, fmt.Errorf("failed to watch buffer: could not attach to buffer %d", buffer)
+	}
+
+	return int(buffer), nil
+}
+
+// UnwatchBuffer detaches from a buffer
+func (c *NvimClient) UnwatchBuffer(bufnr int) error {
+	// An unloaded buffer has already been detached
+	if err := c.call(func(v *nvim.Nvim) error {
+		_, err := v.DetachBuffer(nvim.Buffer(bufnr))
+		return err
+	}); err != nil {
+		return fmt.Errorf("failed to unwatch buffer: %v", err)
+	}
+
+	return nil
+}
+
+// CurrentBufnr returns the number of the current buffer
+func (c *NvimClient) CurrentBufnr() (int, error) {
+	var buffer nvim.Buffer
+	if err := c.call(func(v *nvim.Nvim) error {
+		var err error
+		buffer, err = v.CurrentBuffer()
+		return err
+	}); err != nil {
+		return 0, fmt.Errorf("failed to get current buffer: %v", err)
+	}
+
+	return int(buffer), nil
+}
+
+// BufferSnapshot is a buffer's text together with the changedtick it was
+// read at, so a later write can detect intervening edits
+type BufferSnapshot struct {
+	Text        string `json:"text"`
+	Changedtick int    `json:"changedtick"`
+	Filetype    string `json:"filetype"`
+}
+
+func (c *NvimClient) BufferText(bufnr int) (*BufferSnapshot, error) {
+	// Lines and tick are read in the same call, so no edit can land between
+	expr := `
+		local buf = args.bufnr
+		if not vim.api.nvim_buf_is_loaded(buf) then
+			error('buffer ' .. buf .. ' is not loaded')
+		end
+		local text = table.concat(vim.api.nvim_buf_get_lines(buf, 0, -1, false), '\n')
+		return {text = text, changedtick = vim.api.nvim_buf_get_changedtick(buf), filetype = vim.bo[buf].filetype}`
+
+	output, err := c.luaJSON(expr, map[string]any{"bufnr": bufnr})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read buffer: %v", err)
+	}
+
+	var snapshot BufferSnapshot
+	if err := json.Unmarshal([]byte(output), &snapshot); err != nil {
+		return nil, fmt.Errorf("failed to parse buffer text: %v", err)
+	}
+
+	return &snapshot, nil
+}
+
+func (c *NvimClient) RangeCodeAction(startLine, startCol, endLine, endCol int, kind string, index int, preview, verify bool) (string, error) {
+	// Without an index the actions are only listed; with one the action is
+	// resolved and either previewed as a diff against scratch copies of the
+	// affected files or applied
+	expr := lspCompatLua + `
+		local buf = vim.api.nvim_get_current_buf()
+		local line_count = vim.api.nvim_buf_line_count(buf)
+		if args.start_line < 1 or args.end_line > line_count or args.start_line > args.end_line then
+			error(string.format('invalid range %d-%d (buffer has %d lines)', args.start_line, args.end_line, line_count))
+		end
+
+		local clients = {}
+		for _, client in ipairs(lsp_clients({bufnr = buf})) do
+			if lsp_supports(client, 'textDocument/codeAction', buf) then
+				table.insert(clients, client)
+			end
+		end
+		if #clients == 0 then
+			error('no attached LSP client supports code actions')
+		end
+
+		local function lsp_position(client, line, col)
+			local text = vim.api.nvim_buf_get_lines(buf, line - 1, line, false)[1] or ''
+			col = math.min(col, #text + 1)
+			local character = col - 1
+			local ok, offset = pcall(vim.lsp.util.character_offset, buf, line - 1, col - 1, client.offset_encoding)
+			if ok and offset then
+				character = offset
+			end
+			return {line = line - 1, character = character}
+		end
+
+		local diagnostics = {}
+		for _, diag in ipairs(vim.diagnostic.get(buf)) do
+			if diag.lnum + 1 <= args.end_line and (diag.end_lnum or diag.lnum) + 1 >= args.start_line then
+				if diag.user_data and diag.user_data.lsp then
+					table.insert(diagnostics, diag.user_data.lsp)
+				end
+			end
+		end
+
+		local actions = {}
+		local ranged = {}
+		for _, client in ipairs(clients) do
+			local params = {
+				textDocument = {uri = vim.uri_from_bufnr(buf)},
+				range = {
+					start = lsp_position(client, args.start_line, math.max(args.start_col, 1)),
+					['end'] = lsp_position(client, args.end_line, math.max(args.end_col, 1)),
+				},
+				context = {diagnostics = diagnostics, only = args.kind ~= '' and {args.kind} or nil},
+			}
+			local response = lsp_request_sync(client, 'textDocument/codeAction', params, args.timeout_ms, buf)
+			if response and not response.err then
+				ranged[client.name] = true
+				for _, action in ipairs(response.result or {}) do
+					if args.kind == '' or (action.kind or ''):sub(1, #args.kind) == args.kind then
+						table.insert(actions, {client = client, action = action})
+					end
+				end
+			elseif response and response.err then
+				ranged[client.name] = response.err.message or 'request failed'
+			end
+		end
+
+		if args.index == 0 then
+			local listed = {}
+			for i, entry in ipairs(actions) do
+				local action = entry.action
+				table.insert(listed, {
+					index = i,
+					title = action.title,
+					kind = action.kind or '',
+					client = entry.client.name,
+					preferred = action.isPreferred or false,
+					disabled = action.disabled and action.disabled.reason or vim.NIL,
+					has_edit = action.edit ~= nil,
+					has_command = action.command ~= nil,
+				})
+			end
+			local unsupported = {}
+			for name, status in pairs(ranged) do
+				if status ~= true then
+					table.insert(unsupported, name .. ': ' .. status)
+				end
+			end
+			return {
+				actions = #listed > 0 and listed or vim.NIL,
+				count = #listed,
+				errors = #unsupported > 0 and unsupported or vim.NIL,
+			}
+		end
+
+		local entry = actions[args.index]
+		if not entry then
+			error(string.format('no code action %d (%d available)', args.index, #actions))
+		end
+		local client, action = entry.client, entry.action
+		if action.disabled then
+			error('code action is disabled: ' .. (action.disabled.reason or 'no reason given'))
+		end
+		if not action.edit and type(action.command) ~= 'string' and lsp_supports(client, 'codeAction/resolve', buf) then
+			local response = lsp_request_sync(client, 'codeAction/resolve', action, args.timeout_ms, buf)
+			if response and response.result then
+				action = response.result
+			end
+		end
+
+		-- A bare Command is returned as the action itself
+		local command = action.command
+		if type(command) == 'string' then
+			command = {command = action.command, arguments = action.arguments, title = action.title}
+		end
+
+		local document_edits = {}
+		local unsupported_ops = {}
+		if action.edit then
+			for uri, edits in pairs(action.edit.changes or {}) do
+				table.insert(document_edits, {uri = uri, edits = edits})
+			end
+			for _, change in ipairs(action.edit.documentChanges or {}) do
+				if change.kind then
+					table.insert(unsupported_ops, change.kind)
+				else
+					table.insert(document_edits, {uri = change.textDocument.uri, edits = change.edits})
+				end
+			end
+		end
+
+		if args.preview then
+			local diff_fn = (vim.text and vim.text.diff) or vim.diff
+			local files = {}
+			for _, doc in ipairs(document_edits) do
+				local target = vim.uri_to_bufnr(doc.uri)
+				vim.fn.bufload(target)
+				local before = vim.api.nvim_buf_get_lines(target, 0, -1, false)
+				local scratch = vim.api.nvim_create_buf(false, true)
+				vim.api.nvim_buf_set_lines(scratch, 0, -1, false, before)
+				vim.lsp.util.apply_text_edits(doc.edits, scratch, client.offset_encoding)
+				local after = vim.api.nvim_buf_get_lines(scratch, 0, -1, false)
+				vim.api.nvim_buf_delete(scratch, {force = true})
+				table.insert(files, {
+					file = vim.uri_to_fname(doc.uri),
+					edits = #doc.edits,
+					diff = diff_fn(table.concat(before, '\n') .. '\n', table.concat(after, '\n') .. '\n', {result_type = 'unified', ctxlen = 3}),
+				})
+			end
+			return {
+				title = action.title,
+				kind = action.kind or '',
+				preview = true,
+				files = #files > 0 and files or vim.NIL,
+				command = command and command.command or vim.NIL,
+				unsupported_operations = #unsupported_ops > 0 and unsupported_ops or vim.NIL,
+			}
+		end
+
+		-- Diagnostics are matched by file, source, code and message rather
+		-- than position, since the edit itself shifts lines around
+		local tracked = {[buf] = true}
+		for _, doc in ipairs(document_edits) do
+			tracked[vim.uri_to_bufnr(doc.uri)] = true
+		end
+		local function collect_diagnostics()
+			local collected = {}
+			for tracked_buf in pairs(tracked) do
+				for _, diag in ipairs(vim.diagnostic.get(tracked_buf)) do
+					local file = vim.api.nvim_buf_get_name(tracked_buf)
+					local key = table.concat({file, diag.source or '', tostring(diag.code or ''), diag.message}, '\0')
+					collected[key] = collected[key] or {}
+					table.insert(collected[key], {
+						file = file,
+						line = diag.lnum + 1,
+						col = diag.col + 1,
+						severity = vim.diagnostic.severity[diag.severity] or 'UNKNOWN',
+						source = diag.source or '',
+						code = diag.code ~= nil and tostring(diag.code) or '',
+						message = diag.message,
+					})
+				end
+			end
+			return collected
+		end
+		local before, republished, autocmd
+		if args.verify then
+			before = collect_diagnostics()
+			republished = {}
+			autocmd = vim.api.nvim_create_autocmd('DiagnosticChanged', {
+				callback = function(ev)
+					republished[ev.buf] = true
+				end,
+			})
+		end
+
+		if action.edit then
+			vim.lsp.util.apply_workspace_edit(action.edit, client.offset_encoding)
+		end
+		local command_result = vim.NIL
+		if command then
+			local response = lsp_request_sync(client, 'workspace/executeCommand', {command = command.command, arguments = command.arguments}, args.timeout_ms, buf)
+			if response and response.err then
+				error('command ' .. command.command .. ' failed: ' .. (response.err.message or 'unknown error'))
+			end
+			command_result = command.command
+		end
+		local files = {}
+		for _, doc in ipairs(document_edits) do
+			table.insert(files, vim.uri_to_fname(doc.uri))
+		end
+		local result = {
+			title = action.title,
+			kind = action.kind or '',
+			applied = true,
+			files = #files > 0 and files or vim.NIL,
+			command = command_result,
+		}
+
+		if args.verify then
+			-- Wait for the servers to republish every affected buffer, or
+			-- give up after the timeout and compare what is there
+			local settled = vim.wait(args.verify_wait_ms, function()
+				for tracked_buf in pairs(tracked) do
+					if not republished[tracked_buf] then
+						return false
+					end
+				end
+				return true
+			end, 50)
+			pcall(vim.api.nvim_del_autocmd, autocmd)
+			local after = collect_diagnostics()
+			local resolved, appeared = {}, {}
+			for key, entries in pairs(before) do
+				for i = (after[key] and #after[key] or 0) + 1, #entries do
+					table.insert(resolved, entries[i])
+				end
+			end
+			for key, entries in pairs(after) do
+				for i = (before[key] and #before[key] or 0) + 1, #entries do
+					table.insert(appeared, entries[i])
+				end
+			end
+			result.diagnostics = {
+				settled = settled,
+				resolved = #resolved > 0 and resolved or vim.NIL,
+				appeared = #appeared > 0 and appeared or vim.NIL,
+				resolved_count = #resolved,
+				appeared_count = #appeared,
+			}
+		end
+		return result`
+
+	output, err := c.luaJSON(expr, map[string]any{
+		"start_line":     startLine,
+		"start_col":      startCol,
+		"end_line":       endLine,
+		"end_col":        endCol,
+		"kind":           kind,
+		"index":          index,
+		"preview":        preview,
+		"verify":         verify,
+		"verify_wait_ms": 2000,
+		"timeout_ms":     5000,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to run range code action: %v", err)
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) GfTarget(line, col int) (string, error) {
+	// Vim has no way to set v:fname from script, so 'includeexpr' is
+	// evaluated with v:fname replaced by the quoted filename
+	expr := `
+		local win = vim.api.nvim_get_current_win()
+		local buf = vim.api.nvim_win_get_buf(win)
+		local view = vim.fn.winsaveview()
+		if args.line > 0 then
+			local count = vim.api.nvim_buf_line_count(buf)
+			if args.line > count then
+				vim.fn.winrestview(view)
+				error(string.format('line %d is past the end of the buffer (%d lines)', args.line, count))
+			end
+			vim.api.nvim_win_set_cursor(win, {args.line, math.max(args.col, 1) - 1})
+		end
+		local cursor = vim.api.nvim_win_get_cursor(win)
+		local cfile = vim.fn.expand('<cfile>')
+		local cword = vim.fn.expand('<cWORD>')
+		local candidates = {}
+		if cfile ~= '' then
+			candidates = vim.fn.findfile(cfile, vim.bo[buf].path, -1)
+		end
+		vim.fn.winrestview(view)
+
+		local result = {
+			bufnr = buf,
+			line = cursor[1],
+			col = cursor[2] + 1,
+			cfile = cfile,
+			path = vim.bo[buf].path ~= '' and vim.bo[buf].path or vim.o.path,
+			includeexpr = vim.bo[buf].includeexpr,
+			suffixesadd = vim.bo[buf].suffixesadd,
+			exists = false,
+		}
+		if cfile == '' then
+			result.resolved = vim.NIL
+			return result
+		end
+
+		local function found(path, method)
+			result.resolved = vim.fn.fnamemodify(path, ':p')
+			result.exists = vim.fn.filereadable(path) == 1 or vim.fn.isdirectory(path) == 1
+			result.method = method
+		end
+
+		if cfile:match('^%a[%w+.-]*://') then
+			result.resolved = cfile
+			result.method = 'url'
+		elseif #candidates > 0 then
+			found(candidates[1], cfile:sub(1, 1) == '/' and 'absolute' or 'path')
+		elseif result.includeexpr ~= '' then
+			local expr = result.includeexpr:gsub('v:fname', (vim.fn.string(cfile):gsub('%%', '%%%%')))
+			local ok, transformed = pcall(vim.api.nvim_buf_call, buf, function()
+				return vim.fn.eval(expr)
+			end)
+			if ok and type(transformed) == 'string' and transformed ~= '' then
+				result.includeexpr_result = transformed
+				local via = vim.fn.findfile(transformed, vim.bo[buf].path, -1)
+				if #via > 0 then
+					found(via[1], 'includeexpr')
+				end
+			end
+		end
+		if not result.resolved then
+			result.resolved = vim.NIL
+		end
+
+		-- gF also honours a trailing line number such as file.go:42
+		local gF_line = cword:match(':(%d+)') or cword:match('%((%d+)%)')
+		if gF_line then
+			result.gF_line = tonumber(gF_line)
+		end
+		if #candidates > 1 then
+			result.other_matches = vim.list_slice(candidates, 2, 10)
+		end
+		return result`
+
+	output, err := c.luaJSON(expr, map[string]any{"line": line, "col": col})
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve gf target: %v", err)
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) LayoutTree(tabpage int) (string, error) {
+	// winlayout() nests 'row' (side by side) and 'col' (stacked) nodes
+	// around 'leaf' windows; floating windows are not part of it
+	expr := `
+		local tabnr = args.tabpage ~= 0 and args.tabpage or vim.fn.tabpagenr()
+		if tabnr < 1 or tabnr > vim.fn.tabpagenr('$') then
+			error(string.format('tabpage %d does not exist (%d open)', tabnr, vim.fn.tabpagenr('$')))
+		end
+		local current = vim.api.nvim_get_current_win()
+		local diagram = {}
+
+		local function annotate(node, depth)
+			local indent = string.rep('  ', depth)
+			if node[1] == 'leaf' then
+				local win = node[2]
+				local buf = vim.api.nvim_win_get_buf(win)
+				local name = vim.api.nvim_buf_get_name(buf)
+				local display = name ~= '' and vim.fn.fnamemodify(name, ':~:.') or '[No Name]'
+				local leaf = {
+					type = 'leaf',
+					winid = win,
+					bufnr = buf,
+					name = display,
+					buftype = vim.bo[buf].buftype,
+					width = vim.api.nvim_win_get_width(win),
+					height = vim.api.nvim_win_get_height(win),
+					current = win == current,
+				}
+				table.insert(diagram, string.format('%swin %d: %s (%dx%d)%s', indent, win, display, leaf.width, leaf.height, leaf.current and ' *' or ''))
+				return leaf
+			end
+			local label = node[1] == 'row' and 'row (side by side)' or 'col (stacked)'
+			table.insert(diagram, indent .. label)
+			local children = {}
+			for _, child in ipairs(node[2]) do
+				table.insert(children, annotate(child, depth + 1))
+			end
+			return {type = node[1], children = children}
+		end
+
+		local tree = annotate(vim.fn.winlayout(tabnr), 0)
+		local floating = {}
+		for _, win in ipairs(vim.api.nvim_tabpage_list_wins(vim.api.nvim_list_tabpages()[tabnr])) do
+			if vim.api.nvim_win_get_config(win).relative ~= '' then
+				table.insert(floating, {winid = win, bufnr = vim.api.nvim_win_get_buf(win)})
+			end
+		end
+		return {
+			tabpage = tabnr,
+			tabpage_count = vim.fn.tabpagenr('$'),
+			layout = tree,
+			floating = #floating > 0 and floating or vim.NIL,
+			diagram = table.concat(diagram, '\n'),
+		}`
+
+	output, err := c.luaJSON(expr, map[string]any{"tabpage": tabpage})
+	if err != nil {
+		return "", fmt.Errorf("failed to get layout tree: %v", err)
+	}
+
+	return output, nil
+}
+
+// macroRegisterPattern matches the registers macros can be stored in and
+// played from; uppercase appends to the lowercase register
+var macroRegisterPattern = regexp.MustCompile(`^[a-zA-Z0-9"]$`)
+
+func (c *NvimClient) SetMacro(register, keys string) (string, error) {
+	if !macroRegisterPattern.MatchString(register) || register == `"` || (register >= "0" && register <= "9") {
+		return "", fmt.Errorf("invalid macro register %q (expected a-z, or A-Z to append)", register)
+	}
+
+	// Keys use the same notation as mappings, so <Esc> and <CR> can be
+	// written out instead of as raw control characters
+	expr := `
+		local keys = vim.api.nvim_replace_termcodes(args.keys, true, true, true)
+		local append = args.register:match('%u') ~= nil
+		vim.fn.setreg(args.register, keys, append and 'ac' or 'c')
+		local reg = args.register:lower()
+		local content = vim.fn.getreg(reg)
+		return {register = reg, keys = vim.fn.keytrans(content), length = #content, appended = append}`
+
+	output, err := c.luaJSON(expr, map[string]any{"register": register, "keys": keys})
+	if err != nil {
+		return "", fmt.Errorf("failed to set macro: %v", err)
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) MacroContents(register string) (string, error) {
+	if !macroRegisterPattern.MatchString(register) {
+		return "", fmt.Errorf("invalid macro register %q", register)
+	}
+
+	expr := `return {content = vim.fn.getreg(args.register:lower())}`
+
+	output, err := c.luaJSON(expr, map[string]any{"register": register})
+	if err != nil {
+		return "", fmt.Errorf("failed to read register: %v", err)
+	}
+
+	var result struct {
+		Content string `json:"content"`
+	}
+	if err := json.Unmarshal([]byte(output), &result); err != nil {
+		return "", fmt.Errorf("failed to parse register: %v", err)
+	}
+
+	return result.Content, nil
+}
+
+func (c *NvimClient) PlayMacro(register string, count int) (string, error) {
+	if !macroRegisterPattern.MatchString(register) {
+		return "", fmt.Errorf("invalid macro register %q", register)
+	}
+	if count < 1 {
+		count = 1
+	}
+
+	// A failing motion aborts the macro the same way it does interactively;
+	// the edits made up to that point are kept and reported
+	expr := undoStateLua + `
+		local reg = args.register:lower()
+		if vim.fn.getreg(reg) == '' then
+			error('register ' .. reg .. ' is empty')
+		end
+		local buf = vim.api.nvim_get_current_buf()
+		local before = undo_state(buf)
+		local ok, err = pcall(vim.cmd, 'normal! ' .. args.count .. '@' .. reg)
+		local after = undo_state(buf)
+		local cursor = vim.api.nvim_win_get_cursor(0)
+		return {
+			register = reg,
+			count = args.count,
+			before = before,
+			after = after,
+			cursor = {line = cursor[1], col = cursor[2] + 1},
+			completed = ok,
+			error = ok and vim.NIL or tostring(err),
+		}`
+
+	output, err := c.luaJSON(expr, map[string]any{"register": register, "count": count})
+	if err != nil {
+		return "", fmt.Errorf("failed to play macro: %v", err)
+	}
+
+	return output, nil
+}
+
+// FoundFiles lists the files matching a glob under the project root
+type FoundFiles struct {
+	Root      string   `json:"root"`
+	Method    string   `json:"root_method"`
+	Glob      string   `json:"glob"`
+	Files     []string `json:"files"`
+	Total     int      `json:"total"`
+	Truncated bool     `json:"truncated"`
+}
+
+func (c *NvimClient) FindFiles(glob string, maxResults int) (*FoundFiles, error) {
+	if strings.TrimSpace(glob) == "" {
+		return nil, fmt.Errorf("glob cannot be empty")
+	}
+
+	// globpath() runs inside Neovim, so the glob is resolved against the
+	// editor's project root rather than this server's working directory
+	expr := projectPathsLua + `
+		local root, method = project_root(vim.api.nvim_get_current_buf())
+		local matches = vim.fn.globpath(root, args.glob, false, true)
+		local files = {}
+		local total = 0
+		for _, path in ipairs(matches) do
+			if vim.fn.isdirectory(path) == 0 and not path:find('/%.git/') then
+				total = total + 1
+				if #files < args.max_results then
+					table.insert(files, relative_to(path, root))
+				end
+			end
+		end
+		table.sort(files)
+		return {
+			root = root,
+			root_method = method,
+			glob = args.glob,
+			files = #files > 0 and files or vim.NIL,
+			total = total,
+			truncated = total > #files,
+		}`
+
+	output, err := c.luaJSON(expr, map[string]any{"glob": glob, "max_results": maxResults})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find files: %v", err)
+	}
+
+	var found FoundFiles
+	if err := json.Unmarshal([]byte(output), &found); err != nil {
+		return nil, fmt.Errorf("failed to parse found files: %v", err)
+	}
+
+	return &found, nil
+}
+
+// BufferBytes is an exact, untrimmed slice of a buffer
+type BufferBytes struct {
+	Bufnr       int    `json:"bufnr"`
+	StartLine   int    `json:"start_line"`
+	StartCol    int    `json:"start_col"`
+	EndLine     int    `json:"end_line"`
+	EndCol      int    `json:"end_col"`
+	Changedtick int    `json:"changedtick"`
+	Text        string `json:"text"`
+	Base64      string `json:"base64,omitempty"`
+}
+
+func (c *NvimClient) ReadBytes(bufnr, startLine, startCol, endLine, endCol int) (*BufferBytes, error) {
+	// The text travels base64 encoded where vim.base64 exists (0.10+), so
+	// bytes that are not valid UTF-8 survive the JSON round trip unchanged
+	expr := `
+		local buf = args.bufnr ~= 0 and args.bufnr or vim.api.nvim_get_current_buf()
+		if not vim.api.nvim_buf_is_loaded(buf) then
+			error('buffer ' .. buf .. ' is not loaded')
+		end
+		local count = vim.api.nvim_buf_line_count(buf)
+		local end_line = args.end_line > 0 and args.end_line or count
+		if args.start_line < 1 or end_line > count or args.start_line > end_line then
+			error(string.format('invalid range %d-%d (buffer has %d lines)', args.start_line, end_line, count))
+		end
+		local start_col = math.max(args.start_col, 1)
+		local last = vim.api.nvim_buf_get_lines(buf, end_line - 1, end_line, false)[1]
+		local end_col = args.end_col > 0 and math.min(args.end_col, #last + 1) or #last + 1
+		local first = vim.api.nvim_buf_get_lines(buf, args.start_line - 1, args.start_line, false)[1]
+		if start_col > #first + 1 then
+			error(string.format('start column %d is past the end of line %d', start_col, args.start_line))
+		end
+		local text = table.concat(vim.api.nvim_buf_get_text(buf, args.start_line - 1, start_col - 1, end_line - 1, end_col - 1, {}), '\n')
+		local result = {
+			bufnr = buf,
+			start_line = args.start_line,
+			start_col = start_col,
+			end_line = end_line,
+			end_col = end_col,
+			changedtick = vim.api.nvim_buf_get_changedtick(buf),
+		}
+		if vim.base64 then
+			result.base64 = vim.base64.encode(text)
+		else
+			result.text = text
+		end
+		return result`
+
+	output, err := c.luaJSON(expr, map[string]any{
+		"bufnr":      bufnr,
+		"start_line": startLine,
+		"start_col":  startCol,
+		"end_line":   endLine,
+		"end_col":    endCol,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bytes: %v", err)
+	}
+
+	var result BufferBytes
+	if err := json.Unmarshal([]byte(output), &result); err != nil {
+		return nil, fmt.Errorf("failed to parse bytes: %v", err)
+	}
+	if result.Base64 != "" {
+		decoded, err := base64.StdEncoding.DecodeString(result.Base64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode bytes: %v", err)
+		}
+		result.Text = string(decoded)
+		result.Base64 = ""
+	}
+
+	return &result, nil
+}
+
+func (c *NvimClient) FoldConfig(bufnr, startLine, endLine int) (string, error) {
+	// Fold options and levels are window-local, so they are read in the
+	// first window showing the buffer (the current one when it does)
+	expr := `
+		local buf = args.bufnr ~= 0 and args.bufnr or vim.api.nvim_get_current_buf()
+		if not vim.api.nvim_buf_is_loaded(buf) then
+			error('buffer ' .. buf .. ' is not loaded')
+		end
+		local win = vim.api.nvim_get_current_win()
+		if vim.api.nvim_win_get_buf(win) ~= buf then
+			win = vim.fn.bufwinid(buf)
+			if win == -1 then
+				error('buffer ' .. buf .. ' is not displayed in any window; fold levels are window-local')
+			end
+		end
+		local wo = vim.wo[win]
+		local count = vim.api.nvim_buf_line_count(buf)
+		local first = math.max(args.start_line, 1)
+		local last = args.end_line > 0 and math.min(args.end_line, count) or count
+		last = math.min(last, first + args.max_lines - 1)
+
+		local lines = {}
+		local closed = {}
+		vim.api.nvim_win_call(win, function()
+			local lnum = first
+			while lnum <= last do
+				local fold_start = vim.fn.foldclosed(lnum)
+				table.insert(lines, {line = lnum, level = vim.fn.foldlevel(lnum), closed = fold_start ~= -1})
+				if fold_start ~= -1 and fold_start == lnum then
+					table.insert(closed, {start_line = fold_start, end_line = vim.fn.foldclosedend(lnum)})
+				end
+				lnum = lnum + 1
+			end
+		end)
+
+		return {
+			bufnr = buf,
+			winid = win,
+			foldenable = wo.foldenable,
+			foldmethod = wo.foldmethod,
+			foldlevel = wo.foldlevel,
+			foldnestmax = wo.foldnestmax,
+			foldminlines = wo.foldminlines,
+			foldexpr = wo.foldexpr,
+			foldmarker = wo.foldmarker,
+			foldcolumn = wo.foldcolumn,
+			foldlevelstart = vim.o.foldlevelstart,
+			start_line = first,
+			end_line = last,
+			line_count = count,
+			lines = #lines > 0 and lines or vim.NIL,
+			closed_folds = #closed > 0 and closed or vim.NIL,
+		}`
+
+	output, err := c.luaJSON(expr, map[string]any{
+		"bufnr":      bufnr,
+		"start_line": startLine,
+		"end_line":   endLine,
+		"max_lines":  maxFoldLines,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get fold config: %v", err)
+	}
+
+	return output, nil
+}
+
+// maxFoldLines caps how many per-line fold levels a fold_config call reports
+const maxFoldLines = 500
+
+func (c *NvimClient) ReviewProgress(line int) (string, error) {
+	// The outline comes from LSP document symbols when a server provides
+	// them, otherwise from treesitter declarations; either way it is
+	// flattened in source order so ordinals match reading order
+	expr := lspCompatLua + `
+		local buf = vim.api.nvim_get_current_buf()
+		local line = args.line > 0 and args.line or vim.api.nvim_win_get_cursor(0)[1]
+		local outline_kinds = {
+			[2] = 'module', [5] = 'class', [6] = 'method', [9] = 'constructor', [10] = 'enum',
+			[11] = 'interface', [12] = 'function', [23] = 'struct',
+		}
+		local symbols = {}
+		local source
+
+		for _, client in ipairs(lsp_clients({bufnr = buf})) do
+			if lsp_supports(client, 'textDocument/documentSymbol', buf) then
+				local response = lsp_request_sync(client, 'textDocument/documentSymbol', {textDocument = {uri = vim.uri_from_bufnr(buf)}}, args.timeout_ms, buf)
+				if response and response.result and #response.result > 0 then
+					local function add(symbol, depth)
+						local range = symbol.range or (symbol.location and symbol.location.range)
+						if range and outline_kinds[symbol.kind] then
+							table.insert(symbols, {
+								name = symbol.name,
+								kind = outline_kinds[symbol.kind],
+								start_line = range.start.line + 1,
+								end_line = range['end'].line + 1,
+								depth = depth,
+							})
+						end
+						for _, child in ipairs(symbol.children or {}) do
+							add(child, depth + 1)
+						end
+					end
+					for _, symbol in ipairs(response.result) do
+						add(symbol, 0)
+					end
+					source = 'lsp:' .. client.name
+					break
+				end
+			end
+		end
+
+		if not source then
+			local ok, parser = pcall(vim.treesitter.get_parser, buf)
+			if not ok or not parser then
+				error('no LSP document symbols or treesitter parser for buffer ' .. buf)
+			end
+			local function walk(node, depth)
+				for child in node:iter_children() do
+					local kind = child:type()
+					local is_function = (kind:match('function') or kind:match('method')) and not kind:match('call')
+						and (kind:match('declaration') or kind:match('definition') or kind:match('item'))
+					local is_type = (kind:match('class') or kind:match('struct') or kind:match('interface') or kind == 'type_declaration')
+						and (kind:match('declaration') or kind:match('definition') or kind:match('item') or kind:match('specifier'))
+					local next_depth = depth
+					if is_function or is_type then
+						local name_node = child:field('name')[1]
+						local start_row, _, end_row = child:range()
+						table.insert(symbols, {
+							name = name_node and vim.treesitter.get_node_text(name_node, buf) or kind,
+							kind = is_function and 'function' or 'type',
+							start_line = start_row + 1,
+							end_line = end_row + 1,
+							depth = depth,
+						})
+						next_depth = depth + 1
+					end
+					walk(child, next_depth)
+				end
+			end
+			walk(parser:parse()[1]:root(), 0)
+			source = 'treesitter'
+		end
+
+		table.sort(symbols, function(a, b)
+			if a.start_line ~= b.start_line then
+				return a.start_line < b.start_line
+			end
+			return a.depth < b.depth
+		end)
+
+		local current, previous, following
+		for i, symbol in ipairs(symbols) do
+			symbol.index = i
+			if symbol.start_line <= line and symbol.end_line >= line then
+				-- Later matches start inside earlier ones, so the last is innermost
+				current = symbol
+			elseif symbol.end_line < line then
+				previous = symbol
+			elseif not following and symbol.start_line > line then
+				following = symbol
+			end
+		end
+
+		local result = {
+			line = line,
+			source = source,
+			total = #symbols,
+			current = current or vim.NIL,
+			previous = (not current and previous) or vim.NIL,
+			next = (not current and following) or vim.NIL,
+		}
+		if current then
+			result.progress = string.format('%s %s (%d of %d)', current.kind, current.name, current.index, #symbols)
+		else
+			result.progress = string.format('between symbols (%d total)', #symbols)
+		end
+		return result`
+
+	output, err := c.luaJSON(expr, map[string]any{"line": line, "timeout_ms": 3000})
+	if err != nil {
+		return "", fmt.Errorf("failed to get review progress: %v", err)
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) VerboseOption(name, mode string) (string, error) {
+	if strings.TrimSpace(name) == "" {
+		return "", fmt.Errorf("name cannot be empty")
+	}
+	if strings.ContainsAny(name, "\n\r") {
+		return "", fmt.Errorf("name cannot contain newlines")
+	}
+
+	// Names are checked (options) or '|'-escaped (mappings) before being
+	// spliced into the :verbose command so they cannot chain commands
+	expr := `
+		local exec = vim.api.nvim_exec2 and function(cmd)
+			return vim.api.nvim_exec2(cmd, {output = true}).output
+		end or function(cmd)
+			return vim.api.nvim_exec(cmd, true)
+		end
+		local function parse_last_set(output)
+			local from, lnum = output:match('Last set from (.-) line (%d+)')
+			if from then
+				return {file = vim.fn.expand(from), line = tonumber(lnum)}
+			end
+			from = output:match('Last set from ([^\n]+)')
+			if from then
+				return {file = vim.trim(from), line = vim.NIL}
+			end
+			return vim.NIL
+		end
+
+		if args.mode == '' then
+			if not args.name:match('^[%w_]+$') then
+				error('invalid option name: ' .. args.name)
+			end
+			local ok, info
+			if vim.api.nvim_get_option_info2 then
+				ok, info = pcall(vim.api.nvim_get_option_info2, args.name, {})
+			else
+				ok, info = pcall(vim.api.nvim_get_option_info, args.name)
+			end
+			if not ok then
+				error('unknown option: ' .. args.name)
+			end
+			local output = exec('verbose set ' .. args.name .. '?')
+			return {
+				kind = 'option',
+				name = info.name,
+				scope = info.scope,
+				value = vim.api.nvim_get_option_value(info.name, {}),
+				default = info.default,
+				was_set = info.was_set,
+				last_set = parse_last_set(output),
+				output = vim.trim(output),
+			}
+		end
+
+		local valid_modes = {n = true, v = true, x = true, s = true, o = true, i = true, c = true, t = true, l = true}
+		if not valid_modes[args.mode] then
+			error('invalid mapping mode: ' .. args.mode)
+		end
+		local map = vim.fn.maparg(args.name, args.mode, false, true)
+		if vim.tbl_isempty(map) then
+			error(string.format('no %s-mode mapping for %s', args.mode, args.name))
+		end
+		local lhs = args.name:gsub('|', '<Bar>')
+		local output = exec('verbose ' .. args.mode .. 'map ' .. lhs)
+		return {
+			kind = 'mapping',
+			mode = args.mode,
+			lhs = map.lhs,
+			rhs = map.rhs or vim.NIL,
+			lua_callback = map.callback ~= nil,
+			description = map.desc or vim.NIL,
+			buffer_local = map.buffer == 1,
+			noremap = map.noremap == 1,
+			silent = map.silent == 1,
+			expr = map.expr == 1,
+			last_set = parse_last_set(output),
+			output = vim.trim(output),
+		}`
+
+	output, err := c.luaJSON(expr, map[string]any{"name": name, "mode": mode})
+	if err != nil {
+		return "", fmt.Errorf("failed to get verbose info: %v", err)
+	}
+
+	return output, nil
+}
+
+// positionLua converts columns between Vim byte offsets and LSP character
+// offsets in a given encoding. resolve_encoding(buf, encoding) picks the
+// encoding of the first attached client when none is given.
+const positionLua = lspCompatLua + `
+	local function resolve_encoding(buf, encoding)
+		if encoding ~= '' then
+			return encoding
+		end
+		local client = lsp_clients({bufnr = buf})[1]
+		return client and client.offset_encoding or 'utf-16'
+	end
+	local function line_text(buf, line)
+		local count = vim.api.nvim_buf_line_count(buf)
+		if line < 0 or line >= count then
+			error(string.format('line %d is outside the buffer (%d lines)', line + 1, count))
+		end
+		return vim.api.nvim_buf_get_lines(buf, line, line + 1, false)[1]
+	end
+	local function byte_to_character(text, byte, encoding)
+		byte = math.min(byte, #text)
+		if encoding == 'utf-8' then
+			return byte
+		end
+		if nvim_011 then
+			return vim.str_utfindex(text, encoding, byte, false)
+		end
+		local utf32, utf16 = vim.str_utfindex(text, byte)
+		return encoding == 'utf-16' and utf16 or utf32
+	end
+	local function character_to_byte(text, character, encoding)
+		if encoding == 'utf-8' then
+			return math.min(character, #text)
+		end
+		if nvim_011 then
+			return vim.str_byteindex(text, encoding, character, false)
+		end
+		local ok, byte = pcall(vim.str_byteindex, text, character, encoding == 'utf-16')
+		return ok and byte or #text
+	end
+`
+
+func (c *NvimClient) VimToLsp(bufnr, line, col int, encoding string) (string, error) {
+	expr := positionLua + `
+		local buf = args.bufnr ~= 0 and args.bufnr or vim.api.nvim_get_current_buf()
+		if not vim.api.nvim_buf_is_loaded(buf) then
+			error('buffer ' .. buf .. ' is not loaded')
+		end
+		local encoding = resolve_encoding(buf, args.encoding)
+		local text = line_text(buf, args.line - 1)
+		return {
+			bufnr = buf,
+			encoding = encoding,
+			vim = {line = args.line, col = args.col},
+			lsp = {line = args.line - 1, character = byte_to_character(text, math.max(args.col, 1) - 1, encoding)},
+		}`
+
+	output, err := c.luaJSON(expr, map[string]any{"bufnr": bufnr, "line": line, "col": col, "encoding": encoding})
+	if err != nil {
+		return "", fmt.Errorf("failed to convert position: %v", err)
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) LspToVim(bufnr, line, character int, encoding string) (string, error) {
+	expr := positionLua + `
+		local buf = args.bufnr ~= 0 and args.bufnr or vim.api.nvim_get_current_buf()
+		if not vim.api.nvim_buf_is_loaded(buf) then
+			error('buffer ' .. buf .. ' is not loaded')
+		end
+		local encoding = resolve_encoding(buf, args.encoding)
+		local text = line_text(buf, args.line)
+		local byte = character_to_byte(text, math.max(args.character, 0), encoding)
+		return {
+			bufnr = buf,
+			encoding = encoding,
+			lsp = {line = args.line, character = args.character},
+			vim = {line = args.line + 1, col = byte + 1, display_col = vim.fn.strdisplaywidth(text:sub(1, byte)) + 1},
+		}`
+
+	output, err := c.luaJSON(expr, map[string]any{"bufnr": bufnr, "line": line, "character": character, "encoding": encoding})
+	if err != nil {
+		return "", fmt.Errorf("failed to convert position: %v", err)
+	}
+
+	return output, nil
+}
+
+// eventWatchLua holds the autocommands created by watch_event and the RPC
+// channel they report to
+const eventWatchLua = `
+	_G.neovim_mcp_event_watches = _G.neovim_mcp_event_watches or {next_id = 1, watches = {}}
+	local state = _G.neovim_mcp_event_watches
+	local group = vim.api.nvim_create_augroup('` + namespacePrefix + `events', {clear = false})
+`
+
+// FiredEvent is one autocommand event reported by a watch_event watch
+type FiredEvent struct {
+	ID      int    `json:"id"`
+	Event   string `json:"event"`
+	Pattern string `json:"pattern"`
+	Bufnr   int    `json:"bufnr"`
+	File    string `json:"file"`
+	Match   string `json:"match"`
+	Time    int64  `json:"time"`
+	Once    bool   `json:"once"`
+}
+
+func (c *NvimClient) WatchEvent(event, pattern string, once bool) (int, error) {
+	channel, err := c.channelID()
+	if err != nil {
+		return 0, fmt.Errorf("failed to watch event: %v", err)
+	}
+
+	expr := eventWatchLua + `
+		if vim.fn.exists('##' .. args.event) ~= 1 then
+			error('unknown autocommand event: ' .. args.event)
+		end
+		state.channel = args.channel
+		local id = state.next_id
+		state.next_id = id + 1
+		local autocmd = vim.api.nvim_create_autocmd(args.event, {
+			group = group,
+			pattern = args.pattern,
+			once = args.once,
+			desc = 'neovim-mcp watch_event ' .. id,
+			callback = function(ev)
+				if args.once then
+					state.watches[id] = nil
+				end
+				-- The channel is gone if the server disconnected; the
+				-- event is dropped rather than failing the autocommand
+				pcall(vim.rpcnotify, state.channel, '` + eventFiredMethod + `', vim.json.encode({
+					id = id,
+					event = ev.event,
+					pattern = args.pattern,
+					bufnr = ev.buf,
+					file = ev.file ~= '' and vim.fn.fnamemodify(ev.file, ':p') or '',
+					match = ev.match,
+					time = os.time(),
+					once = args.once,
+				}))
+			end,
+		})
+		state.watches[id] = autocmd
+		return {id = id}`
+
+	output, err := c.luaJSON(expr, map[string]any{"event": event, "pattern": pattern, "once": once, "channel": channel})
+	if err != nil {
+		return 0, fmt.Errorf("failed to watch event: %v", err)
+	}
+
+	var result struct {
+		ID int `json:"id"`
+	}
+	if err := json.Unmarshal([]byte(output), &result); err != nil {
+		return 0, fmt.Errorf("failed to parse watch result: %v", err)
+	}
+
+	return result.ID, nil
+}
+
+func (c *NvimClient) UnwatchEvent(id int) (bool, error) {
+	expr := eventWatchLua + `
+		local autocmd = state.watches[args.id]
+		if autocmd then
+			pcall(vim.api.nvim_del_autocmd, autocmd)
+			state.watches[args.id] = nil
+		end
+		return {watched = autocmd ~= nil}`
+
+	output, err := c.luaJSON(expr, map[string]any{"id": id})
+	if err != nil {
+		return false, fmt.Errorf("failed to unwatch event: %v", err)
+	}
+
+	var result struct {
+		Watched bool `json:"watched"`
+	}
+	if err := json.Unmarshal([]byte(output), &result); err != nil {
+		return false, fmt.Errorf("failed to parse unwatch result: %v", err)
+	}
+
+	return result.Watched, nil
+}
+
+// RedirectEvents points the event watches at this client's current
+// connection
+func (c *NvimClient) RedirectEvents() error {
+	channel, err := c.channelID()
+	if err != nil {
+		return fmt.Errorf("failed to redirect events: %v", err)
+	}
+
+	expr := eventWatchLua + `
+		state.channel = args.channel
+		return {}`
+
+	if _, err := c.luaJSON(expr, map[string]any{"channel": channel}); err != nil {
+		return fmt.Errorf("failed to redirect events: %v", err)
+	}
+
+	return nil
+}
+
+func (c *NvimClient) GetDocstring(line, col int) (string, error) {
+	// Python-style docstrings live in the first statement of the body;
+	// everywhere else the docs are the run of comments directly above the
+	// declaration (or above its export/decorator wrapper)
+	expr := `
+		local buf = vim.api.nvim_get_current_buf()
+		local line = args.line > 0 and args.line or vim.api.nvim_win_get_cursor(0)[1]
+		local col = args.line > 0 and math.max(args.col, 1) or vim.api.nvim_win_get_cursor(0)[2] + 1
+		local ok, parser = pcall(vim.treesitter.get_parser, buf)
+		if not ok or not parser then
+			error('no treesitter parser for buffer ' .. buf)
+		end
+		local root = parser:parse()[1]:root()
+		local node = root:named_descendant_for_range(line - 1, col - 1, line - 1, col - 1)
+
+		local function is_declaration(kind)
+			local named = (kind:match('function') or kind:match('method') or kind:match('class')
+				or kind:match('struct') or kind:match('interface') or kind:match('enum')
+				or kind == 'type_declaration' or kind == 'const_declaration' or kind == 'var_declaration')
+			return named and not kind:match('call')
+				and (kind:match('declaration') or kind:match('definition') or kind:match('item') or kind:match('specifier'))
+		end
+		while node and not is_declaration(node:type()) do
+			node = node:parent()
+		end
+		if not node then
+			error(string.format('no declaration at line %d col %d', line, col))
+		end
+
+		local function range_of(first, last)
+			local sr, sc = first:range()
+			local _, _, er, ec = last:range()
+			return {start_line = sr + 1, start_col = sc + 1, end_line = er + 1, end_col = ec + 1}
+		end
+
+		local name_node = node:field('name')[1]
+		local sr, _, er = node:range()
+		local result = {
+			symbol = {
+				name = name_node and vim.treesitter.get_node_text(name_node, buf) or vim.NIL,
+				kind = node:type(),
+				start_line = sr + 1,
+				end_line = er + 1,
+			},
+			docstring = vim.NIL,
+		}
+
+		local body = node:field('body')[1]
+		local first = body and body:named_child(0)
+		if first and first:type() == 'expression_statement' and first:named_child(0) and first:named_child(0):type() == 'string' then
+			local doc = first:named_child(0)
+			local docstring = range_of(doc, doc)
+			docstring.text = vim.treesitter.get_node_text(doc, buf)
+			docstring.style = 'inner'
+			result.docstring = docstring
+			return result
+		end
+
+		local anchor = node
+		local parent = node:parent()
+		while parent and (parent:type() == 'export_statement' or parent:type() == 'decorated_definition') do
+			anchor = parent
+			parent = parent:parent()
+		end
+		local comments = {}
+		local next_row = anchor:range()
+		local sibling = anchor:prev_named_sibling()
+		while sibling and sibling:type():match('comment') do
+			local _, _, end_row = sibling:range()
+			-- A blank line separates an unrelated comment from the docs
+			if end_row < next_row - 1 then
+				break
+			end
+			table.insert(comments, 1, sibling)
+			next_row = sibling:range()
+			sibling = sibling:prev_named_sibling()
+		end
+		if #comments > 0 then
+			local docstring = range_of(comments[1], comments[#comments])
+			local texts = {}
+			for _, comment in ipairs(comments) do
+				table.insert(texts, vim.treesitter.get_node_text(comment, buf))
+			end
+			docstring.text = table.concat(texts, '\n')
+			docstring.style = 'preceding'
+			result.docstring = docstring
+		else
+			result.insert_before_line = anchor:range() + 1
+		end
+		return result`
+
+	output, err := c.luaJSON(expr, map[string]any{"line": line, "col": col})
+	if err != nil {
+		return "", fmt.Errorf("failed to get docstring: %v", err)
+	}
+
+	return output, nil
+}
+
+// EditorState is the part of the editor state compared by observed commands
+type EditorState struct {
+	Bufnr        int            `json:"bufnr"`
+	Winid        int            `json:"winid"`
+	Name         string         `json:"name"`
+	Changedtick  int            `json:"changedtick"`
+	Line         int            `json:"line"`
+	Col          int            `json:"col"`
+	Changedticks map[string]int `json:"changedticks"`
+}
+
+func (c *NvimClient) EditorState() (*EditorState, error) {
+	// Ticks are keyed by buffer number as strings since JSON objects need
+	// string keys; vim.empty_dict keeps an empty map an object
+	expr := `
+		local buf = vim.api.nvim_get_current_buf()
+		local cursor = vim.api.nvim_win_get_cursor(0)
+		local ticks = vim.empty_dict()
+		for _, b in ipairs(vim.api.nvim_list_bufs()) do
+			if vim.api.nvim_buf_is_loaded(b) then
+				ticks[tostring(b)] = vim.api.nvim_buf_get_changedtick(b)
+			end
+		end
+		return {
+			bufnr = buf,
+			winid = vim.api.nvim_get_current_win(),
+			name = vim.api.nvim_buf_get_name(buf),
+			changedtick = vim.api.nvim_buf_get_changedtick(buf),
+			line = cursor[1],
+			col = cursor[2] + 1,
+			changedticks = ticks,
+		}`
+
+	output, err := c.luaJSON(expr, map[string]any{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get editor state: %v", err)
+	}
+
+	var state EditorState
+	if err := json.Unmarshal([]byte(output), &state); err != nil {
+		return nil, fmt.Errorf("failed to parse editor state: %v", err)
+	}
+
+	return &state, nil
+}
+
+func (c *NvimClient) Diagnose() (string, error) {
+	// Only reads state; every field is guarded so one failing probe does not
+	// hide the rest of the report
+	expr := lspCompatLua + `
+		local version = vim.version()
+		local buf = vim.api.nvim_get_current_buf()
+		local report = {
+			nvim_version = string.format('%d.%d.%d%s', version.major, version.minor, version.patch,
+				version.prerelease and ('-' .. tostring(version.prerelease)) or ''),
+			servername = vim.v.servername,
+			cwd = vim.fn.getcwd(),
+			os = (vim.uv or vim.loop).os_uname().sysname,
+		}
+
+		local clients = {}
+		for _, client in ipairs(lsp_clients({})) do
+			local attached = {}
+			for b in pairs(client.attached_buffers or {}) do
+				table.insert(attached, b)
+			end
+			table.sort(attached)
+			local stopped = false
+			if nvim_011 then
+				stopped = client:is_stopped()
+			elseif client.is_stopped then
+				stopped = client.is_stopped()
+			end
+			table.insert(clients, {
+				id = client.id,
+				name = client.name,
+				root_dir = client.config.root_dir or vim.NIL,
+				offset_encoding = client.offset_encoding,
+				attached_buffers = #attached > 0 and attached or vim.NIL,
+				attached_to_current = client.attached_buffers and client.attached_buffers[buf] or false,
+				stopped = stopped,
+			})
+		end
+		report.lsp_clients = #clients > 0 and clients or vim.NIL
+
+		local bo = vim.bo[buf]
+		report.buffer = {
+			bufnr = buf,
+			name = vim.api.nvim_buf_get_name(buf),
+			filetype = bo.filetype,
+			buftype = bo.buftype,
+			fileformat = bo.fileformat,
+			fileencoding = bo.fileencoding,
+			modified = bo.modified,
+			readonly = bo.readonly,
+			modifiable = bo.modifiable,
+			expandtab = bo.expandtab,
+			shiftwidth = bo.shiftwidth,
+			tabstop = bo.tabstop,
+			textwidth = bo.textwidth,
+			line_count = vim.api.nvim_buf_line_count(buf),
+			diagnostics = #vim.diagnostic.get(buf),
+		}
+		local has_parser = pcall(vim.treesitter.get_parser, buf)
+		report.buffer.treesitter = has_parser
+
+		local errmsg = vim.v.errmsg
+		report.last_error = errmsg ~= '' and errmsg or vim.NIL
+		return report`
+
+	output, err := c.luaJSON(expr, map[string]any{})
+	if err != nil {
+		return "", fmt.Errorf("failed to collect diagnostics report: %v", err)
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) GetBufferContent(startLine, endLine int) (string, error) {
+	expr := `
+		local buf = vim.api.nvim_get_current_buf()
+		local count = vim.api.nvim_buf_line_count(buf)
+		local first = math.max(args.start_line, 1)
+		local last = args.end_line > 0 and math.min(args.end_line, count) or count
+		if first > count then
+			error(string.format('start line %d is past the end of the buffer (%d lines)', first, count))
+		end
+		return {
+			bufnr = buf,
+			file = vim.api.nvim_buf_get_name(buf),
+			changedtick = vim.api.nvim_buf_get_changedtick(buf),
+			start_line = first,
+			end_line = last,
+			line_count = count,
+			lines = vim.api.nvim_buf_get_lines(buf, first - 1, last, false),
+		}`
+
+	output, err := c.luaJSON(expr, map[string]any{
+		"start_line": startLine,
+		"end_line":   endLine,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to read buffer content: %v", err)
+	}
+
+	var content struct {
+		Bufnr       int      `json:"bufnr"`
+		File        string   `json:"file"`
+		Changedtick int      `json:"changedtick"`
+		StartLine   int      `json:"start_line"`
+		EndLine     int      `json:"end_line"`
+		LineCount   int      `json:"line_count"`
+		Lines       []string `json:"lines"`
+	}
+	if err := json.Unmarshal([]byte(output), &content); err != nil {
+		return "", fmt.Errorf("failed to parse buffer content: %v", err)
+	}
+
+	var result strings.Builder
+	result.WriteString(fmt.Sprintf("Buffer %d: %s (lines %d-%d of %d, changedtick %d)\n\n",
+		content.Bufnr, content.File, content.StartLine, content.EndLine, content.LineCount, content.Changedtick))
+	width := len(strconv.Itoa(content.EndLine))
+	for i, line := range content.Lines {
+		result.WriteString(fmt.Sprintf("%*d: %s\n", width, content.StartLine+i, line))
+	}
+
+	return result.String(), nil
+}
+
+func (c *NvimClient) ListBuffers(includeUnlisted bool) (string, error) {
+	// Scratch buffers ('buftype' nofile) are hidden along with unlisted ones,
+	// since neither has a file the user is working on
+	expr := `
+		local current = vim.api.nvim_get_current_buf()
+		local result = {}
+		for _, buf in ipairs(vim.api.nvim_list_bufs()) do
+			local bo = vim.bo[buf]
+			if args.include_unlisted or (bo.buflisted and bo.buftype ~= 'nofile') then
+				local name = vim.api.nvim_buf_get_name(buf)
+				table.insert(result, {
+					bufnr = buf,
+					path = name ~= '' and vim.fn.fnamemodify(name, ':p') or '',
+					modified = bo.modified,
+					filetype = bo.filetype,
+					buftype = bo.buftype,
+					listed = bo.buflisted,
+					loaded = vim.api.nvim_buf_is_loaded(buf),
+					current = buf == current,
+				})
+			end
+		end
+		return #result > 0 and result or vim.NIL`
+
+	output, err := c.luaJSON(expr, map[string]any{"include_unlisted": includeUnlisted})
+	if err != nil {
+		return "", fmt.Errorf("failed to list buffers: %v", err)
+	}
+	if output == "null" {
+		return "[]", nil
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) Ping() error {
+	output, err := c.remoteExpr("1")
+	if err != nil {
+		return fmt.Errorf("cannot reach Neovim at %s: %w", c.socketPath, err)
+	}
+	if output != "1" {
+		return fmt.Errorf("unexpected ping reply from %s: %q", c.socketPath, output)
+	}
+	return nil
+}
+
+func (c *NvimClient) SetCursor(line, col int, center bool) (string, error) {
+	// col is a 1-based byte column; one past the end of the line is allowed
+	// so the cursor can be placed after the last character
+	expr := `
+		local win = vim.api.nvim_get_current_win()
+		local buf = vim.api.nvim_win_get_buf(win)
+		local count = vim.api.nvim_buf_line_count(buf)
+		if args.line < 1 or args.line > count then
+			error(string.format('line %d is out of range (buffer has %d lines)', args.line, count))
+		end
+		local text = vim.api.nvim_buf_get_lines(buf, args.line - 1, args.line, false)[1]
+		local col = args.col > 0 and args.col or 1
+		if col > #text + 1 then
+			error(string.format('column %d is out of range (line %d has %d bytes)', col, args.line, #text))
+		end
+		vim.api.nvim_win_set_cursor(win, {args.line, col - 1})
+		if args.center then
+			vim.api.nvim_win_call(win, function()
+				vim.cmd('normal! zz')
+			end)
+		end
+		local cursor = vim.api.nvim_win_get_cursor(win)
+		return {
+			file = vim.api.nvim_buf_get_name(buf),
+			line = cursor[1],
+			col = cursor[2] + 1,
+			topline = vim.fn.line('w0', win),
+			botline = vim.fn.line('w$', win),
+		}`
+
+	output, err := c.luaJSON(expr, map[string]any{
+		"line":   line,
+		"col":    col,
+		"center": center,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to set cursor: %v", err)
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) GetVisualSelection() (string, error) {
+	// The '< and '> marks survive leaving visual mode, unlike getpos('v'),
+	// so this reports the last selection rather than a live one
+	expr := `
+		local buf = vim.api.nvim_get_current_buf()
+		local start_pos, end_pos = vim.fn.getpos("'<"), vim.fn.getpos("'>")
+		local vmode = vim.fn.visualmode()
+		if start_pos[2] == 0 or end_pos[2] == 0 then
+			error('no visual selection has been made in the current buffer')
+		end
+		if start_pos[2] > end_pos[2] or (start_pos[2] == end_pos[2] and start_pos[3] > end_pos[3]) then
+			start_pos, end_pos = end_pos, start_pos
+		end
+
+		local lines
+		if vim.fn.exists('*getregion') == 1 then
+			lines = vim.fn.getregion(start_pos, end_pos, {type = vmode ~= '' and vmode or 'v'})
+		else
+			lines = vim.api.nvim_buf_get_lines(buf, start_pos[2] - 1, end_pos[2], false)
+		end
+
+		-- Linewise selections put v:maxcol in the end mark; report the
+		-- real end of the line instead
+		local end_text = vim.api.nvim_buf_get_lines(buf, end_pos[2] - 1, end_pos[2], false)[1] or ''
+		return {
+			file = vim.api.nvim_buf_get_name(buf),
+			mode = vmode == '\22' and 'blockwise' or (vmode == 'V' and 'linewise' or 'charwise'),
+			start_line = start_pos[2],
+			start_col = start_pos[3],
+			end_line = end_pos[2],
+			end_col = math.min(end_pos[3], math.max(#end_text, 1)),
+			text = table.concat(lines, '\n'),
+		}`
+
+	output, err := c.luaJSON(expr, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to get visual selection: %v", err)
+	}
+
+	return output, nil
+}
+
+// openCommands maps open_location split options to the command that opens
+// the file
+var openCommands = map[string]string{
+	"":           "edit",
+	"none":       "edit",
+	"horizontal": "split",
+	"vertical":   "vsplit",
+	"tab":        "tabedit",
+}
+
+func (c *NvimClient) OpenLocation(path string, line, col int, split string) (string, error) {
+	command, ok := openCommands[split]
+	if !ok {
+		return "", fmt.Errorf("invalid split %q (expected none, horizontal, vertical or tab)", split)
+	}
+	if path == "" {
+		return "", fmt.Errorf("path cannot be empty")
+	}
+
+	// Relative paths resolve against Neovim's working directory, not the
+	// server's; the position is clamped to the file so a stale line number
+	// still lands nearby
+	expr := `
+		local path = vim.fn.fnamemodify(args.path, ':p')
+		if vim.fn.filereadable(path) == 0 then
+			error('file does not exist: ' .. path)
+		end
+		vim.cmd(args.command .. ' ' .. vim.fn.fnameescape(path))
+		local win = vim.api.nvim_get_current_win()
+		local buf = vim.api.nvim_win_get_buf(win)
+		local line = math.min(math.max(args.line, 1), vim.api.nvim_buf_line_count(buf))
+		local text = vim.api.nvim_buf_get_lines(buf, line - 1, line, false)[1]
+		local col = math.min(math.max(args.col, 1), math.max(#text, 1))
+		vim.api.nvim_win_set_cursor(win, {line, col - 1})
+		return {
+			file = vim.api.nvim_buf_get_name(buf),
+			bufnr = buf,
+			winid = win,
+			line = line,
+			col = col,
+		}`
+
+	output, err := c.luaJSON(expr, map[string]any{
+		"path":    path,
+		"line":    line,
+		"col":     col,
+		"command": command,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to open location: %v", err)
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) ListLspClients() (string, error) {
+	expr := lspCompatLua + `
+		local buf = vim.api.nvim_get_current_buf()
+		local clients = {}
+		for _, client in ipairs(lsp_clients({bufnr = buf})) do
+			local filetypes = client.config.filetypes or {}
+			table.insert(clients, {
+				id = client.id,
+				name = client.name,
+				root_dir = client.config.root_dir or vim.NIL,
+				filetypes = #filetypes > 0 and filetypes or vim.NIL,
+			})
+		end
+		local result = {
+			bufnr = buf,
+			file = vim.api.nvim_buf_get_name(buf),
+			filetype = vim.bo[buf].filetype,
+			clients = #clients > 0 and clients or vim.NIL,
+		}
+		if #clients == 0 then
+			result.note = 'no language server is attached to this buffer, so missing diagnostics do not mean the code is clean'
+		end
+		return result`
+
+	output, err := c.luaJSON(expr, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to list LSP clients: %v", err)
+	}
+
+	return output, nil
+}
+
+// lspAtPositionLua defines lsp_at_position(method, line, col, extra), which
+// sends a position request for a 1-based line and byte column (the cursor
+// when line is 0) to each attached client supporting method, converting the
+// position to the client's encoding. It returns the buffer, the position
+// used and a {client, result} entry per non-empty response.
+// lsp_locations(client, result) turns a Location, Location[] or
+// LocationLink[] result into file paths with 1-based Vim positions.
+const lspAtPositionLua = positionLua + `
+	local function lsp_at_position(method, line, col, extra)
+		local buf = vim.api.nvim_get_current_buf()
+		if line == 0 then
+			local cursor = vim.api.nvim_win_get_cursor(0)
+			line, col = cursor[1], cursor[2] + 1
+		end
+		local text = line_text(buf, line - 1)
+		local clients = {}
+		for _, client in ipairs(lsp_clients({bufnr = buf})) do
+			if lsp_supports(client, method, buf) then
+				table.insert(clients, client)
+			end
+		end
+		if #clients == 0 then
+			error('no attached LSP client supports ' .. method)
+		end
+
+		local responses, errors = {}, {}
+		for _, client in ipairs(clients) do
+			local params = vim.tbl_extend('force', {
+				textDocument = {uri = vim.uri_from_bufnr(buf)},
+				position = {
+					line = line - 1,
+					character = byte_to_character(text, math.max(col, 1) - 1, client.offset_encoding or 'utf-16'),
+				},
+			}, extra or {})
+			local response, err = lsp_request_sync(client, method, params, 5000, buf)
+			if not response then
+				table.insert(errors, client.name .. ': ' .. (err or 'request failed'))
+			elseif response.err then
+				table.insert(errors, client.name .. ': ' .. (response.err.message or vim.inspect(response.err)))
+			elseif response.result ~= nil and response.result ~= vim.NIL then
+				table.insert(responses, {client = client, result = response.result})
+			end
+		end
+		if #responses == 0 and #errors > 0 then
+			error(table.concat(errors, '; '))
+		end
+		return buf, {line = line, col = col}, responses
+	end
+
+	local function file_line(fname, row)
+		local buf = vim.fn.bufnr(fname)
+		if buf > 0 and vim.api.nvim_buf_is_loaded(buf) then
+			return vim.api.nvim_buf_get_lines(buf, row, row + 1, false)[1] or ''
+		end
+		local file = io.open(fname, 'r')
+		if not file then
+			return ''
+		end
+		local n = 0
+		for text in file:lines() do
+			if n == row then
+				file:close()
+				return text
+			end
+			n = n + 1
+		end
+		file:close()
+		return ''
+	end
+
+	local function lsp_locations(client, result)
+		if result.uri or result.targetUri then
+			result = {result}
+		end
+		local encoding = client.offset_encoding or 'utf-16'
+		local locations = {}
+		for _, loc in ipairs(result) do
+			local fname = vim.uri_to_fname(loc.uri or loc.targetUri)
+			local range = loc.targetSelectionRange or loc.range or loc.targetRange
+			local s, e = range.start, range['end']
+			table.insert(locations, {
+				file = fname,
+				line = s.line + 1,
+				col = character_to_byte(file_line(fname, s.line), s.character, encoding) + 1,
+				end_line = e.line + 1,
+				end_col = character_to_byte(file_line(fname, e.line), e.character, encoding) + 1,
+			})
+		end
+		return locations
+	end
+`
+
+func (c *NvimClient) LspHover(line, col int) (string, error) {
+	// Hover contents may be MarkupContent, a MarkedString or a list of
+	// MarkedStrings; each is rendered to markdown the way K shows it
+	expr := lspAtPositionLua + `
+		local function render(contents)
+			if type(contents) == 'string' then
+				return contents
+			elseif contents.kind then
+				return contents.value
+			elseif contents.language then
+				return '` + "```" + `' .. contents.language .. '\n' .. contents.value .. '\n` + "```" + `'
+			end
+			local parts = {}
+			for _, part in ipairs(contents) do
+				local text = render(part)
+				if text ~= '' then
+					table.insert(parts, text)
+				end
+			end
+			return table.concat(parts, '\n\n')
+		end
+
+		local _, position, responses = lsp_at_position('textDocument/hover', args.line, args.col)
+		local texts = {}
+		for _, response in ipairs(responses) do
+			local text = vim.trim(render(response.result.contents or ''))
+			if text ~= '' then
+				table.insert(texts, #responses > 1 and ('**' .. response.client.name .. '**\n\n' .. text) or text)
+			end
+		end
+		return {position = position, text = table.concat(texts, '\n\n---\n\n')}`
+
+	output, err := c.luaJSON(expr, map[string]any{"line": line, "col": col})
+	if err != nil {
+		return "", fmt.Errorf("failed to get hover: %v", err)
+	}
+
+	var hover struct {
+		Position struct {
+			Line int `json:"line"`
+			Col  int `json:"col"`
+		} `json:"position"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal([]byte(output), &hover); err != nil {
+		return "", fmt.Errorf("failed to parse hover: %v", err)
+	}
+	if hover.Text == "" {
+		return fmt.Sprintf("No hover information at line %d col %d", hover.Position.Line, hover.Position.Col), nil
+	}
+
+	return hover.Text, nil
+}
+
+func (c *NvimClient) LspDefinition(line, col int) (string, error) {
+	// Several servers may answer; duplicates of the same position are dropped
+	expr := lspAtPositionLua + `
+		local _, position, responses = lsp_at_position('textDocument/definition', args.line, args.col)
+		local seen, locations = {}, {}
+		for _, response in ipairs(responses) do
+			for _, loc in ipairs(lsp_locations(response.client, response.result)) do
+				local key = loc.file .. ':' .. loc.line .. ':' .. loc.col
+				if not seen[key] then
+					seen[key] = true
+					loc.client = response.client.name
+					table.insert(locations, loc)
+				end
+			end
+		end
+		return {position = position, definitions = #locations > 0 and locations or vim.NIL}`
+
+	output, err := c.luaJSON(expr, map[string]any{"line": line, "col": col})
+	if err != nil {
+		return "", fmt.Errorf("failed to get definition: %v", err)
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) LspReferences(line, col int, includeDeclaration bool) (string, error) {
+	// Each reference carries its trimmed source line so it reads well in
+	// a quickfix list
+	expr := lspAtPositionLua + `
+		local _, position, responses = lsp_at_position('textDocument/references', args.line, args.col, {
+			context = {includeDeclaration = args.include_declaration},
+		})
+		local seen, references = {}, {}
+		for _, response in ipairs(responses) do
+			for _, loc in ipairs(lsp_locations(response.client, response.result)) do
+				local key = loc.file .. ':' .. loc.line .. ':' .. loc.col
+				if not seen[key] then
+					seen[key] = true
+					loc.text = vim.trim(file_line(loc.file, loc.line - 1))
+					table.insert(references, loc)
+				end
+			end
+		end
+		table.sort(references, function(a, b)
+			if a.file ~= b.file then
+				return a.file < b.file
+			end
+			if a.line ~= b.line then
+				return a.line < b.line
+			end
+			return a.col < b.col
+		end)
+		return {position = position, count = #references, references = #references > 0 and references or vim.NIL}`
+
+	output, err := c.luaJSON(expr, map[string]any{
+		"line":                line,
+		"col":                 col,
+		"include_declaration": includeDeclaration,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get references: %v", err)
+	}
+
+	return output, nil
+}
+
+// maxSearchMatches caps how many matches a single search_buffer call returns
+const maxSearchMatches = 1000
+
+func (c *NvimClient) SearchBuffer(pattern string, regex, caseSensitive bool) (string, error) {
+	if pattern == "" {
+		return "", fmt.Errorf("pattern cannot be empty")
+	}
+
+	// Regex patterns use Vim's regex engine, as / does; columns are 1-based
+	// bytes and the text searched is the live buffer, not the file on disk
+	expr := `
+		local buf = vim.api.nvim_get_current_buf()
+		local find
+		if args.regex then
+			local ok, re = pcall(vim.regex, (args.case_sensitive and '\\C' or '\\c') .. args.pattern)
+			if not ok then
+				error('invalid pattern: ' .. tostring(re))
+			end
+			find = function(text, init)
+				local s, e = re:match_str(text:sub(init))
+				if s then
+					return init + s, init + e - 1
+				end
+			end
+		else
+			local needle = args.case_sensitive and args.pattern or args.pattern:lower()
+			find = function(text, init)
+				return (args.case_sensitive and text or text:lower()):find(needle, init, true)
+			end
+		end
+
+		local matches, truncated = {}, false
+		for lnum, text in ipairs(vim.api.nvim_buf_get_lines(buf, 0, -1, false)) do
+			local init = 1
+			while init <= #text + 1 do
+				local s, e = find(text, init)
+				if not s then
+					break
+				end
+				if #matches >= args.max_matches then
+					truncated = true
+					break
+				end
+				table.insert(matches, {line = lnum, col = s, end_col = e + 1, text = text:sub(s, e), line_text = text})
+				-- Step past zero-width matches so the scan always advances
+				init = e >= s and e + 1 or s + 1
+			end
+			if truncated then
+				break
+			end
+		end
+		return {
+			file = vim.api.nvim_buf_get_name(buf),
+			count = #matches,
+			truncated = truncated,
+			matches = #matches > 0 and matches or vim.NIL,
+		}`
+
+	output, err := c.luaJSON(expr, map[string]any{
+		"pattern":        pattern,
+		"regex":          regex,
+		"case_sensitive": caseSensitive,
+		"max_matches":    maxSearchMatches,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to search buffer: %v", err)
+	}
+
+	return output, nil
+}
+
+// defaultRegisters are the registers get_registers reads when none are named
+const defaultRegisters = `"0123456789abcdefghijklmnopqrstuvwxyz`
+
+// maxRegisterLength caps how many bytes of a register get_registers returns
+const maxRegisterLength = 4096
+
+func (c *NvimClient) GetRegisters(names string) (string, error) {
+	if names == "" {
+		names = defaultRegisters
+	}
+
+	// Empty registers are left out; register types are reported as
+	// charwise, linewise or blockwise with the block width
+	expr := `
+		local result = {}
+		for name in args.names:gmatch('.') do
+			local ok, value = pcall(vim.fn.getreg, name)
+			if not ok then
+				error('invalid register ' .. name)
+			end
+			if value ~= '' then
+				local regtype = vim.fn.getregtype(name)
+				local entry = {
+					name = name,
+					type = regtype == 'v' and 'charwise' or (regtype == 'V' and 'linewise' or 'blockwise'),
+					size = #value,
+					content = value,
+				}
+				if regtype:sub(1, 1) == '\22' then
+					entry.block_width = tonumber(regtype:sub(2))
+				end
+				if #value > args.max_length then
+					entry.content = value:sub(1, args.max_length)
+					entry.truncated = true
+				end
+				table.insert(result, entry)
+			end
+		end
+		return #result > 0 and result or vim.NIL`
+
+	output, err := c.luaJSON(expr, map[string]any{
+		"names":      names,
+		"max_length": maxRegisterLength,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get registers: %v", err)
+	}
+	if output == "null" {
+		return "[]", nil
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) GetMarks() (string, error) {
+	// Buffer-local marks come from the current buffer; file marks A-Z can
+	// point at any file, so they carry their own file name
+	expr := `
+		local buf = vim.api.nvim_get_current_buf()
+		local file = vim.api.nvim_buf_get_name(buf)
+		local marks = {}
+		local names = {}
+		for byte = string.byte('a'), string.byte('z') do
+			table.insert(names, string.char(byte))
+		end
+		vim.list_extend(names, {'<', '>', '^', '.'})
+		for _, name in ipairs(names) do
+			local pos = vim.fn.getpos("'" .. name)
+			if pos[2] > 0 then
+				table.insert(marks, {name = name, scope = 'buffer', file = file, line = pos[2], col = pos[3]})
+			end
+		end
+		for byte = string.byte('A'), string.byte('Z') do
+			local name = string.char(byte)
+			local mark = vim.api.nvim_get_mark(name, {})
+			if mark[1] > 0 then
+				table.insert(marks, {
+					name = name,
+					scope = 'global',
+					file = mark[4] ~= '' and vim.fn.fnamemodify(mark[4], ':p') or '',
+					line = mark[1],
+					col = mark[2] + 1,
+				})
+			end
+		end
+		return #marks > 0 and marks or vim.NIL`
+
+	output, err := c.luaJSON(expr, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to get marks: %v", err)
+	}
+	if output == "null" {
+		return "[]", nil
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) GetBufferInfo() (string, error) {
+	// An empty 'fileencoding' means the buffer is written in 'encoding'
+	expr := `
+		local buf = vim.api.nvim_get_current_buf()
+		local bo = vim.bo[buf]
+		local name = vim.api.nvim_buf_get_name(buf)
+		return {
+			bufnr = buf,
+			path = name ~= '' and vim.fn.fnamemodify(name, ':p') or '',
+			filetype = bo.filetype,
+			line_count = vim.api.nvim_buf_line_count(buf),
+			modified = bo.modified,
+			readonly = bo.readonly,
+			fileencoding = bo.fileencoding ~= '' and bo.fileencoding or vim.o.encoding,
+			fileformat = bo.fileformat,
+		}`
+
+	output, err := c.luaJSON(expr, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to get buffer info: %v", err)
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) ApplyEdits(edits []TextEdit) (string, error) {
+	if len(edits) == 0 {
+		return "", fmt.Errorf("no edits provided")
+	}
+
+	// A single-buffer transaction gets the same validation, bottom-up
+	// application and rollback as multi_buffer_edit
+	output, err := c.remoteExpr("bufnr('%')")
+	if err != nil {
+		return "", fmt.Errorf("failed to get current buffer: %v", err)
+	}
+	bufnr, err := strconv.Atoi(output)
+	if err != nil {
+		return "", fmt.Errorf("unexpected buffer number %q", output)
+	}
+
+	return c.MultiBufferEdit(map[int][]TextEdit{bufnr: edits}, nil)
+}
+
+func (c *NvimClient) InsertText(line, col int, text string) (string, error) {
+	// The cursor is moved to just after the inserted text; in normal mode
+	// Neovim keeps it on the last character when that is the line end
+	expr := `
+		local win = vim.api.nvim_get_current_win()
+		local buf = vim.api.nvim_win_get_buf(win)
+		if not vim.bo[buf].modifiable then
+			error('buffer ' .. buf .. ' is not modifiable')
+		end
+		local line, col = args.line, args.col
+		if line == 0 then
+			local cursor = vim.api.nvim_win_get_cursor(win)
+			line, col = cursor[1], cursor[2] + 1
+		end
+		local count = vim.api.nvim_buf_line_count(buf)
+		if line < 1 or line > count then
+			error(string.format('line %d is out of range (buffer has %d lines)', line, count))
+		end
+		local current = vim.api.nvim_buf_get_lines(buf, line - 1, line, false)[1]
+		col = math.max(col, 1)
+		if col > #current + 1 then
+			error(string.format('column %d is out of range (line %d has %d bytes)', col, line, #current))
+		end
+
+		local lines = vim.split(args.text, '\n', {plain = true})
+		vim.api.nvim_buf_set_text(buf, line - 1, col - 1, line - 1, col - 1, lines)
+		local end_line = line + #lines - 1
+		local end_col = #lines == 1 and col + #lines[1] or #lines[#lines] + 1
+		vim.api.nvim_win_set_cursor(win, {end_line, end_col - 1})
+		local cursor = vim.api.nvim_win_get_cursor(win)
+		return {
+			inserted_at = {line = line, col = col},
+			end_position = {line = end_line, col = end_col},
+			cursor = {line = cursor[1], col = cursor[2] + 1},
+			changedtick = vim.api.nvim_buf_get_changedtick(buf),
+		}`
+
+	output, err := c.luaJSON(expr, map[string]any{
+		"line": line,
+		"col":  col,
+		"text": text,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to insert text: %v", err)
+	}
+
+	return output, nil
+}
+
+// notifyLevels maps notify levels to the vim.log.levels key and the
+// highlight group used when falling back to :echomsg
+var notifyLevels = map[string][2]string{
+	"":      {"INFO", "None"},
+	"info":  {"INFO", "None"},
+	"warn":  {"WARN", "WarningMsg"},
+	"error": {"ERROR", "ErrorMsg"},
+}
+
+func (c *NvimClient) Notify(message, level string) (string, error) {
+	mapped, ok := notifyLevels[level]
+	if !ok {
+		return "", fmt.Errorf("invalid level %q (expected info, warn or error)", level)
+	}
+	if message == "" {
+		return "", fmt.Errorf("message cannot be empty")
+	}
+
+	// The message travels as an RPC argument, so it needs no escaping until
+	// the :echomsg fallback, where string() quotes it as a Vim literal
+	expr := `
+		if type(vim.notify) == 'function' and vim.log and vim.log.levels then
+			vim.notify(args.message, vim.log.levels[args.level])
+			return 'vim.notify'
+		end
+		vim.cmd('echohl ' .. args.highlight)
+		vim.cmd('echomsg ' .. vim.fn.string(args.message))
+		vim.cmd('echohl None')
+		return 'echomsg'`
+
+	output, err := c.luaJSON(expr, map[string]any{
+		"message":   message,
+		"level":     mapped[0],
+		"highlight": mapped[1],
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to notify: %v", err)
+	}
+
+	var method string
+	if err := json.Unmarshal([]byte(output), &method); err != nil {
+		return "", fmt.Errorf("failed to parse notify result: %v", err)
+	}
+	if level == "" {
+		level = "info"
+	}
+
+	return fmt.Sprintf("Displayed %s message via %s", level, method), nil
+}
+
+func (c *NvimClient) GetCodeActions(line, col, applyIndex int, verify bool) (string, error) {
+	// A position is an empty range, which is what a code-action keybinding
+	// sends in normal mode; listing and applying are range_code_action's
+	if line == 0 {
+		output, err := c.luaJSON(`
+			local cursor = vim.api.nvim_win_get_cursor(0)
+			return {cursor[1], cursor[2] + 1}`, nil)
+		if err != nil {
+			return "", fmt.Errorf("failed to get cursor: %v", err)
+		}
+		var cursor [2]int
+		if err := json.Unmarshal([]byte(output), &cursor); err != nil {
+			return "", fmt.Errorf("failed to parse cursor: %v", err)
+		}
+		line, col = cursor[0], cursor[1]
+	}
+	if col == 0 {
+		col = 1
+	}
+
+	return c.RangeCodeAction(line, col, line, col, "", applyIndex, false, verify)
+}
+
+func (c *NvimClient) LspRename(line, col int, newName string) (string, error) {
+	// Each server answers with a workspace edit but only the first is
+	// applied, since two servers renaming the same symbol would edit twice
+	expr := lspAtPositionLua + `
+		local _, position, responses = lsp_at_position('textDocument/rename', args.line, args.col, {newName = args.new_name})
+		local response = responses[1]
+		if not response then
+			error('the language server found nothing to rename at this position')
+		end
+
+		local counts, operations = {}, 0
+		for uri, edits in pairs(response.result.changes or {}) do
+			counts[vim.uri_to_fname(uri)] = (counts[vim.uri_to_fname(uri)] or 0) + #edits
+		end
+		for _, change in ipairs(response.result.documentChanges or {}) do
+			if change.kind then
+				operations = operations + 1
+			else
+				local fname = vim.uri_to_fname(change.textDocument.uri)
+				counts[fname] = (counts[fname] or 0) + #change.edits
+			end
+		end
+		vim.lsp.util.apply_workspace_edit(response.result, response.client.offset_encoding or 'utf-16')
+
+		local files, total = {}, 0
+		for fname, count in pairs(counts) do
+			table.insert(files, {file = fname, edits = count})
+			total = total + count
+		end
+		table.sort(files, function(a, b) return a.file < b.file end)
+		return {
+			position = position,
+			new_name = args.new_name,
+			client = response.client.name,
+			files = #files > 0 and files or vim.NIL,
+			file_count = #files,
+			edit_count = total,
+			file_operations = operations,
+		}`
+
+	output, err := c.luaJSON(expr, map[string]any{"line": line, "col": col, "new_name": newName})
+	if err != nil {
+		return "", fmt.Errorf("failed to rename: %v", err)
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) FormatBuffer(rangeStart, rangeEnd *int) (string, error) {
+	// Formatting that only shuffles whitespace keeps the line count, so the
+	// buffer is compared by checksum; changedtick alone moves on no-op edits
+	expr := lspCompatLua + `
+		local buf = vim.api.nvim_get_current_buf()
+		local method = 'textDocument/formatting'
+		local opts = {bufnr = buf, async = false, timeout_ms = 5000}
+		if args.start_line > 0 then
+			local count = vim.api.nvim_buf_line_count(buf)
+			local start_line, end_line = args.start_line, args.end_line > 0 and args.end_line or args.start_line
+			if start_line > end_line or end_line > count then
+				error(string.format('invalid range %d-%d (buffer has %d lines)', start_line, end_line, count))
+			end
+			local last = vim.api.nvim_buf_get_lines(buf, end_line - 1, end_line, false)[1]
+			method = 'textDocument/rangeFormatting'
+			opts.range = {start = {start_line, 0}, ['end'] = {end_line, #last}}
+		end
+
+		local names = {}
+		for _, client in ipairs(lsp_clients({bufnr = buf})) do
+			if lsp_supports(client, method, buf) then
+				table.insert(names, client.name)
+			end
+		end
+		if #names == 0 then
+			error('no attached LSP client supports ' .. method)
+		end
+
+		local function checksum()
+			return vim.fn.sha256(table.concat(vim.api.nvim_buf_get_lines(buf, 0, -1, false), '\n'))
+		end
+		local before, lines_before = checksum(), vim.api.nvim_buf_line_count(buf)
+		vim.lsp.buf.format(opts)
+		return {
+			file = vim.api.nvim_buf_get_name(buf),
+			method = method,
+			clients = names,
+			changed = checksum() ~= before,
+			lines_before = lines_before,
+			lines_after = vim.api.nvim_buf_line_count(buf),
+			changedtick = vim.api.nvim_buf_get_changedtick(buf),
+		}`
+
+	params := map[string]any{"start_line": 0, "end_line": 0}
+	if rangeStart != nil {
+		params["start_line"] = *rangeStart
+	}
+	if rangeEnd != nil {
+		params["end_line"] = *rangeEnd
+	}
+
+	output, err := c.luaJSON(expr, params)
+	if err != nil {
+		return "", fmt.Errorf("failed to format buffer: %v", err)
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) GetTreesitterContext(line, col int) (string, error) {
+	// Function and class nodes are recognised by type name, as in snapshot,
+	// so this works across grammars without per-language queries
+	expr := `
+		local buf = vim.api.nvim_get_current_buf()
+		local line, col = args.line, args.col
+		if line == 0 then
+			local cursor = vim.api.nvim_win_get_cursor(0)
+			line, col = cursor[1], cursor[2] + 1
+		end
+		local count = vim.api.nvim_buf_line_count(buf)
+		if line < 1 or line > count then
+			error(string.format('line %d is out of range (buffer has %d lines)', line, count))
+		end
+		col = math.max(col, 1)
+
+		local ok, parser = pcall(vim.treesitter.get_parser, buf)
+		if not ok or not parser then
+			local filetype = vim.bo[buf].filetype
+			error('no treesitter parser available for filetype ' .. (filetype ~= '' and filetype or '(none)'))
+		end
+		parser:parse()
+		local node = vim.treesitter.get_node({bufnr = buf, pos = {line - 1, col - 1}})
+		if not node then
+			error(string.format('no syntax node at line %d col %d', line, col))
+		end
+
+		local function describe(n, with_text)
+			local start_row, start_col, end_row, end_col = n:range()
+			local name = n:field('name')[1]
+			return {
+				type = n:type(),
+				name = name and vim.treesitter.get_node_text(name, buf) or vim.NIL,
+				start_line = start_row + 1,
+				start_col = start_col + 1,
+				end_line = end_row + 1,
+				end_col = end_col + 1,
+				text = with_text and vim.treesitter.get_node_text(n, buf) or nil,
+			}
+		end
+
+		local result = {
+			file = vim.api.nvim_buf_get_name(buf),
+			language = parser:lang(),
+			position = {line = line, col = col},
+			node = describe(node, false),
+		}
+		local ancestors = {}
+		local parent = node
+		while parent do
+			local kind = parent:type()
+			if not result['function'] and (kind:match('function') or kind:match('method')) and not kind:match('call') then
+				result['function'] = describe(parent, true)
+			elseif not result.class and (kind:match('class') or kind:match('struct') or kind:match('interface') or kind:match('impl')) then
+				result.class = describe(parent, result['function'] == nil)
+			end
+			table.insert(ancestors, kind)
+			parent = parent:parent()
+		end
+		result.ancestors = ancestors
+		return result`
+
+	output, err := c.luaJSON(expr, map[string]any{"line": line, "col": col})
+	if err != nil {
+		return "", fmt.Errorf("failed to get treesitter context: %v", err)
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) SaveBuffer(path string, force bool) (string, error) {
+	// :write runs BufWritePre and BufWritePost, so format-on-save and LSP
+	// hooks fire as they would for the user; Vim's error is passed through
+	expr := `
+		local buf = vim.api.nvim_get_current_buf()
+		local command = args.force and 'write!' or 'write'
+		if args.path ~= '' then
+			command = command .. ' ' .. vim.fn.fnameescape(args.path)
+		end
+		local ok, err = pcall(vim.cmd, command)
+		if not ok then
+			error((tostring(err):gsub('^Vim:', '')))
+		end
+		local file = args.path ~= '' and vim.fn.fnamemodify(args.path, ':p') or vim.api.nvim_buf_get_name(buf)
+		return {
+			bufnr = buf,
+			file = file,
+			command = command,
+			bytes = vim.fn.getfsize(file),
+			modified = vim.bo[buf].modified,
+			changedtick = vim.api.nvim_buf_get_changedtick(buf),
+		}`
+
+	output, err := c.luaJSON(expr, map[string]any{"path": path, "force": force})
+	if err != nil {
+		return "", fmt.Errorf("failed to save buffer: %v", err)
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) Undo(count int) (string, error) {
+	return c.undoRedo("undo", count)
+}
+
+func (c *NvimClient) Redo(count int) (string, error) {
+	return c.undoRedo("redo", count)
+}
+
+// undoRedo runs :undo or :redo count times in the current buffer and
+// reports where the buffer ended up in its undo tree
+func (c *NvimClient) undoRedo(command string, count int) (string, error) {
+	if count < 0 {
+		return "", fmt.Errorf("count must be positive, got %d", count)
+	}
+	if count == 0 {
+		count = 1
+	}
+
+	// Stepping stops early at either end of the tree, which is reported
+	// through steps rather than as an error
+	expr := undoStateLua + `
+		local buf = vim.api.nvim_get_current_buf()
+		local before = undo_state(buf)
+		local steps = 0
+		for _ = 1, args.count do
+			local seq = vim.fn.changenr()
+			vim.cmd('silent ' .. args.command)
+			if vim.fn.changenr() == seq then
+				break
+			end
+			steps = steps + 1
+		end
+		local after = undo_state(buf)
+		after.changenr = vim.fn.changenr()
+		after.steps = steps
+		after.previous_seq = before.seq_cur
+		return after`
+
+	output, err := c.luaJSON(expr, map[string]any{"command": command, "count": count})
+	if err != nil {
+		return "", fmt.Errorf("failed to %s: %v", command, err)
+	}
+
+	return output, nil
 }
 
-func NewNvimClient() (*NvimClient, error) {
-	// Use auto-detection
-	socketPath := findNvimSocket()
-	if socketPath == "" {
-		return nil, fmt.Errorf("no Neovim instance found for current directory")
+func (c *NvimClient) GetChangelist() (string, error) {
+	// getchangelist() returns the entries oldest first with 0-based columns
+	// and the index g; and g, would move from, which equals the entry count
+	// when the user has not navigated the list
+	expr := `
+		local buf = vim.api.nvim_get_current_buf()
+		local list = vim.fn.getchangelist(buf)
+		local entries, position = list[1], list[2]
+		local changes = {}
+		for i, entry in ipairs(entries) do
+			local text = vim.api.nvim_buf_get_lines(buf, entry.lnum - 1, entry.lnum, false)[1]
+			table.insert(changes, {
+				index = i,
+				line = entry.lnum,
+				col = entry.col + 1,
+				text = text or vim.NIL,
+				current = i == position + 1,
+			})
+		end
+		return {
+			bufnr = buf,
+			file = vim.api.nvim_buf_get_name(buf),
+			changenr = vim.fn.changenr(),
+			position = position + 1,
+			count = #changes,
+			changes = #changes > 0 and changes or vim.NIL,
+		}`
+
+	output, err := c.luaJSON(expr, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to get changelist: %v", err)
 	}
 
-	return &NvimClient{
-		socketPath: socketPath,
-	}, nil
+	return output, nil
 }
 
-func findNvimSocket() string {
-	// Check if NVIM environment variable is set (when running inside nvim)
-	if nvimSocket := os.Getenv("NVIM"); nvimSocket != "" {
-		if _, err := os.Stat(nvimSocket); err == nil {
-			return nvimSocket
-		}
+func (c *NvimClient) GetProjectRoot() (string, error) {
+	// Same resolution as relative_path, so the tools agree on the root
+	expr := projectPathsLua + `
+		local buf = vim.api.nvim_get_current_buf()
+		local root, method = project_root(buf)
+		return {
+			root = root,
+			method = method,
+			file = vim.api.nvim_buf_get_name(buf),
+			cwd = vim.fn.getcwd(),
+		}`
+
+	output, err := c.luaJSON(expr, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to get project root: %v", err)
 	}
 
-	// Otherwise, try to find the socket for the current working directory
-	pwd, err := os.Getwd()
+	return output, nil
+}
+
+func (c *NvimClient) ClearQuickfix(closeWindow, loclist bool) (int, error) {
+	// The current list is emptied in place rather than a new empty one
+	// pushed, so the stale results do not linger in :colder
+	expr := `
+		local size
+		if args.loclist then
+			size = vim.fn.getloclist(0, {size = 0}).size
+			vim.fn.setloclist(0, {}, 'r', {items = {}, title = ''})
+			if args.close_window then
+				vim.cmd('lclose')
+			end
+		else
+			size = vim.fn.getqflist({size = 0}).size
+			vim.fn.setqflist({}, 'r', {items = {}, title = ''})
+			if args.close_window then
+				vim.cmd('cclose')
+			end
+		end
+		return size`
+
+	output, err := c.luaJSON(expr, map[string]any{"close_window": closeWindow, "loclist": loclist})
 	if err != nil {
-		return ""
+		return 0, fmt.Errorf("failed to clear list: %v", err)
 	}
 
-	// Generate socket path using working directory name
-	cacheDir := os.Getenv("XDG_CACHE_HOME")
-	if cacheDir == "" {
-		homeDir, _ := os.UserHomeDir()
-		cacheDir = filepath.Join(homeDir, ".cache")
+	var cleared int
+	if err := json.Unmarshal([]byte(output), &cleared); err != nil {
+		return 0, fmt.Errorf("failed to parse clear result: %v", err)
 	}
-	sockDir := filepath.Join(cacheDir, "nvim")
 
-	projBase := filepath.Base(pwd)
-	socketPath := filepath.Join(sockDir, fmt.Sprintf("%s.sock", projBase))
+	return cleared, nil
+}
 
-	// Check if socket exists
-	if _, err := os.Stat(socketPath); err == nil {
-		return socketPath
+// checkWindow verifies that winid refers to an existing window (0 means current)
+func (c *NvimClient) checkWindow(winid int) error {
+	if winid == 0 {
+		return nil
 	}
 
-	return ""
-}
+	exists, err := c.remoteExpr(fmt.Sprintf("win_id2win(%d)", winid))
+	if err != nil {
+		return fmt.Errorf("failed to look up window: %v", err)
+	}
+	if exists == "0" {
+		return fmt.Errorf("window %d does not exist", winid)
+	}
 
-func (c *NvimClient) SetQuickfixList(items []QuickfixItem) error {
-	// Convert items to Vim dictionary format
-	vimList := c.quickfixItemsToVimList(items)
+	return nil
+}
 
-	// Use setqflist() function
-	command := fmt.Sprintf("call setqflist(%s)", vimList)
-	_, err := c.ExecuteCommand(command)
-	return err
+// CommandError is returned when a command fails inside Neovim, either with
+// an error message (Errmsg) or an exception (Exception), which is how :throw
+// and errors inside try blocks surface
+type CommandError struct {
+	Errmsg     string
+	Exception  string
+	Throwpoint string
 }
 
-func (c *NvimClient) OpenQuickfixWindow() error {
-	_, err := c.ExecuteCommand("copen")
-	return err
+func (e *CommandError) Error() string {
+	if e.Exception == "" {
+		return fmt.Sprintf("vim error: %s", e.Errmsg)
+	}
+	// Errors converted to exceptions look like Vim(cmd):E123: ...; anything
+	// else was thrown by the command itself
+	kind := "exception thrown"
+	if strings.HasPrefix(e.Exception, "Vim") {
+		kind = "vim error"
+	}
+	if e.Throwpoint != "" {
+		return fmt.Sprintf("%s: %s (at %s)", kind, e.Exception, e.Throwpoint)
+	}
+	return fmt.Sprintf("%s: %s", kind, e.Exception)
 }
 
 func (c *NvimClient) ExecuteCommand(command string) (string, error) {
@@ -85,23 +5284,60 @@ func (c *NvimClient) ExecuteCommand(command string) (string, error) {
 		normalizedCommand = command[1:]
 	}
 
-	// Clear Vim's error message variable first
-	if _, err := c.remoteExpr("execute('let v:errmsg = \"\"')"); err != nil {
-		return "", fmt.Errorf("failed to clear error message: %v", err)
-	}
+	// Errors raised inside try become exceptions, so v:exception catches
+	// both failing commands and :throw; v:errmsg still covers errors that
+	// silent! keeps from aborting. The command travels in a global variable
+	// so it needs no quoting inside the script.
+	expr := `
+		vim.v.errmsg = ''
+		vim.g.neovim_mcp_result = nil
+		vim.g.neovim_mcp_command = args.command
+		local script = table.concat({
+			'try',
+			"  let g:neovim_mcp_result = {'output': execute(g:neovim_mcp_command)}",
+			'catch',
+			"  let g:neovim_mcp_result = {'exception': v:exception, 'throwpoint': v:throwpoint}",
+			'endtry',
+		}, '\n')
+		local ok, err = pcall(function()
+			if vim.api.nvim_exec2 then
+				vim.api.nvim_exec2(script, {})
+			else
+				vim.api.nvim_exec(script, false)
+			end
+		end)
+		local result = vim.g.neovim_mcp_result or {exception = tostring(err), throwpoint = ''}
+		vim.g.neovim_mcp_command = nil
+		vim.g.neovim_mcp_result = nil
+		result.errmsg = vim.v.errmsg
+		return result`
 
-	// Execute command and capture output using execute() function
-	output, err := c.remoteExpr(fmt.Sprintf("execute('%s')", c.escapeVimString(normalizedCommand)))
+	raw, err := c.luaJSON(expr, map[string]any{"command": normalizedCommand})
 	if err != nil {
 		return "", fmt.Errorf("failed to execute command: %v", err)
 	}
 
+	var result struct {
+		Output     string `json:"output"`
+		Exception  string `json:"exception"`
+		Throwpoint string `json:"throwpoint"`
+		Errmsg     string `json:"errmsg"`
+	}
+	if err := json.Unmarshal([]byte(raw), &result); err != nil {
+		return "", fmt.Errorf("failed to parse command result: %v", err)
+	}
+	if result.Exception != "" {
+		return "", &CommandError{Exception: result.Exception, Throwpoint: result.Throwpoint}
+	}
+
 	// Check for Vim errors by reading v:errmsg
-	vimError, err := c.remoteExpr("v:errmsg")
-	if err == nil && strings.TrimSpace(vimError) != "" {
-		return "", fmt.Errorf("vim error: %s", vimError)
+	if strings.TrimSpace(result.Errmsg) != "" {
+		return "", &CommandError{Errmsg: result.Errmsg}
 	}
 
+	// execute() prefixes the captured messages with a newline
+	output := strings.Trim(result.Output, "\n")
+
 	// Return the command output, or a success message if no output
 	if strings.TrimSpace(output) == "" {
 		return fmt.Sprintf("Command executed successfully: %s", command), nil
@@ -116,8 +5352,12 @@ func (c *NvimClient) quickfixItemsToVimList(items []QuickfixItem) string {
 	for _, item := range items {
 		parts := []string{}
 
-		// Add filename
-		parts = append(parts, fmt.Sprintf("'filename': '%s'", c.escapeVimString(item.Filename)))
+		// Add the buffer, or the filename when there is none
+		if item.Bufnr > 0 {
+			parts = append(parts, fmt.Sprintf("'bufnr': %d", item.Bufnr))
+		} else {
+			parts = append(parts, fmt.Sprintf("'filename': \"%s\"", c.escapeVimString(item.Filename)))
+		}
 
 		// Add line number
 		parts = append(parts, fmt.Sprintf("'lnum': %d", item.Line))
@@ -127,12 +5367,20 @@ func (c *NvimClient) quickfixItemsToVimList(items []QuickfixItem) string {
 			parts = append(parts, fmt.Sprintf("'col': %d", item.Column))
 		}
 
+		// Add the end of the range if specified
+		if item.EndLine > 0 {
+			parts = append(parts, fmt.Sprintf("'end_lnum': %d", item.EndLine))
+		}
+		if item.EndCol > 0 {
+			parts = append(parts, fmt.Sprintf("'end_col': %d", item.EndCol))
+		}
+
 		// Add text
-		parts = append(parts, fmt.Sprintf("'text': '%s'", c.escapeVimString(item.Text)))
+		parts = append(parts, fmt.Sprintf("'text': \"%s\"", c.escapeVimString(item.Text)))
 
 		// Add type if specified
 		if item.Type != "" {
-			parts = append(parts, fmt.Sprintf("'type': '%s'", item.Type))
+			parts = append(parts, fmt.Sprintf("'type': \"%s\"", c.escapeVimString(item.Type)))
 		}
 
 		itemStrs = append(itemStrs, "{"+strings.Join(parts, ", ")+"}")
@@ -142,118 +5390,1061 @@ func (c *NvimClient) quickfixItemsToVimList(items []QuickfixItem) string {
 }
 
 func (c *NvimClient) escapeVimString(s string) string {
-	// Escape single quotes for Vim strings
-	return strings.ReplaceAll(s, "'", "''")
+	// Escape for a double-quoted Vim string, which unlike a single-quoted
+	// one can carry newlines and other control characters
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch ch := s[i]; ch {
+		case '\\':
+			b.WriteString(`\\`)
+		case '"':
+			b.WriteString(`\"`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			// Bytes >= 0x80 are passed through so UTF-8 text is unchanged
+			if ch < 0x20 || ch == 0x7f {
+				fmt.Fprintf(&b, `\x%02x`, ch)
+			} else {
+				b.WriteByte(ch)
+			}
+		}
+	}
+	return b.String()
+}
+
+// TextEdit replaces the text between two positions. Lines and columns are
+// 1-based; the end column is exclusive, so start == end inserts text.
+type TextEdit struct {
+	StartLine int    `json:"start_line"`
+	StartCol  int    `json:"start_col"`
+	EndLine   int    `json:"end_line"`
+	EndCol    int    `json:"end_col"`
+	NewText   string `json:"new_text"`
 }
 
 type QuickfixItem struct {
 	Filename string
+	Bufnr    int // used instead of Filename for unsaved or unnamed buffers
 	Line     int
 	Column   int
+	EndLine  int // optional end of the range; zero marks a single point
+	EndCol   int // exclusive, like the end of every other range here
 	Text     string
 	Type     string // "E" for error, "W" for warning, "I" for info
 }
 
-func (c *NvimClient) GetBufferContext() (string, error) {
-	var result strings.Builder
+// Validate clamps a negative column to 1 and reports why the item cannot
+// be a quickfix entry, if it cannot
+func (item *QuickfixItem) Validate() error {
+	if item.Filename == "" && item.Bufnr == 0 {
+		return errors.New("filename or bufnr is required")
+	}
+	if item.Filename != "" && item.Bufnr != 0 {
+		return errors.New("filename and bufnr are mutually exclusive")
+	}
+	if item.Bufnr < 0 {
+		return fmt.Errorf("invalid bufnr %d", item.Bufnr)
+	}
+	if item.Line < 1 {
+		return fmt.Errorf("line must be at least 1, got %d", item.Line)
+	}
+	if item.Column < 0 {
+		item.Column = 1
+	}
+	if item.EndCol < 0 {
+		item.EndCol = 1
+	}
+	if item.EndCol > 0 && item.EndLine == 0 {
+		item.EndLine = item.Line
+	}
+	if item.EndLine != 0 && item.EndLine < item.Line {
+		return fmt.Errorf("end_line %d is before line %d", item.EndLine, item.Line)
+	}
+	switch item.Type {
+	case "", "E", "W", "I", "N":
+	default:
+		return fmt.Errorf("unknown type %q (expected E, W, I or N)", item.Type)
+	}
+	return nil
+}
 
-	// Get file path
-	filePath, err := c.remoteExpr("expand('%:p')")
-	if err != nil {
-		return "", fmt.Errorf("failed to get file path: %v", err)
+// bufferContextLua gathers everything get_buffer_context reports in one
+// call, so the cursor cannot move between fields. The selection is the live
+// one (getpos('v') to the cursor) and selected_text spans its whole lines.
+const bufferContextLua = `
+	local mode = vim.fn.mode()
+	local result = {
+		file_path = vim.fn.expand('%:p'),
+		cursor = {line = vim.fn.line('.'), col = vim.fn.col('.')},
+		mode = mode,
+		changedtick = vim.b.changedtick,
 	}
-	result.WriteString("FILE_PATH:" + filePath + "\n")
+	local kind = mode:sub(1, 1)
+	if kind == 'v' or kind == 'V' or kind == '\22' then
+		local start_pos, end_pos = vim.fn.getpos('v'), vim.fn.getpos('.')
+		result.visual_selection = {
+			start_line = start_pos[2],
+			start_col = start_pos[3],
+			end_line = end_pos[2],
+			end_col = end_pos[3],
+		}
+		local first, last = math.min(start_pos[2], end_pos[2]), math.max(start_pos[2], end_pos[2])
+		result.selected_text = table.concat(vim.api.nvim_buf_get_lines(0, first - 1, last, false), '\n')
+	else
+		result.current_line = vim.fn.getline('.')
+	end
+	return result`
 
-	// Get cursor position
-	cursor, err := c.remoteExpr("printf('%d:%d', line('.'), col('.'))")
+func (c *NvimClient) GetBufferContextJSON() (string, error) {
+	output, err := c.luaJSON(bufferContextLua, nil)
 	if err != nil {
-		return "", fmt.Errorf("failed to get cursor position: %v", err)
+		return "", fmt.Errorf("failed to get buffer context: %v", err)
 	}
-	result.WriteString("CURSOR:" + cursor + "\n")
 
-	// Get current mode
-	mode, err := c.remoteExpr("mode()")
+	return output, nil
+}
+
+func (c *NvimClient) GetBufferContext() (string, error) {
+	// All fields come from one call; the text layout is unchanged from
+	// when each was fetched separately
+	output, err := c.luaJSON(bufferContextLua, nil)
 	if err != nil {
-		return "", fmt.Errorf("failed to get mode: %v", err)
+		return "", fmt.Errorf("failed to get buffer context: %v", err)
 	}
-	result.WriteString("MODE:" + mode + "\n")
-
-	// Check if in visual mode and get selection
-	if strings.HasPrefix(mode, "v") || strings.HasPrefix(mode, "V") || mode == "\x16" { // \x16 is Ctrl-V
-		// Get visual selection range using current selection positions
-		visualRange, err := c.remoteExpr("printf('%d:%d to %d:%d', getpos('v')[1], getpos('v')[2], getpos('.')[1], getpos('.')[2])")
-		if err != nil {
-			return "", fmt.Errorf("failed to get visual range: %v", err)
-		}
-		result.WriteString("VISUAL_SELECTION:" + visualRange + "\n")
 
-		// Get selected text using Lua for more reliable extraction
-		selectedText, err := c.remoteExpr(`luaeval('(function()
-			local start_pos = vim.fn.getpos("v")
-			local end_pos = vim.fn.getpos(".")
-			local start_line, start_col = start_pos[2], start_pos[3]
-			local end_line, end_col = end_pos[2], end_pos[3]
+	var state struct {
+		FilePath string `json:"file_path"`
+		Cursor   struct {
+			Line int `json:"line"`
+			Col  int `json:"col"`
+		} `json:"cursor"`
+		Mode            string `json:"mode"`
+		Changedtick     int    `json:"changedtick"`
+		CurrentLine     string `json:"current_line"`
+		VisualSelection *struct {
+			StartLine int `json:"start_line"`
+			StartCol  int `json:"start_col"`
+			EndLine   int `json:"end_line"`
+			EndCol    int `json:"end_col"`
+		} `json:"visual_selection"`
+		SelectedText string `json:"selected_text"`
+	}
+	if err := json.Unmarshal([]byte(output), &state); err != nil {
+		return "", fmt.Errorf("failed to parse buffer context: %v", err)
+	}
 
-			-- Ensure proper ordering
-			if start_line > end_line or (start_line == end_line and start_col > end_col) then
-				start_line, end_line = end_line, start_line
-				start_col, end_col = end_col, start_col
-			end
+	var result strings.Builder
+	result.WriteString("FILE_PATH:" + state.FilePath + "\n")
+	result.WriteString(fmt.Sprintf("CURSOR:%d:%d\n", state.Cursor.Line, state.Cursor.Col))
+	result.WriteString("MODE:" + state.Mode + "\n")
+	result.WriteString(fmt.Sprintf("CHANGEDTICK:%d\n", state.Changedtick))
 
-			local lines = vim.api.nvim_buf_get_lines(0, start_line - 1, end_line, false)
-			return table.concat(lines, "\\n")
-		end)()')`)
-		if err != nil {
-			return "", fmt.Errorf("failed to get selected text: %v", err)
-		}
-		result.WriteString("SELECTED_TEXT:" + selectedText + "\n")
+	if selection := state.VisualSelection; selection != nil {
+		result.WriteString(fmt.Sprintf("VISUAL_SELECTION:%d:%d to %d:%d\n", selection.StartLine, selection.StartCol, selection.EndLine, selection.EndCol))
+		result.WriteString("SELECTED_TEXT:" + state.SelectedText + "\n")
 	} else {
-		// Get current line
-		currentLine, err := c.remoteExpr("getline('.')")
-		if err != nil {
-			return "", fmt.Errorf("failed to get current line: %v", err)
-		}
-		result.WriteString("CURRENT_LINE:" + currentLine + "\n")
+		result.WriteString("CURRENT_LINE:" + state.CurrentLine + "\n")
 	}
 
 	return result.String(), nil
 }
 
-func (c *NvimClient) GetDiagnostics() (string, error) {
-	// Use Lua expression to get diagnostics as formatted string
-	expr := `luaeval('(function()
-		local diagnostics = vim.diagnostic.get(0)
+// diagnosticSeverities are the severity names accepted by the diagnostic
+// filters, most severe first
+var diagnosticSeverities = []string{"ERROR", "WARN", "INFO", "HINT"}
+
+// diagnosticFilterLua collects diagnostics for args.scope ('all' for every
+// buffer, otherwise the current one) filtered by args.severity (exactly one
+// level) or args.min_severity (that level or worse). For scope all they are
+// ordered by file and line and returned with each buffer's file name.
+const diagnosticFilterLua = `
+	local function collect_diagnostics()
+		local opts = {}
+		if args.severity ~= '' then
+			opts.severity = vim.diagnostic.severity[args.severity]
+		elseif args.min_severity ~= '' then
+			opts.severity = {min = vim.diagnostic.severity[args.min_severity]}
+		end
+		if args.scope ~= 'all' then
+			return vim.diagnostic.get(0, opts), {}
+		end
+		-- The diagnostics may be the cached tables, so file names are kept
+		-- aside rather than stored on them
+		local diagnostics = vim.diagnostic.get(nil, opts)
+		local files = {}
+		for _, diag in ipairs(diagnostics) do
+			files[diag.bufnr] = files[diag.bufnr] or vim.api.nvim_buf_get_name(diag.bufnr)
+		end
+		table.sort(diagnostics, function(a, b)
+			if files[a.bufnr] ~= files[b.bufnr] then
+				return files[a.bufnr] < files[b.bufnr]
+			end
+			if a.lnum ~= b.lnum then
+				return a.lnum < b.lnum
+			end
+			return a.col < b.col
+		end)
+		return diagnostics, files
+	end
+`
+
+func (c *NvimClient) GetDiagnostics(scope, severity, minSeverity string) (string, error) {
+	// With scope all, each file's diagnostics follow a FILE: header
+	expr := diagnosticFilterLua + `
+		local diagnostics, files = collect_diagnostics()
 		if #diagnostics == 0 then
 			return "NO_DIAGNOSTICS"
 		else
 			local result = {}
+			local file
 			for _, diag in ipairs(diagnostics) do
+				if files[diag.bufnr] and files[diag.bufnr] ~= file then
+					file = files[diag.bufnr]
+					table.insert(result, "FILE:" .. file)
+				end
 				local severity_map = {"ERROR", "WARN", "INFO", "HINT"}
 				local severity = severity_map[diag.severity] or "UNKNOWN"
 				table.insert(result, "DIAGNOSTIC:" .. (diag.lnum + 1) .. ":" .. (diag.col + 1) .. ":" .. severity .. ":" .. (diag.message or ""))
 			end
-			return table.concat(result, "\\n")
+			return table.concat(result, "\n")
+		end`
+
+	output, err := c.luaJSON(expr, map[string]any{
+		"scope":        scope,
+		"severity":     severity,
+		"min_severity": minSeverity,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get diagnostics: %v", err)
+	}
+
+	var text string
+	if err := json.Unmarshal([]byte(output), &text); err != nil {
+		return "", fmt.Errorf("failed to parse diagnostics: %v", err)
+	}
+
+	return text, nil
+}
+
+func (c *NvimClient) GetDiagnosticsJSON(scope, severity, minSeverity string) (string, error) {
+	// Positions are converted to the 1-based, end-exclusive columns the
+	// other tools use; codes may be numbers or strings, so both become strings
+	expr := diagnosticFilterLua + `
+		local severity_map = {'ERROR', 'WARN', 'INFO', 'HINT'}
+		local diagnostics, files = collect_diagnostics()
+		local result = {}
+		for _, diag in ipairs(diagnostics) do
+			table.insert(result, {
+				file = files[diag.bufnr],
+				bufnr = files[diag.bufnr] and diag.bufnr or nil,
+				line = diag.lnum + 1,
+				col = diag.col + 1,
+				end_line = (diag.end_lnum or diag.lnum) + 1,
+				end_col = (diag.end_col or diag.col) + 1,
+				severity = severity_map[diag.severity] or 'UNKNOWN',
+				source = diag.source or '',
+				code = diag.code ~= nil and tostring(diag.code) or '',
+				message = diag.message or '',
+			})
 		end
-	end)()')`
+		return #result > 0 and result or vim.NIL`
 
-	output, err := c.remoteExpr(expr)
+	output, err := c.luaJSON(expr, map[string]any{
+		"scope":        scope,
+		"severity":     severity,
+		"min_severity": minSeverity,
+	})
 	if err != nil {
 		return "", fmt.Errorf("failed to get diagnostics: %v", err)
 	}
+	if output == "null" {
+		return "[]", nil
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) LineOffsets(bufnr, startLine, maxLines int) (string, error) {
+	// Offsets are computed from nvim_buf_get_offset, which counts every line
+	// ending as a single byte, so they are widened for 'fileformat' dos
+	expr := `
+		local buf = args.bufnr ~= 0 and args.bufnr or vim.api.nvim_get_current_buf()
+		if not vim.api.nvim_buf_is_loaded(buf) then
+			error('buffer ' .. buf .. ' is not loaded')
+		end
+		local ff = vim.bo[buf].fileformat
+		local eol_extra = ff == 'dos' and 1 or 0
+		local count = vim.api.nvim_buf_line_count(buf)
+		local first = math.max(args.start_line, 1)
+		local last = math.min(first + args.max_lines - 1, count)
+		local offsets = {}
+		for lnum = first, last do
+			local off = vim.api.nvim_buf_get_offset(buf, lnum - 1) + eol_extra * (lnum - 1)
+			table.insert(offsets, {line = lnum, offset = off})
+		end
+		local total = vim.api.nvim_buf_get_offset(buf, count)
+		if vim.bo[buf].eol or vim.bo[buf].fixeol then
+			total = total + eol_extra * count
+		else
+			total = total + eol_extra * (count - 1)
+		end
+		local result = {
+			bufnr = buf,
+			fileformat = ff,
+			fileencoding = vim.bo[buf].fileencoding ~= '' and vim.bo[buf].fileencoding or vim.o.encoding,
+			line_count = count,
+			total_bytes = total,
+			offsets = offsets,
+		}
+		if last < count then
+			result.next_line = last + 1
+		end
+		return result`
+
+	output, err := c.luaJSON(expr, map[string]any{
+		"bufnr":      bufnr,
+		"start_line": startLine,
+		"max_lines":  maxLines,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get line offsets: %v", err)
+	}
+
+	return output, nil
+}
+
+func (c *NvimClient) CommandInfo(command string) (string, error) {
+	if strings.TrimSpace(command) == "" {
+		return "", fmt.Errorf("command cannot be empty")
+	}
+
+	// Every bar-separated command is parsed by Neovim itself, so modifiers,
+	// abbreviations and ranges are resolved before classification. Commands
+	// that run other commands (:execute with string literals, :normal,
+	// :global, :bufdo, ...) are classified through what they run, and
+	// anything the rules cannot follow is reported as unknown rather than
+	// assumed safe.
+	expr := `
+		local backtick = string.char(96)
+		local result = {input = args.command, findings = {}, quits = false, shell = false, lua = false, unresolved = false}
+		local rank = {['read-only'] = 1, mutating = 2, unknown = 3, lua = 4, shell = 5, quit = 6}
+		local flags = {quit = 'quits', shell = 'shell', lua = 'lua', unknown = 'unresolved'}
+
+		local function set_of(names)
+			local set = {}
+			for _, name in ipairs(names) do
+				set[name] = true
+			end
+			return set
+		end
+
+		local quit_commands = set_of({
+			'quit', 'qall', 'quitall', 'wq', 'wqall', 'xit', 'xall', 'exit', 'cquit', 'stop',
+			'suspend', 'detach', 'restart',
+		})
+		local shell_commands = set_of({
+			'!', 'terminal', 'shell', 'make', 'lmake', 'grep', 'grepadd', 'lgrep', 'lgrepadd',
+			'cscope', 'lcscope', 'scscope', 'diffpatch', 'perl', 'perldo', 'perlfile', 'python',
+			'pydo', 'pyfile', 'python3', 'py3do', 'py3file', 'pyx', 'pythonx', 'pyxdo', 'pyxfile',
+			'ruby', 'rubydo', 'rubyfile',
+		})
+		local lua_commands = set_of({'lua', 'luado', 'luafile'})
+		-- These run code from files, registers or plugins
+		local unresolved_commands = set_of({
+			'source', 'runtime', 'packadd', 'packloadall', 'doautocmd', 'doautoall', 'hardcopy',
+			'checkhealth', 'debug', '@', '*',
+		})
+		local echo_commands = set_of({'echo', 'echon', 'echomsg', 'echoerr', 'echowindow'})
+		local eval_commands = set_of({
+			'call', 'const', 'unlet', 'lockvar', 'unlockvar', 'eval', 'if', 'elseif', 'while',
+			'for', 'return', 'throw', 'cexpr', 'lexpr', 'cgetexpr', 'lgetexpr', 'caddexpr',
+			'laddexpr',
+		})
+		local do_commands = set_of({
+			'argdo', 'bufdo', 'windo', 'tabdo', 'cdo', 'cfdo', 'ldo', 'lfdo', 'folddoopen',
+			'folddoclosed',
+		})
+		-- These define code that runs later
+		local defining_commands = set_of({'autocmd', 'command', 'function'})
+		-- These only list existing definitions when given no arguments
+		local listing = set_of({'highlight', 'filetype', 'syntax', 'let'})
+		local read_only = set_of({
+			'messages', 'ls', 'buffers', 'files', 'jumps', 'marks', 'registers', 'display',
+			'changes', 'pwd', 'version', 'history', 'clist', 'llist', 'scriptnames', 'digraphs',
+			'print', 'number', '#', 'list', 'help', 'undolist', 'tags', 'oldfiles', '=',
+		})
+		-- Options whose values are evaluated or run as programs
+		local code_options = set_of({
+			'statusline', 'tabline', 'winbar', 'statuscolumn', 'foldexpr', 'foldtext',
+			'indentexpr', 'formatexpr', 'includeexpr', 'charconvert', 'diffexpr', 'patchexpr',
+			'printexpr', 'omnifunc', 'completefunc', 'thesaurusfunc', 'tagfunc', 'operatorfunc',
+			'quickfixtextfunc', 'findfunc', 'shell', 'shellcmdflag', 'shellpipe', 'shellredir',
+			'shellquote', 'shellxquote', 'shellxescape', 'makeprg', 'grepprg', 'keywordprg',
+			'equalprg', 'formatprg', 'exrc',
+		})
+		local shell_functions = set_of({
+			'system', 'systemlist', 'jobstart', 'jobsend', 'chansend', 'termopen', 'libcall',
+			'libcallnr', 'spawn', 'popen',
+		})
+		local mutating_functions = set_of({
+			'setline', 'setbufline', 'append', 'appendbufline', 'deletebufline', 'setreg',
+			'setpos', 'setcharpos', 'cursor', 'setcursorcharpos', 'setqflist', 'setloclist',
+			'writefile', 'delete', 'mkdir', 'rename', 'bufload', 'bufadd', 'setbufvar',
+			'setwinvar', 'settabvar', 'settabwinvar', 'setfperm', 'winrestview', 'histadd',
+			'histdel', 'matchadd', 'matchaddpos', 'matchdelete', 'clearmatches', 'setmatches',
+			'chdir', 'setenv', 'setcmdline', 'win_gotoid', 'add', 'insert', 'remove', 'extend',
+		})
+		-- Functions without side effects. Anything not listed here or above,
+		-- including user and autoload functions, cannot be checked.
+		local pure_functions = set_of({
+			'abs', 'and', 'or', 'xor', 'invert', 'argc', 'argv', 'argidx', 'bufexists',
+			'buflisted', 'bufloaded', 'bufname', 'bufnr', 'bufwinid', 'bufwinnr', 'byte2line',
+			'byteidx', 'ceil', 'changenr', 'char2nr', 'charcol', 'charidx', 'col', 'copy',
+			'count', 'deepcopy', 'empty', 'escape', 'executable', 'exepath', 'exists', 'expand',
+			'filereadable', 'filewritable', 'float2nr', 'floor', 'fnameescape', 'fnamemodify',
+			'foldclosed', 'foldclosedend', 'foldlevel', 'get', 'getbufinfo', 'getbufline',
+			'getbufoneline', 'getbufvar', 'getchangelist', 'getcharpos', 'getcmdline',
+			'getcmdpos', 'getcmdtype', 'getcurpos', 'getcwd', 'getenv', 'getfperm', 'getfsize',
+			'getftime', 'getftype', 'getjumplist', 'getline', 'getloclist', 'getmarklist',
+			'getmatches', 'getpid', 'getpos', 'getqflist', 'getreg', 'getreginfo', 'getregtype',
+			'gettabinfo', 'gettabvar', 'gettabwinvar', 'getwininfo', 'getwinvar', 'glob',
+			'globpath', 'has', 'has_key', 'haslocaldir', 'hasmapto', 'histget', 'histnr',
+			'hlexists', 'hlID', 'hostname', 'indent', 'index', 'isdirectory', 'items', 'join',
+			'json_decode', 'json_encode', 'keys', 'len', 'line', 'line2byte', 'localtime',
+			'maparg', 'mapcheck', 'match', 'matchend', 'matchlist', 'matchstr', 'matchstrpos',
+			'max', 'min', 'mode', 'nr2char', 'pathshorten', 'pow', 'printf', 'range',
+			'readfile', 'reg_executing', 'reg_recording', 'reltime', 'reltimefloat',
+			'reltimestr', 'repeat', 'resolve', 'reverse', 'round', 'shellescape', 'shiftwidth',
+			'simplify', 'slice', 'split', 'sqrt', 'str2float', 'str2nr', 'strcharpart',
+			'strchars', 'strdisplaywidth', 'strftime', 'stridx', 'string', 'strlen', 'strpart',
+			'strridx', 'strtrans', 'strwidth', 'submatch', 'substitute', 'synID', 'synIDattr',
+			'synIDtrans', 'tabpagebuflist', 'tabpagenr', 'tabpagewinnr', 'tempname', 'tolower',
+			'toupper', 'tr', 'trim', 'type', 'undotree', 'values', 'virtcol', 'visualmode',
+			'win_findbuf', 'win_getid', 'win_id2tabwin', 'win_id2win', 'winbufnr', 'wincol',
+			'winheight', 'winlayout', 'winline', 'winnr', 'winsaveview', 'winwidth', 'wordcount',
+		})
+
+		local function mark(name, classification, reason)
+			table.insert(result.findings, {command = name, classification = classification, reason = reason})
+			if flags[classification] then
+				result[flags[classification]] = true
+			end
+		end
+
+		local function option_name(name)
+			local ok, info = pcall(vim.api.nvim_get_option_info2, name, {})
+			return ok and info.name or name
+		end
+
+		-- scan_text flags shell and Lua entry points anywhere in a command's
+		-- arguments, string literals included, since strings can be run later
+		local function scan_text(name, text)
+			for fn in text:gmatch('([%w_#]+)%s*%(') do
+				if shell_functions[fn] then
+					mark(name, 'shell', fn .. '() runs an external program')
+				end
+			end
+			if text:find('os.execute', 1, true) then
+				mark(name, 'shell', 'os.execute() runs an external program')
+			end
+			if text:find('luaeval', 1, true) or text:find('v:lua', 1, true) then
+				mark(name, 'lua', 'evaluates Lua code')
+			end
+		end
+
+		-- scan_expression checks every function an expression calls
+		local function scan_expression(name, text)
+			local uses_lua = text:find('luaeval', 1, true) or text:find('v:lua', 1, true)
+			for pos in text:gmatch('()%(') do
+				local before = text:sub(1, pos - 1)
+				local fn = before:match('([%w_:#.]*)%s*$'):gsub('^[.:]+', '')
+				if before:match('[%]%)}]%s*$') then
+					mark(name, 'unknown', 'calls a function reference that cannot be checked')
+				elseif fn == '' or fn:match('^%d') then
+					-- A parenthesized subexpression
+				elseif mutating_functions[fn] then
+					mark(name, 'mutating', fn .. '() changes buffers, files or editor state')
+				elseif uses_lua then
+					-- Calls made next to Lua code are as unchecked as the Lua
+					-- code itself, which scan_text already flags
+				elseif not pure_functions[fn] and not shell_functions[fn] then
+					mark(name, 'unknown', fn .. '() cannot be checked')
+				end
+			end
+			if text:find(backtick, 1, true) and (text:find('expand', 1, true) or text:find('glob', 1, true)) then
+				mark(name, 'shell', 'backtick expansion runs a shell command')
+			end
+		end
+
+		-- split_expression separates an expression from a following
+		-- bar-separated command, skipping bars inside string literals and ||.
+		-- The third result is true when a string literal is never closed.
+		local function split_expression(text)
+			local i, quote = 1, nil
+			while i <= #text do
+				local c = text:sub(i, i)
+				if quote == "'" then
+					if c == "'" then
+						if text:sub(i + 1, i + 1) == "'" then
+							i = i + 1
+						else
+							quote = nil
+						end
+					end
+				elseif quote == '"' then
+					if c == '\\' then
+						i = i + 1
+					elseif c == '"' then
+						quote = nil
+					end
+				elseif c == '@' then
+					-- Register names such as @" are not strings
+					i = i + 1
+				elseif c == "'" or c == '"' then
+					quote = c
+				elseif c == '|' then
+					if text:sub(i + 1, i + 1) ~= '|' then
+						return text:sub(1, i - 1), text:sub(i + 1), false
+					end
+					i = i + 1
+				end
+				i = i + 1
+			end
+			return text, nil, quote ~= nil
+		end
+
+		-- split_bar returns the command after the first unescaped bar in
+		-- arguments the parser did not split
+		local function split_bar(text)
+			local i = 1
+			while i <= #text do
+				local c = text:sub(i, i)
+				if c == '\\' or c == '\22' then
+					i = i + 1
+				elseif c == '|' then
+					return text:sub(i + 1)
+				end
+				i = i + 1
+			end
+			return nil
+		end
+
+		-- literal_string evaluates an :execute argument made only of string
+		-- literals joined by . or .., returning nil for anything else
+		local function literal_string(text)
+			local parts, current, joined = {}, nil, false
+			local i = 1
+			while i <= #text do
+				local c = text:sub(i, i)
+				if c:match('%s') then
+					i = i + 1
+				elseif c == '.' then
+					if current == nil or joined then
+						return nil
+					end
+					joined = true
+					i = i + (text:sub(i + 1, i + 1) == '.' and 2 or 1)
+				elseif c == "'" or c == '"' then
+					local j = i + 1
+					while j <= #text do
+						local d = text:sub(j, j)
+						if c == '"' and d == '\\' then
+							j = j + 1
+						elseif d == c then
+							if c == "'" and text:sub(j + 1, j + 1) == "'" then
+								j = j + 1
+							else
+								break
+							end
+						end
+						j = j + 1
+					end
+					if j > #text then
+						return nil
+					end
+					local ok, value = pcall(vim.fn.eval, text:sub(i, j))
+					if not ok or type(value) ~= 'string' then
+						return nil
+					end
+					if joined then
+						current = current .. value
+					else
+						if current then
+							table.insert(parts, current)
+						end
+						current = value
+					end
+					joined = false
+					i = j + 1
+				else
+					return nil
+				end
+			end
+			if current == nil or joined then
+				return nil
+			end
+			table.insert(parts, current)
+			return table.concat(parts, ' ')
+		end
+
+		local classify
+		classify = function(text, depth)
+			local input = text:gsub('^[%s:]+', '')
+			if input == '' then
+				return
+			end
+			if depth > 20 then
+				mark(input, 'unknown', 'nests commands too deeply to check')
+				return
+			end
+			if input:match('^"') then
+				mark(input, 'read-only', 'is a comment')
+				return
+			end
+
+			local ok, parsed = pcall(vim.api.nvim_parse_cmd, input, {})
+			if depth == 0 then
+				result.parsed = ok
+				if ok then
+					result.command = parsed.cmd
+					result.range = parsed.range
+					result.bang = parsed.bang
+					result.args = parsed.args
+				else
+					result.command = vim.fn.fullcommand(input:match("^[%s%d,.$%%'<>+-]*(%a+)") or '')
+					result.range = {}
+					result.bang = input:match("^[%s%d,.$%%'<>+-]*%a+!") ~= nil
+					result.args = {}
+					result.parse_error = parsed
+				end
+			end
+			if not ok then
+				if input:match("^[%s%d,;.$%%'<>+-]+$") then
+					mark(input, 'mutating', 'moves the cursor')
+				else
+					mark(input, 'unknown', 'Neovim could not parse the command: ' .. tostring(parsed))
+				end
+				return
+			end
+
+			local cmd = parsed.cmd
+			local argstr = table.concat(parsed.args or {}, ' ')
+			local rest
+			scan_text(cmd, argstr)
+
+			if quit_commands[cmd] or cmd == 'wincmd' and argstr:match('^%s*[qc]') then
+				mark(cmd, 'quit', 'quits Neovim')
+			elseif shell_commands[cmd] or (cmd == 'read' or cmd == 'write') and argstr:match('^%s*!') then
+				mark(cmd, 'shell', 'runs an external program')
+			elseif lua_commands[cmd] or cmd == '=' and argstr:match('%S') then
+				mark(cmd, 'lua', 'runs Lua code')
+			elseif unresolved_commands[cmd] or cmd:match('^%u') then
+				mark(cmd, 'unknown', 'runs code from files, registers or plugins that cannot be checked')
+			elseif cmd == 'execute' then
+				local expression, after, open = split_expression(argstr)
+				rest = after
+				local value = not open and literal_string(expression)
+				if value then
+					mark(cmd, 'read-only', 'runs the commands in its string arguments')
+					for line in (value .. '\n'):gmatch('(.-)\n') do
+						classify(line, depth + 1)
+					end
+				else
+					scan_expression(cmd, expression)
+					mark(cmd, 'unknown', 'builds the command from an expression that cannot be checked')
+				end
+			elseif echo_commands[cmd] or eval_commands[cmd] or cmd == 'let' and argstr:match('%S') then
+				local expression, after, open = split_expression(argstr)
+				rest = after
+				if open then
+					mark(cmd, 'unknown', 'has a string literal that is never closed')
+				elseif echo_commands[cmd] then
+					mark(cmd, 'read-only', 'only displays the value of an expression')
+				else
+					mark(cmd, 'mutating', 'evaluates an expression that may change editor state')
+				end
+				local option = (cmd == 'let' or cmd == 'const') and expression:match('^%s*&[lg]?:?(%a+)')
+				if option and code_options[option_name(option)] then
+					mark(cmd, 'unknown', 'sets an option that runs expressions or external programs')
+				end
+				scan_expression(cmd, expression)
+			elseif cmd == 'normal' then
+				if argstr:find('ZZ', 1, true) or argstr:find('ZQ', 1, true) or argstr:find('\23[qc]') then
+					mark(cmd, 'quit', 'types keys that quit Neovim')
+				elseif argstr:find('[:!Q@=K]') or argstr:find('gq', 1, true) then
+					mark(cmd, 'unknown', 'types keys that can run commands, macros or external programs')
+				else
+					mark(cmd, 'mutating', 'types keys that may change buffers')
+				end
+			elseif do_commands[cmd] then
+				mark(cmd, 'mutating', 'runs a command in several buffers or windows')
+				classify(argstr, depth + 1)
+			elseif cmd == 'global' or cmd == 'vglobal' then
+				local delim = argstr:match('^%s*(.)')
+				local body = ''
+				if delim then
+					local i = argstr:find(delim, 1, true) + 1
+					while i <= #argstr do
+						local c = argstr:sub(i, i)
+						if c == '\\' then
+							i = i + 1
+						elseif c == delim then
+							body = argstr:sub(i + 1)
+							break
+						end
+						i = i + 1
+					end
+				end
+				if body:match('%S') then
+					mark(cmd, 'read-only', 'runs a command on matching lines')
+					classify(body, depth + 1)
+				else
+					mark(cmd, 'read-only', 'prints matching lines')
+				end
+			elseif defining_commands[cmd] or cmd:match('map$') or cmd:match('abbrev') or cmd:match('menu$') then
+				if argstr == '' and not parsed.bang then
+					mark(cmd, 'read-only', 'lists existing definitions')
+				elseif cmd:find('un', 1, true) or argstr == '' then
+					mark(cmd, 'mutating', 'removes existing definitions')
+				else
+					mark(cmd, 'unknown', 'defines code that runs later and cannot be checked')
+				end
+			elseif cmd == 'set' or cmd == 'setlocal' or cmd == 'setglobal' then
+				rest = split_bar(argstr)
+				local querying, code = true, false
+				for _, a in ipairs(parsed.args or {}) do
+					if not a:match('%?$') then
+						querying = false
+						if code_options[option_name(a:match('^(%w+)') or '')] then
+							code = true
+						end
+					end
+				end
+				if code then
+					mark(cmd, 'unknown', 'sets an option that runs expressions or external programs')
+				elseif querying then
+					mark(cmd, 'read-only', 'only queries option values')
+				else
+					mark(cmd, 'mutating', 'changes option values')
+				end
+			elseif listing[cmd] then
+				rest = split_bar(argstr)
+				if argstr == '' and not parsed.bang then
+					mark(cmd, 'read-only', 'lists existing definitions')
+				else
+					mark(cmd, 'mutating', 'defines or changes editor state')
+				end
+			elseif read_only[cmd] then
+				rest = split_bar(argstr)
+				mark(cmd, 'read-only', 'only displays information')
+			else
+				rest = split_bar(argstr)
+				mark(cmd, 'mutating', 'may change buffers, files or editor state')
+				if cmd == 'put' and (parsed.reg == '=' or argstr:match('^%s*=')) or argstr:find('\\=', 1, true) then
+					scan_expression(cmd, argstr)
+				end
+				if argstr:find(backtick, 1, true) and cmd ~= 'substitute' then
+					mark(cmd, 'shell', 'backtick expansion runs a shell command')
+				end
+			end
+
+			if rest and rest:match('%S') then
+				classify(rest, depth + 1)
+			end
+			if parsed.nextcmd and parsed.nextcmd ~= '' then
+				classify(parsed.nextcmd, depth + 1)
+			end
+		end
+
+		classify(args.command, 0)
+		if #result.findings == 0 then
+			mark(result.command or '', 'read-only', 'does nothing')
+		end
+		local worst = result.findings[1]
+		for _, finding in ipairs(result.findings) do
+			if rank[finding.classification] > rank[worst.classification] then
+				worst = finding
+			end
+		end
+		result.command = result.command or ''
+		result.classification = worst.classification
+		result.reason = worst.reason
+		return result`
+
+	output, err := c.luaJSON(expr, map[string]any{"command": command})
+	if err != nil {
+		return "", fmt.Errorf("failed to get command info: %v", err)
+	}
 
 	return output, nil
 }
 
+// CommandFinding is one classification reached for a command or for one of
+// the commands it runs
+type CommandFinding struct {
+	Command        string `json:"command"`
+	Classification string `json:"classification"`
+	Reason         string `json:"reason"`
+}
+
+// CommandDetails is the part of CommandInfo used for policy decisions
+type CommandDetails struct {
+	Command        string           `json:"command"`
+	Classification string           `json:"classification"`
+	Reason         string           `json:"reason"`
+	Quits          bool             `json:"quits"`
+	Shell          bool             `json:"shell"`
+	Lua            bool             `json:"lua"`
+	Unresolved     bool             `json:"unresolved"`
+	Findings       []CommandFinding `json:"findings"`
+}
+
+// Finding returns the first finding with the given classification, falling
+// back to the overall one
+func (d *CommandDetails) Finding(classification string) CommandFinding {
+	for _, finding := range d.Findings {
+		if finding.Classification == classification {
+			return finding
+		}
+	}
+	return CommandFinding{Command: d.Command, Classification: d.Classification, Reason: d.Reason}
+}
+
+func (c *NvimClient) ClassifyCommand(command string) (*CommandDetails, error) {
+	output, err := c.CommandInfo(command)
+	if err != nil {
+		return nil, err
+	}
+
+	var details CommandDetails
+	if err := json.Unmarshal([]byte(output), &details); err != nil {
+		return nil, fmt.Errorf("failed to decode command info: %v", err)
+	}
+
+	return &details, nil
+}
+
+// luaJSON runs a Lua function body in Neovim and returns its result encoded as
+// JSON. The args value is JSON encoded and available to the body as `args`.
+func (c *NvimClient) luaJSON(body string, args any) (string, error) {
+	encodedArgs, err := json.Marshal(args)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode arguments: %v", err)
+	}
+
+	// The body goes on its own lines so a trailing comment cannot swallow
+	// the closing end
+	code := "return vim.json.encode((function(args)\n" + body + "\nend)(vim.json.decode(...)))"
+
+	var result string
+	if err := c.call(func(v *nvim.Nvim) error {
+		return v.ExecLua(code, &result, string(encodedArgs))
+	}); err != nil {
+		return "", fmt.Errorf("failed to execute expression: %v", err)
+	}
+
+	return result, nil
+}
+
 func (c *NvimClient) remoteExpr(expr string) (string, error) {
-	cmd := exec.Command("nvim", "--server", c.socketPath, "--remote-expr", expr)
+	var result any
+	if err := c.call(func(v *nvim.Nvim) error {
+		return v.Eval(expr, &result)
+	}); err != nil {
+		return "", fmt.Errorf("failed to execute expression: %w", err)
+	}
+
+	// Callers expect the same text --remote-expr used to print
+	switch value := result.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return value, nil
+	case int64, uint64, float64:
+		return fmt.Sprint(value), nil
+	case bool:
+		return fmt.Sprintf("v:%t", value), nil
+	default:
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return "", fmt.Errorf("failed to encode result: %v", err)
+		}
+		return string(encoded), nil
+	}
+}
+
+// call runs fn on the RPC connection and gives up after the client's timeout
+func (c *NvimClient) call(fn func(v *nvim.Nvim) error) error {
+	v, err := c.connection()
+	if err != nil {
+		return err
+	}
+	defer c.release(v)
+
+	ctx := c.context()
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	if ctx.Done() == nil {
+		err := fn(v)
+		c.checkConnection(v, err)
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- fn(v) }()
+
+	select {
+	case err := <-done:
+		c.checkConnection(v, err)
+		return err
+	case <-ctx.Done():
+		if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			// The caller gave up; the answer is discarded when it arrives
+			return fmt.Errorf("stopped waiting for Neovim: %w", ctx.Err())
+		}
+		// A pending request cannot be cancelled, so the connection is
+		// dropped to release it once other calls are done with it, and the
+		// next call dials again
+		c.dropConnection(v)
+		return fmt.Errorf("%w after %s", errRPCTimeout, c.timeout)
+	}
+}
+
+// context returns the context bounding this client's calls
+func (c *NvimClient) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
 
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+// errRPCTimeout reports that Neovim did not answer within the RPC timeout
+var errRPCTimeout = errors.New("timed out waiting for Neovim")
 
-	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("failed to execute expression: %v, stderr: %s", err, stderr.String())
+// connection returns the RPC connection, dialing the socket if needed, and
+// counts the caller as one of its users until it calls release
+func (c *NvimClient) connection() (*nvim.Nvim, error) {
+	c.rpcMu.Lock()
+	defer c.rpcMu.Unlock()
+
+	if c.rpc == nil {
+		if c.socketPath == "" {
+			return nil, fmt.Errorf("no Neovim socket configured")
+		}
+		ctx := c.context()
+		if c.timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, c.timeout)
+			defer cancel()
+		}
+		v, err := nvim.Dial(c.socketPath, nvim.DialContext(ctx), nvim.DialNetDial(dialNvim))
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to %s: %v", c.socketPath, err)
+		}
+		if err := c.registerHandlers(v); err != nil {
+			v.Close()
+			return nil, fmt.Errorf("failed to connect to %s: %v", c.socketPath, err)
+		}
+		c.rpc = v
+		if c.dropped {
+			c.dropped = false
+			if c.handlers.Reconnected != nil {
+				go c.handlers.Reconnected()
+			}
+		}
+	}
+	if c.rpcUsers == nil {
+		c.rpcUsers = make(map[*nvim.Nvim]int)
+	}
+	c.rpcUsers[c.rpc]++
+
+	return c.rpc, nil
+}
+
+// release ends a call's use of v, shutting v if it was dropped or the client
+// was closed while the call was in flight
+func (c *NvimClient) release(v *nvim.Nvim) {
+	c.rpcMu.Lock()
+	defer c.rpcMu.Unlock()
+
+	c.rpcUsers[v]--
+	if c.rpcUsers[v] > 0 {
+		return
+	}
+	delete(c.rpcUsers, v)
+	if c.closed || c.rpc != v {
+		v.Close()
+		if c.rpc == v {
+			c.rpc = nil
+		}
+	}
+}
+
+// dialNvim picks the network from the address itself; nvim.Dial's own
+// check treats any path containing a colon as TCP
+func dialNvim(ctx context.Context, _, address string) (net.Conn, error) {
+	var d net.Dialer
+	if isTCPAddress(address) {
+		return d.DialContext(ctx, "tcp", address)
+	}
+	return d.DialContext(ctx, "unix", address)
+}
+
+// isTCPAddress reports whether address is a host:port address, as used by
+// nvim --listen 127.0.0.1:6666, rather than a Unix socket path
+func isTCPAddress(address string) bool {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || strings.ContainsRune(host, '/') {
+		return false
+	}
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n <= 65535
+}
+
+// checkConnection drops a connection whose session has closed, e.g. because
+// Neovim exited, so that the next call dials again
+func (c *NvimClient) checkConnection(v *nvim.Nvim, err error) {
+	if !errors.Is(err, rpc.ErrClosed) && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		return
 	}
+	c.dropConnection(v)
+}
+
+// dropConnection forgets v if it is still the current connection, so that the
+// next call dials again. v itself is closed once no call is using it, which
+// also ends any request abandoned on it.
+func (c *NvimClient) dropConnection(v *nvim.Nvim) {
+	c.rpcMu.Lock()
+	defer c.rpcMu.Unlock()
+	if c.rpc != v {
+		return
+	}
+	c.rpc = nil
+	c.dropped = true
+	if c.rpcUsers[v] == 0 {
+		v.Close()
+	}
+}
+
+// Close shuts down the RPC connection, if one is open. Calls still in flight
+// keep it open until they return.
+func (c *NvimClient) Close() error {
+	c.rpcMu.Lock()
+	defer c.rpcMu.Unlock()
 
-	return strings.TrimSpace(stdout.String()), nil
+	c.closed = true
+	if c.rpc == nil || c.rpcUsers[c.rpc] > 0 {
+		return nil
+	}
+	err := c.rpc.Close()
+	c.rpc = nil
+	return err
 }
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEscapeVimString(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "hello world", "hello world"},
+		{"double quote", `say "hi"`, `say \"hi\"`},
+		{"single quote", "it's", "it's"},
+		{"backslash", `C:\path\file`, `C:\\path\\file`},
+		{"backslash before quote", `\"`, `\\\"`},
+		{"newline", "one\ntwo", `one\ntwo`},
+		{"carriage return and tab", "a\r\tb", `a\r\tb`},
+		{"bar", "echo 1 | qa", "echo 1 | qa"},
+		{"key notation", "foo<CR>bar", "foo<CR>bar"},
+		{"escaped key notation", `\<CR>`, `\\<CR>`},
+		{"control character", "a\x1bb", `a\x1bb`},
+		{"delete", "a\x7fb", `a\x7fb`},
+		{"utf-8", "héllo → 世界", "héllo → 世界"},
+	}
+
+	c := &NvimClient{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.escapeVimString(tt.in); got != tt.want {
+				t.Errorf("escapeVimString(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsTCPAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		want    bool
+	}{
+		{"127.0.0.1:6666", true},
+		{"[::1]:6666", true},
+		{"localhost:6666", true},
+		{"/tmp/nvim.sock", false},
+		{"/tmp/a:1/sock", false},
+		{"host:0", false},
+		{"host:70000", false},
+		{"host:port", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			if got := isTCPAddress(tt.address); got != tt.want {
+				t.Errorf("isTCPAddress(%q) = %v, want %v", tt.address, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTruncateOutput(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		limit int
+		want  string
+	}{
+		{"ascii", "hello world", 5, "hello\n... (truncated, 6 more bytes)"},
+		{"rune boundary", "héllo", 3, "hé\n... (truncated, 3 more bytes)"},
+		{"inside two-byte rune", "héllo", 2, "h\n... (truncated, 5 more bytes)"},
+		{"inside four-byte rune", "a😀b", 3, "a\n... (truncated, 5 more bytes)"},
+		{"leading rune", "世界", 2, "\n... (truncated, 6 more bytes)"},
+		{"zero limit", "abc", 0, "\n... (truncated, 3 more bytes)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := truncateOutput(tt.text, tt.limit); got != tt.want {
+				t.Errorf("truncateOutput(%q, %d) = %q, want %q", tt.text, tt.limit, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuickfixItemValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		item    QuickfixItem
+		want    QuickfixItem
+		wantErr string
+	}{
+		{
+			name: "filename",
+			item: QuickfixItem{Filename: "main.go", Line: 3, Text: "x"},
+			want: QuickfixItem{Filename: "main.go", Line: 3, Text: "x"},
+		},
+		{
+			name: "bufnr",
+			item: QuickfixItem{Bufnr: 4, Line: 3, Type: "W"},
+			want: QuickfixItem{Bufnr: 4, Line: 3, Type: "W"},
+		},
+		{name: "neither filename nor bufnr", item: QuickfixItem{Line: 3}, wantErr: "filename or bufnr is required"},
+		{name: "filename and bufnr", item: QuickfixItem{Filename: "main.go", Bufnr: 4, Line: 3}, wantErr: "filename and bufnr are mutually exclusive"},
+		{name: "negative bufnr", item: QuickfixItem{Bufnr: -1, Line: 3}, wantErr: "invalid bufnr -1"},
+		{name: "zero line", item: QuickfixItem{Filename: "main.go"}, wantErr: "line must be at least 1, got 0"},
+		{
+			name: "negative columns clamped",
+			item: QuickfixItem{Filename: "main.go", Line: 3, Column: -2, EndCol: -1},
+			want: QuickfixItem{Filename: "main.go", Line: 3, Column: 1, EndLine: 3, EndCol: 1},
+		},
+		{
+			name: "end column defaults end line",
+			item: QuickfixItem{Bufnr: 1, Line: 3, EndCol: 8},
+			want: QuickfixItem{Bufnr: 1, Line: 3, EndLine: 3, EndCol: 8},
+		},
+		{name: "end line before line", item: QuickfixItem{Filename: "main.go", Line: 3, EndLine: 2}, wantErr: "end_line 2 is before line 3"},
+		{name: "unknown type", item: QuickfixItem{Filename: "main.go", Line: 3, Type: "X"}, wantErr: `unknown type "X" (expected E, W, I or N)`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			item := tt.item
+			err := item.Validate()
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("Validate() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Validate() error = %v", err)
+			}
+			if item != tt.want {
+				t.Errorf("Validate() left %+v, want %+v", item, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuickfixItemsToVimList(t *testing.T) {
+	tests := []struct {
+		name  string
+		items []QuickfixItem
+		want  string
+	}{
+		{"empty", nil, "[]"},
+		{
+			"filename",
+			[]QuickfixItem{{Filename: "main.go", Line: 3, Column: 5, Text: "unused", Type: "W"}},
+			`[{'filename': "main.go", 'lnum': 3, 'col': 5, 'text': "unused", 'type': "W"}]`,
+		},
+		{
+			"bufnr instead of filename",
+			[]QuickfixItem{{Bufnr: 7, Line: 1, Text: "x"}},
+			`[{'bufnr': 7, 'lnum': 1, 'text': "x"}]`,
+		},
+		{
+			"escaping",
+			[]QuickfixItem{{Filename: `C:\src\"a".go`, Line: 2, Text: "it's\nbroken | here"}},
+			`[{'filename': "C:\\src\\\"a\".go", 'lnum': 2, 'text': "it's\nbroken | here"}]`,
+		},
+		{
+			"range",
+			[]QuickfixItem{{Filename: "main.go", Line: 3, Column: 2, EndLine: 5, EndCol: 9, Text: "x"}},
+			`[{'filename': "main.go", 'lnum': 3, 'col': 2, 'end_lnum': 5, 'end_col': 9, 'text': "x"}]`,
+		},
+		{
+			"end line without end column",
+			[]QuickfixItem{{Bufnr: 2, Line: 3, EndLine: 4, Text: "x"}},
+			`[{'bufnr': 2, 'lnum': 3, 'end_lnum': 4, 'text': "x"}]`,
+		},
+		{
+			"several items",
+			[]QuickfixItem{{Bufnr: 1, Line: 1, Text: "a"}, {Filename: "b.go", Line: 2, Text: "b"}},
+			`[{'bufnr': 1, 'lnum': 1, 'text': "a"}, {'filename': "b.go", 'lnum': 2, 'text': "b"}]`,
+		},
+	}
+
+	c := &NvimClient{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.quickfixItemsToVimList(tt.items); got != tt.want {
+				t.Errorf("quickfixItemsToVimList() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestErrorCategory(t *testing.T) {
+	tests := []struct {
+		message string
+		want    string
+	}{
+		{"failed to bind arguments: unexpected end of JSON input", "arguments"},
+		{"write access is disabled; start the server with --allow-write", "policy"},
+		{"command blocked by policy: shell commands are disabled", "policy"},
+		{"no Neovim instance found: no socket", "connection"},
+		{"found multiple Neovim instances; pick one with select_instance", "connection"},
+		{"failed to connect to /tmp/nvim.sock: connection refused", "connection"},
+		{"Neovim at /tmp/nvim.sock is not responding: timed out", "connection"},
+		{"failed to watch buffer: buffer 3 is not loaded", "invalid_target"},
+		{"Watch 4 does not exist", "invalid_target"},
+		{"invalid buffer resource URI", "invalid_target"},
+		{"failed to execute command: E492: Not an editor command", "nvim"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.message, func(t *testing.T) {
+			if got := errorCategory(tt.message); got != tt.want {
+				t.Errorf("errorCategory(%q) = %q, want %q", tt.message, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindMacroKeys(t *testing.T) {
+	tests := []struct {
+		name      string
+		keys      string
+		sequences []string
+		want      string
+	}{
+		{"plain edit", "ciwfoo\x1b", macroShellKeys, ""},
+		{"shell filter", "!!sort\r", macroShellKeys, "!"},
+		{"ex mode", "gQ", macroShellKeys, "Q"},
+		{"command-line window", "q:", macroShellKeys, "q:"},
+		{"other register", "@a", macroShellKeys, "@"},
+		{"first listed wins", "@a!!", macroShellKeys, "!"},
+		{"write and quit", "ddZZ", macroQuitKeys, "ZZ"},
+		{"quit without writing", "ZQ", macroQuitKeys, "ZQ"},
+		{"single Z", "Zz", macroQuitKeys, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := findMacroKeys(tt.keys, tt.sequences); got != tt.want {
+				t.Errorf("findMacroKeys(%q) = %q, want %q", tt.keys, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMacroCommands(t *testing.T) {
+	tests := []struct {
+		name string
+		keys string
+		want []string
+	}{
+		{"no command", "ciwfoo\x1b", nil},
+		{"carriage return", ":w\r", []string{"w"}},
+		{"newline", ":s/a/b/\n", []string{"s/a/b/"}},
+		{"unterminated", "dd:normal! x", []string{"normal! x"}},
+		{"several", ":w\rj:!ls\n", []string{"w", "!ls"}},
+		{"trimmed", ":  wq  \r", []string{"wq"}},
+		{"empty command line", ":\r:q\r", []string{"q"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := macroCommands(tt.keys)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("macroCommands(%q) = %q, want %q", tt.keys, got, tt.want)
+			}
+		})
+	}
+}
@@ -2,7 +2,10 @@ module github.com/bstastny/neovim-mcp
 
 go 1.24.4
 
-require github.com/mark3labs/mcp-go v0.39.1
+require (
+	github.com/mark3labs/mcp-go v0.39.1
+	github.com/neovim/go-client v1.2.1
+)
 
 require (
 	github.com/bahlo/generic-list-go v0.2.0 // indirect
@@ -1,34 +1,184 @@
 package main
 
 import (
-	"log"
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"regexp"
+	"sync"
+	"syscall"
 
+	"github.com/mark3labs/mcp-go/mcp"
 	"github.com/mark3labs/mcp-go/server"
 )
 
 func main() {
+	var config Config
+	flag.BoolVar(&config.AllowWrite, "allow-write", false, "allow tools that modify buffers or files")
+	flag.BoolVar(&config.AllowLua, "allow-lua", false, "allow execute_command to run Lua code")
+	flag.BoolVar(&config.AllowShell, "allow-shell", false, "allow execute_command to run shell commands")
+	flag.BoolVar(&config.SafeMode, "safe-mode", false, "only let execute_command run read-only commands")
+	flag.Func("command-denylist", "regular expression for commands execute_command rejects; repeat for several", func(pattern string) error {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return err
+		}
+		config.CommandDenylist = append(config.CommandDenylist, re)
+		return nil
+	})
+	flag.StringVar(&config.Socket, "socket", "", "Neovim socket path or host:port to connect to (overrides $NVIM_MCP_SOCKET and auto-detection)")
+	flag.DurationVar(&config.RPCTimeout, "rpc-timeout", defaultRPCTimeout, "how long to wait for Neovim to answer each call (0 waits indefinitely)")
+	flag.IntVar(&config.MaxOutputBytes, "max-output-bytes", defaultMaxOutputBytes, "truncate tool results longer than this many bytes (0 disables the limit)")
+	logLevel := os.Getenv("NVIM_MCP_LOG")
+	if logLevel == "" {
+		logLevel = "info"
+	}
+	flag.StringVar(&logLevel, "log-level", logLevel, "log verbosity: debug, info, warn or error (defaults to $NVIM_MCP_LOG, then info)")
+	flag.Parse()
+
+	// Logs go to stderr; stdout carries the MCP protocol
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(logLevel)); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid log level %q: expected debug, info, warn or error\n", logLevel)
+		os.Exit(2)
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
 	// Initialize the Neovim toolbox
-	nvimToolbox, err := NewNvimToolbox()
+	nvimToolbox, err := NewNvimToolbox(config)
 	if err != nil {
-		log.Printf("Warning during initialization: %v", err)
+		slog.Warn("initialization incomplete", "err", err)
 	}
 
+	// Buffer resources are refreshed whenever a client lists resources
+	hooks := &server.Hooks{}
+	hooks.AddBeforeListResources(nvimToolbox.RefreshBufferResources)
+
 	// Create MCP server with tool capabilities
 	s := server.NewMCPServer(
 		"neovim-mcp",
 		"1.0.0",
 		server.WithToolCapabilities(true),
-		server.WithInstructions("This MCP server provides access to the user's live Neovim editing session. Use get_buffer_context first to see what code the user is currently working on, get_diagnostics to understand any issues, and populate_quickfix to send your analysis results back to their editor."),
+		server.WithResourceCapabilities(true, true),
+		server.WithHooks(hooks),
+		server.WithToolHandlerMiddleware(nvimToolbox.RecordErrors),
+		server.WithToolHandlerMiddleware(nvimToolbox.LimitOutput),
+		server.WithInstructions("This MCP server provides access to the user's live Neovim editing session. Use snapshot first to see what the user is currently working on (get_buffer_context gives the selected text), get_diagnostics to understand any issues, and populate_quickfix to send your analysis results back to their editor."),
 	)
 
-	// Register tools
+	// Register tools and resources
 	nvimToolbox.RegisterTools(s)
+	nvimToolbox.RegisterResources(s)
 
 	// Start the server
-	log.Println("Starting Neovim MCP server...")
-	if err := server.ServeStdio(s); err != nil {
-		log.Fatal(err)
+	slog.Info("starting Neovim MCP server", "socket", nvimToolbox.client.socketPath, "detection", nvimToolbox.client.detection)
+	if err := serveStdio(s, nvimToolbox); err != nil {
+		slog.Error("server stopped", "err", err)
+		os.Exit(1)
+	}
+}
+
+// serveStdio serves s on stdin and stdout like server.ServeStdio, except that
+// resources/subscribe and resources/unsubscribe are answered by the toolbox:
+// mcp-go advertises subscriptions but has no handler for them
+func serveStdio(s *server.MCPServer, t *NvimToolbox) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	// The stdio server calls this once its session is registered, before it
+	// reads any input
+	sessions := make(chan context.Context, 1)
+	stdio := server.NewStdioServer(s)
+	stdio.SetContextFunc(func(ctx context.Context) context.Context {
+		sessions <- ctx
+		return ctx
+	})
+
+	stdout := &lockedWriter{w: os.Stdout}
+	input, forward := io.Pipe()
+	go func() {
+		forward.CloseWithError(filterSubscriptions(sessions, t, os.Stdin, forward, stdout))
+	}()
+
+	return stdio.Listen(ctx, input, stdout)
+}
+
+// filterSubscriptions copies the messages on stdin to forward, except for
+// subscription requests, which it answers on stdout itself
+func filterSubscriptions(sessions <-chan context.Context, t *NvimToolbox, stdin io.Reader, forward, stdout io.Writer) error {
+	ctx := <-sessions
+	sessionID := server.ClientSessionFromContext(ctx).SessionID()
+
+	reader := bufio.NewReader(stdin)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var request struct {
+				ID     mcp.RequestId `json:"id"`
+				Method string        `json:"method"`
+				Params struct {
+					URI string `json:"uri"`
+				} `json:"params"`
+			}
+			var handle func(context.Context, string, string) error
+			if json.Unmarshal(line, &request) == nil && !request.ID.IsNil() {
+				switch request.Method {
+				case "resources/subscribe":
+					handle = t.SubscribeResource
+				case "resources/unsubscribe":
+					handle = t.UnsubscribeResource
+				}
+			}
+
+			if handle == nil {
+				if _, err := forward.Write(line); err != nil {
+					return err
+				}
+			} else {
+				var response any = mcp.NewJSONRPCResponse(request.ID, mcp.Result{})
+				if err := handle(ctx, sessionID, request.Params.URI); err != nil {
+					response = mcp.NewJSONRPCError(request.ID, mcp.INVALID_PARAMS, err.Error(), nil)
+				}
+				encoded, err := json.Marshal(response)
+				if err != nil {
+					return err
+				}
+				if _, err := stdout.Write(append(encoded, '\n')); err != nil {
+					return err
+				}
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
 	}
 }
 
+// lockedWriter serializes writes, so that responses written by
+// filterSubscriptions do not interleave with the stdio server's
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
 
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
@@ -2,34 +2,97 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/mark3labs/mcp-go/mcp"
 	"github.com/mark3labs/mcp-go/server"
 )
 
+// Config controls which categories of operations the server permits
+type Config struct {
+	AllowWrite bool // tools that modify buffer contents or files
+	AllowLua   bool // commands that run Lua code
+	AllowShell bool // commands that run external programs
+
+	SafeMode        bool             // execute_command only runs read-only commands
+	CommandDenylist []*regexp.Regexp // commands execute_command always rejects
+
+	Socket     string        // explicit socket path, bypassing auto-detection
+	RPCTimeout time.Duration // how long each call to Neovim may take
+
+	MaxOutputBytes int // longest text a tool result may carry; zero disables the limit
+}
+
+// defaultMaxOutputBytes keeps a whole-buffer read of a large file from
+// flooding the client
+const defaultMaxOutputBytes = 100 * 1024
+
 // NvimToolbox holds the client connection and implements tool handlers
 type NvimToolbox struct {
-	client *NvimClient
+	// client is replaced on reconnect, so handlers take a snapshot from
+	// ensureConnection or currentClient instead of reading it directly
+	clientMu    sync.Mutex
+	client      *NvimClient
+	reconnectMu sync.Mutex
+
+	config Config
+	server *server.MCPServer
+
+	// watched holds the buffers attached by watch_buffer and pending those
+	// changed since the last notification, which flush is armed to send
+	watchMu      sync.Mutex
+	watched      map[int]bool
+	pending      map[int]bool
+	flush        *time.Timer
+	eventWatches map[int]bool
+	recentEvents []FiredEvent
+
+	// subscriptions maps resource URIs to the sessions subscribed to them,
+	// which are the only ones told about updates
+	subscriptions map[string]map[string]bool
+
+	// bufferResources maps the URIs of registered buffer resources to a
+	// signature of their metadata, so unchanged ones are not re-announced
+	resourceMu      sync.Mutex
+	bufferResources map[string]string
+
+	// errors is the session's ledger of failed tool calls, oldest first
+	errMu  sync.Mutex
+	errors []SessionError
 }
 
 // NewNvimToolbox creates a new toolbox instance with Neovim client
-func NewNvimToolbox() (*NvimToolbox, error) {
-	client, err := NewNvimClient()
+func NewNvimToolbox(config Config) (*NvimToolbox, error) {
+	client, err := NewNvimClient(config.Socket)
 	if err != nil {
-		log.Printf("Warning: %v", err)
+		slog.Warn("no Neovim instance yet", "err", err)
 		// Continue anyway - the client might connect later
-		client = &NvimClient{}
+		client = newNvimClientForSocket("")
 	}
 
-	return &NvimToolbox{
-		client: client,
-	}, nil
+	t := &NvimToolbox{config: config}
+	t.client = t.configure(client)
+	return t, nil
 }
 
 // RegisterTools creates and registers all MCP tools with the server
 func (t *NvimToolbox) RegisterTools(s *server.MCPServer) {
+	t.server = s
+
 	// Create populate_quickfix tool
 	populateQuickfixTool := mcp.NewTool(
 		"populate_quickfix",
@@ -40,7 +103,7 @@ func (t *NvimToolbox) RegisterTools(s *server.MCPServer) {
 	// Create execute_command tool
 	executeCommandTool := mcp.NewTool(
 		"execute_command",
-		mcp.WithDescription("Execute Vim commands when you need specific editor information not available through other tools. Prefer the dedicated context tools first."),
+		mcp.WithDescription("Execute Vim commands when you need specific editor information not available through other tools. Prefer the dedicated context tools first. Commands that are not read-only need --allow-write. Set observe to learn whether the command changed buffers, created new ones or moved the cursor."),
 		mcp.WithInputSchema[ExecuteCommandArgs](),
 	)
 
@@ -54,20 +117,693 @@ func (t *NvimToolbox) RegisterTools(s *server.MCPServer) {
 	// Create get_diagnostics tool
 	getDiagnosticsTool := mcp.NewTool(
 		"get_diagnostics",
-		mcp.WithDescription("Get current errors, warnings, and hints from language servers. Use this to understand what's broken or needs attention in the code."),
+		mcp.WithDescription("Get current errors, warnings, and hints from language servers. Use this to understand what's broken or needs attention in the code. Set scope to all for a project-wide view grouped by file. Set format to json for a list of objects with line, col, end_line, end_col, severity, source, code and message."),
 		mcp.WithInputSchema[GetDiagnosticsArgs](),
 	)
 
+	// Create line_offsets tool
+	lineOffsetsTool := mcp.NewTool(
+		"line_offsets",
+		mcp.WithDescription("Get the byte offset at the start of each line of a buffer, accounting for the file's line endings. Use this to map byte positions from external tools back to lines. Results are paged; pass next_line as start_line to continue."),
+		mcp.WithInputSchema[LineOffsetsArgs](),
+	)
+
+	// Create command_info tool
+	commandInfoTool := mcp.NewTool(
+		"command_info",
+		mcp.WithDescription("Parse a Vim command without running it and classify it, and every command it would run, as read-only, mutating, shell, lua, quit, or unknown. Use this before execute_command to check whether a command would change the user's buffers or run external programs."),
+		mcp.WithInputSchema[CommandInfoArgs](),
+	)
+
+	// Create get_loclist tool
+	getLoclistTool := mcp.NewTool(
+		"get_loclist",
+		mcp.WithDescription("Get the location list of a specific window (the current window by default). Location lists are per-window and independent of the global quickfix list."),
+		mcp.WithInputSchema[GetLoclistArgs](),
+	)
+
+	// Create populate_loclist tool
+	populateLoclistTool := mcp.NewTool(
+		"populate_loclist",
+		mcp.WithDescription("Send results to a specific window's location list instead of the global quickfix list. Use this when findings are scoped to one window and should not replace the user's quickfix list."),
+		mcp.WithInputSchema[PopulateLoclistArgs](),
+	)
+
+	// Create loclist_navigate tool
+	loclistNavigateTool := mcp.NewTool(
+		"loclist_navigate",
+		mcp.WithDescription("Move a window to the next, previous, first, last, or a numbered entry of its location list and report the resulting position."),
+		mcp.WithInputSchema[LoclistNavigateArgs](),
+	)
+
+	// Create job_status tool
+	jobStatusTool := mcp.NewTool(
+		"job_status",
+		mcp.WithDescription("Poll a Neovim job (e.g. a terminal or async build) without blocking. Reports running, exited, or failed with the exit code, plus the latest output when the job runs in a terminal buffer."),
+		mcp.WithInputSchema[JobStatusArgs](),
+	)
+
+	// Create spell_errors tool
+	spellErrorsTool := mcp.NewTool(
+		"spell_errors",
+		mcp.WithDescription("Get misspelled words in a buffer with their positions and suggested corrections. Only reports errors when the user has 'spell' enabled; returns an empty list otherwise."),
+		mcp.WithInputSchema[SpellErrorsArgs](),
+	)
+
+	// Create get_arglist tool
+	getArglistTool := mcp.NewTool(
+		"get_arglist",
+		mcp.WithDescription("Get the argument list (the file set used by :argdo and :next) and the index of the current entry."),
+		mcp.WithInputSchema[GetArglistArgs](),
+	)
+
+	// Create set_arglist tool
+	setArglistTool := mcp.NewTool(
+		"set_arglist",
+		mcp.WithDescription("Replace the argument list with the given files without switching the current window. Use this to assemble a set of files before running a batch operation over them with :argdo."),
+		mcp.WithInputSchema[SetArglistArgs](),
+	)
+
+	// Create snapshot tool
+	snapshotTool := mcp.NewTool(
+		"snapshot",
+		mcp.WithDescription("Get everything relevant about what the user is looking at right now in one call: file, cursor, mode, enclosing function, visible line range, and any diagnostic under the cursor. Use this as the first call to orient yourself."),
+		mcp.WithInputSchema[SnapshotArgs](),
+	)
+
+	// Create multi_buffer_edit tool
+	multiBufferEditTool := mcp.NewTool(
+		"multi_buffer_edit",
+		mcp.WithDescription("Apply text edits across several buffers as one transaction. All ranges and expected changedticks are validated before anything changes; if applying fails in any buffer every buffer is rolled back with undo."),
+		mcp.WithInputSchema[MultiBufferEditArgs](),
+	)
+
+	// Create get_view tool
+	getViewTool := mcp.NewTool(
+		"get_view",
+		mcp.WithDescription("Save a window's scroll and cursor state (winsaveview). Call this before moving the cursor and pass the returned view to set_view afterwards so the user's view is left undisturbed."),
+		mcp.WithInputSchema[GetViewArgs](),
+	)
+
+	// Create set_view tool
+	setViewTool := mcp.NewTool(
+		"set_view",
+		mcp.WithDescription("Restore a window's scroll and cursor state from a view previously returned by get_view (winrestview)."),
+		mcp.WithInputSchema[SetViewArgs](),
+	)
+
+	// Create selection_diff tool
+	selectionDiffTool := mcp.NewTool(
+		"selection_diff",
+		mcp.WithDescription("Preview a replacement for the user's visual selection as a unified diff without changing anything. Uses the live selection or the most recent one if the user has left visual mode."),
+		mcp.WithInputSchema[SelectionDiffArgs](),
+	)
+
+	// Create test_results tool
+	testResultsTool := mcp.NewTool(
+		"test_results",
+		mcp.WithDescription("Get structured test outcomes from the user's test framework. Reports neotest pass/fail/skip counts and test positions when neotest is installed, plus failing entries with file and line from the last :make or test run's quickfix list."),
+		mcp.WithInputSchema[TestResultsArgs](),
+	)
+
+	// Create namespaces tool
+	namespacesTool := mcp.NewTool(
+		"namespaces",
+		mcp.WithDescription("List the highlight/extmark namespaces this server has created in Neovim, or clear one (or all) of them to remove leftover highlights, virtual text, and diagnostics."),
+		mcp.WithInputSchema[NamespacesArgs](),
+	)
+
+	// Create filetype_profile tool
+	filetypeProfileTool := mcp.NewTool(
+		"filetype_profile",
+		mcp.WithDescription("Get the formatting-relevant settings for a buffer's filetype in one call: commentstring, indentation options and indentexpr, textwidth, formatoptions, and matchpairs. Use this before generating code so edits match the language and the user's style."),
+		mcp.WithInputSchema[FiletypeProfileArgs](),
+	)
+
+	// Create local_rename tool
+	localRenameTool := mcp.NewTool(
+		"local_rename",
+		mcp.WithDescription("Rename a symbol within its enclosing function in the current buffer only, using treesitter (or a whole-word search when no parser is available). Use preview to see the affected lines first. Prefer LSP rename for cross-file symbols."),
+		mcp.WithInputSchema[LocalRenameArgs](),
+	)
+
+	// Create server_capabilities tool
+	serverCapabilitiesTool := mcp.NewTool(
+		"server_capabilities",
+		mcp.WithDescription("Report which categories of operations this server permits (read, write, lua, shell, lsp-actions) and the active command policy. Check this before attempting edits so you don't call tools that are disabled."),
+		mcp.WithInputSchema[ServerCapabilitiesArgs](),
+	)
+
+	// Create modeline_settings tool
+	modelineSettingsTool := mcp.NewTool(
+		"modeline_settings",
+		mcp.WithDescription("Report options a file sets through its modeline (e.g. 'vim: sw=2 et') together with their effective and global values. Use this to spot per-file overrides of the user's usual settings."),
+		mcp.WithInputSchema[ModelineSettingsArgs](),
+	)
+
+	// Create open_quickfix_entry tool
+	openQuickfixEntryTool := mcp.NewTool(
+		"open_quickfix_entry",
+		mcp.WithDescription("Show a quickfix entry at its position in the current window, a new split or tab, or the preview window. Use preview to show a result without moving the user away from their current window."),
+		mcp.WithInputSchema[OpenQuickfixEntryArgs](),
+	)
+
+	// Create diagnostic_config tool
+	diagnosticConfigTool := mcp.NewTool(
+		"diagnostic_config",
+		mcp.WithDescription("Get how diagnostics are presented to the user: whether virtual text, signs, and underlines are enabled, severity sorting, and per-display severity filters. Use this to describe diagnostics the way the user sees them."),
+		mcp.WithInputSchema[DiagnosticConfigArgs](),
+	)
+
+	// Create relative_path tool
+	relativePathTool := mcp.NewTool(
+		"relative_path",
+		mcp.WithDescription("Convert a file path (or the current buffer's path) to a path relative to the project root, found from the attached LSP client, the nearest .git directory, or the working directory."),
+		mcp.WithInputSchema[RelativePathArgs](),
+	)
+
+	// Create quickfix_do tool
+	quickfixDoTool := mcp.NewTool(
+		"quickfix_do",
+		mcp.WithDescription("Run a Vim command at every quickfix entry, like :cdo (e.g. 's/old/new/' at each flagged line). Each changed buffer gets a single undo step. Returns a per-entry result. Requires write access."),
+		mcp.WithInputSchema[QuickfixDoArgs](),
+	)
+
+	// Create syntax_tree tool
+	syntaxTreeTool := mcp.NewTool(
+		"syntax_tree",
+		mcp.WithDescription("Get the treesitter syntax tree for a line range as an S-expression with node ranges and field names, like :InspectTree. Use this for grammar-aware edits; the range is capped to keep output small."),
+		mcp.WithInputSchema[SyntaxTreeArgs](),
+	)
+
+	// Create counterpart_file tool
+	counterpartFileTool := mcp.NewTool(
+		"counterpart_file",
+		mcp.WithDescription("Find the test or source counterpart of a buffer's file (foo.go and foo_test.go, foo.h and foo.c, src/ and test/) using projectionist or clangd when available and common conventions otherwise. Reports whether it exists and can open it."),
+		mcp.WithInputSchema[CounterpartFileArgs](),
+	)
+
+	// Create detect_indent tool
+	detectIndentTool := mcp.NewTool(
+		"detect_indent",
+		mcp.WithDescription("Infer a buffer's real indentation style (tabs or spaces and width) from its content, with a confidence score and the effective indent options for comparison. Use this to match the file's style when options may be left at defaults."),
+		mcp.WithInputSchema[DetectIndentArgs](),
+	)
+
+	// Create set_cmdline tool
+	setCmdlineTool := mcp.NewTool(
+		"set_cmdline",
+		mcp.WithDescription("Propose a Vim command by pre-filling the user's command line so they can review and run it with Enter. Set execute to run it directly instead (requires write access and is subject to the command policy)."),
+		mcp.WithInputSchema[SetCmdlineArgs](),
+	)
+
+	// Create function_signatures tool
+	functionSignaturesTool := mcp.NewTool(
+		"function_signatures",
+		mcp.WithDescription("List every function and method declared in a buffer with its signature line, parameters, return type, receiver, and visibility, without the bodies. Use this as a compact API map of a file."),
+		mcp.WithInputSchema[FunctionSignaturesArgs](),
+	)
+
+	// Create resolve_instance tool
+	resolveInstanceTool := mcp.NewTool(
+		"resolve_instance",
+		mcp.WithDescription("List the live Neovim instances that could be the user's editor along with which one was chosen and why, or pick one by socket path for the rest of the session. Use this when other tools report that multiple instances match or the wrong instance seems connected."),
+		mcp.WithInputSchema[ResolveInstanceArgs](),
+	)
+
+	// Create list_nvim_instances tool
+	listNvimInstancesTool := mcp.NewTool(
+		"list_nvim_instances",
+		mcp.WithDescription("List every live Neovim instance on this machine, including project sockets for other directories, with its socket path, working directory and pid, and mark the one this session is connected to. Use select_instance to switch to another one."),
+		mcp.WithInputSchema[ListNvimInstancesArgs](),
+	)
+
+	// Create select_instance tool
+	selectInstanceTool := mcp.NewTool(
+		"select_instance",
+		mcp.WithDescription("Connect the rest of the session to a specific Neovim instance by socket path or host:port, e.g. one reported by list_nvim_instances. All other tools then act on that editor."),
+		mcp.WithInputSchema[SelectInstanceArgs](),
+	)
+
+	// Create lsp_request tool
+	lspRequestTool := mcp.NewTool(
+		"lsp_request",
+		mcp.WithDescription("Send any LSP method (e.g. textDocument/typeDefinition or textDocument/prepareCallHierarchy) to the language servers attached to a buffer and return their raw JSON results. Omit params to send the position under the cursor. Use dedicated tools first when they exist."),
+		mcp.WithInputSchema[LspRequestArgs](),
+	)
+
+	// Create create_checkpoint tool
+	createCheckpointTool := mcp.NewTool(
+		"create_checkpoint",
+		mcp.WithDescription("Record a buffer's current undo state before a series of edits. Pass the returned seq_cur to restore_checkpoint to revert just those edits."),
+		mcp.WithInputSchema[CreateCheckpointArgs](),
+	)
+
+	// Create restore_checkpoint tool
+	restoreCheckpointTool := mcp.NewTool(
+		"restore_checkpoint",
+		mcp.WithDescription("Revert a buffer to a checkpoint from create_checkpoint using its undo sequence number. Changes made before the checkpoint are kept. Requires write access."),
+		mcp.WithInputSchema[RestoreCheckpointArgs](),
+	)
+
+	// Create group_diagnostics tool
+	groupDiagnosticsTool := mcp.NewTool(
+		"group_diagnostics",
+		mcp.WithDescription("Cluster a buffer's diagnostics by source and code, returning each group's count, affected lines, and example locations. Use this to triage many similar issues and fix them in one pass."),
+		mcp.WithInputSchema[GroupDiagnosticsArgs](),
+	)
+
+	// Create read_buffer_display tool
+	readBufferDisplayTool := mcp.NewTool(
+		"read_buffer_display",
+		mcp.WithDescription("Read lines from the current window prefixed with the same line-number and sign gutter the user sees (respecting number, relativenumber and signcolumn). Use this when you need to refer to lines the way the user reads them; use line_offsets or other ranged reads for programmatic access."),
+		mcp.WithInputSchema[ReadBufferDisplayArgs](),
+	)
+
+	// Create detect_runtime tool
+	detectRuntimeTool := mcp.NewTool(
+		"detect_runtime",
+		mcp.WithDescription("Detect a buffer's language runtime from its shebang, filetype, and nearby project files (package.json, go.mod, Cargo.toml) and suggest a command to run it. Returns the evidence used so you can judge the guess before proposing a run command."),
+		mcp.WithInputSchema[DetectRuntimeArgs](),
+	)
+
+	// Create watch_buffer tool
+	watchBufferTool := mcp.NewTool(
+		"watch_buffer",
+		mcp.WithDescription("Start watching a buffer for changes. Edits are coalesced and announced as resource-updated notifications to clients subscribed to nvim://buffer/<bufnr>; read that resource to get the new contents instead of polling. The watch ends with a last notification when the buffer is unloaded or the session switches to another Neovim instance."),
+		mcp.WithInputSchema[WatchBufferArgs](),
+	)
+
+	// Create unwatch_buffer tool
+	unwatchBufferTool := mcp.NewTool(
+		"unwatch_buffer",
+		mcp.WithDescription("Stop watching a buffer previously passed to watch_buffer."),
+		mcp.WithInputSchema[WatchBufferArgs](),
+	)
+
+	// Create range_code_action tool
+	rangeCodeActionTool := mcp.NewTool(
+		"range_code_action",
+		mcp.WithDescription("Request LSP code actions for a range of the current buffer (e.g. extract function or extract variable) with an optional kind filter. Without index the actions are listed; with index the chosen action is previewed as a diff (preview=true) or applied. Set verify_diagnostics when applying a fix to learn whether it resolved the diagnostics or introduced new ones."),
+		mcp.WithInputSchema[RangeCodeActionArgs](),
+	)
+
+	// Create gf_target tool
+	gfTargetTool := mcp.NewTool(
+		"gf_target",
+		mcp.WithDescription("Report the filename under the cursor (or at a given position) and the file gf would open, resolved through the buffer's path, suffixesadd and includeexpr, plus whether it exists. Use this to follow file references the way the user's editor would."),
+		mcp.WithInputSchema[GfTargetArgs](),
+	)
+
+	// Create layout_tree tool
+	layoutTreeTool := mcp.NewTool(
+		"layout_tree",
+		mcp.WithDescription("Get the split layout of a tabpage as a nested row/col tree whose leaves carry each window's id, buffer, name and size, plus a compact text diagram. Use this to understand how the user's screen is arranged."),
+		mcp.WithInputSchema[LayoutTreeArgs](),
+	)
+
+	// Create quickfix_window tool
+	quickfixWindowTool := mcp.NewTool(
+		"quickfix_window",
+		mcp.WithDescription("Open or move the quickfix window with a given height and position (bottom, top, left or right) and return its geometry. Use this to give long result lists more room."),
+		mcp.WithInputSchema[QuickfixWindowArgs](),
+	)
+
+	// Create record_macro tool
+	recordMacroTool := mcp.NewTool(
+		"record_macro",
+		mcp.WithDescription("Store a sequence of keys (in mapping notation such as <Esc> and <CR>) in a register so it can be replayed with play_macro. Requires --allow-write."),
+		mcp.WithInputSchema[RecordMacroArgs](),
+	)
+
+	// Create play_macro tool
+	playMacroTool := mcp.NewTool(
+		"play_macro",
+		mcp.WithDescription("Replay a register as a macro (@<reg>) a number of times from the cursor in the current window, using Neovim's own macro engine. Use this to repeat a transformation across many locations. Requires --allow-write; macros using !, Q, q: or @ also need --allow-shell."),
+		mcp.WithInputSchema[PlayMacroArgs](),
+	)
+
+	// Create find_files tool
+	findFilesTool := mcp.NewTool(
+		"find_files",
+		mcp.WithDescription("Find files matching a glob (e.g. **/*_test.go) under the editor's project root using Neovim's own globpath and cwd. Paths are returned relative to the root; optionally load the matches into the arglist or the quickfix list."),
+		mcp.WithInputSchema[FindFilesArgs](),
+	)
+
+	// Create read_bytes tool
+	readBytesTool := mcp.NewTool(
+		"read_bytes",
+		mcp.WithDescription("Read the exact text of a buffer range with nvim_buf_get_text, without any trimming, along with its byte length, SHA-256 and the changedtick. Use this to verify content before editing or to hash and diff ranges precisely."),
+		mcp.WithInputSchema[ReadBytesArgs](),
+	)
+
+	// Create session_errors tool
+	sessionErrorsTool := mcp.NewTool(
+		"session_errors",
+		mcp.WithDescription("List the tool calls that failed during this session with their arguments, error category and time, optionally clearing the list. Use this to notice repeated failures and back off or change approach."),
+		mcp.WithInputSchema[SessionErrorsArgs](),
+	)
+
+	// Create fold_config tool
+	foldConfigTool := mcp.NewTool(
+		"fold_config",
+		mcp.WithDescription("Get a buffer's folding configuration (foldmethod, foldlevel, foldexpr and related options) and the computed fold level and closed state of each line in a range. Use this to understand why regions are collapsed before reasoning about or creating folds."),
+		mcp.WithInputSchema[FoldConfigArgs](),
+	)
+
+	// Create review_progress tool
+	reviewProgressTool := mcp.NewTool(
+		"review_progress",
+		mcp.WithDescription("Report which symbol of the current buffer's outline a line falls in and its position among all symbols (e.g. function 5 of 12). Use this to walk a file systematically and report progress to the user."),
+		mcp.WithInputSchema[ReviewProgressArgs](),
+	)
+
+	// Create verbose_option tool
+	verboseOptionTool := mcp.NewTool(
+		"verbose_option",
+		mcp.WithDescription("Answer \"where was this set?\" for an option (:verbose set name?) or, when mode is given, a mapping (:verbose map lhs). Returns the value plus the file and line it was last set from, parsed from the Last set from line."),
+		mcp.WithInputSchema[VerboseOptionArgs](),
+	)
+
+	// Create convert_position tool
+	convertPositionTool := mcp.NewTool(
+		"convert_position",
+		mcp.WithDescription("Convert a position between Vim's convention (1-based line and 1-based byte column) and LSP's (0-based line and 0-based character offset in the client's encoding). Use this whenever you mix positions from lsp_request with the other tools."),
+		mcp.WithInputSchema[ConvertPositionArgs](),
+	)
+
+	// Create watch_event tool
+	watchEventTool := mcp.NewTool(
+		"watch_event",
+		mcp.WithDescription("Register an autocommand (BufWritePost by default) that reports each time it fires as a resource-updated notification to clients subscribed to nvim://events; read that resource for the event details. Use this for reactive workflows such as acting when the user saves. Watches end when the session switches to another Neovim instance."),
+		mcp.WithInputSchema[WatchEventArgs](),
+	)
+
+	// Create unwatch_event tool
+	unwatchEventTool := mcp.NewTool(
+		"unwatch_event",
+		mcp.WithDescription("Remove an autocommand created by watch_event."),
+		mcp.WithInputSchema[UnwatchEventArgs](),
+	)
+
+	// Create get_docstring tool
+	getDocstringTool := mcp.NewTool(
+		"get_docstring",
+		mcp.WithDescription("Find the declaration at a position with treesitter and return its documentation with exact range: the comments directly above it or a Python-style docstring inside the body. When there is none, reports where documentation would be inserted."),
+		mcp.WithInputSchema[GetDocstringArgs](),
+	)
+
+	// Create diagnose tool
+	diagnoseTool := mcp.NewTool(
+		"diagnose",
+		mcp.WithDescription("Collect a read-only report for bug reports or troubleshooting: Neovim version, socket path and transport, how the instance was chosen, attached LSP clients and their status, the current buffer's filetype and options, and recent failed tool calls."),
+		mcp.WithInputSchema[DiagnoseArgs](),
+	)
+
+	// Create get_buffer_content tool
+	getBufferContentTool := mcp.NewTool(
+		"get_buffer_content",
+		mcp.WithDescription("Read the current buffer's text with line numbers, either whole, a 1-based inclusive line range, or a page given by offset and limit. Large results are truncated, so read big files in pages. Use this when you need more than the cursor line or selection from get_buffer_context, e.g. a whole function or file."),
+		mcp.WithInputSchema[GetBufferContentArgs](),
+	)
+
+	// Create list_buffers tool
+	listBuffersTool := mcp.NewTool(
+		"list_buffers",
+		mcp.WithDescription("List the user's open buffers with their number, absolute path, modified flag and filetype. Use this to pick a buffer to inspect without asking the user; unlisted and scratch buffers are skipped unless include_unlisted is set."),
+		mcp.WithInputSchema[ListBuffersArgs](),
+	)
+
+	// Create ping tool
+	pingTool := mcp.NewTool(
+		"ping",
+		mcp.WithDescription("Check whether the server can reach Neovim, reconnecting to a fresh instance if the old one went away. Reports connected or disconnected along with the socket path."),
+		mcp.WithInputSchema[PingArgs](),
+	)
+
+	// Create set_cursor tool
+	setCursorTool := mcp.NewTool(
+		"set_cursor",
+		mcp.WithDescription("Move the cursor in the current window to a line and column, optionally centering the view on it. Use this to point the user at a location you are talking about."),
+		mcp.WithInputSchema[SetCursorArgs](),
+	)
+
+	// Create get_visual_selection tool
+	getVisualSelectionTool := mcp.NewTool(
+		"get_visual_selection",
+		mcp.WithDescription("Get the range and text of the user's most recent visual selection in the current buffer from the '< and '> marks. This works after the user has left visual mode, but it reflects the last selection rather than a live one; use get_buffer_context to see a selection that is still active."),
+		mcp.WithInputSchema[GetVisualSelectionArgs](),
+	)
+
+	// Create open_location tool
+	openLocationTool := mcp.NewTool(
+		"open_location",
+		mcp.WithDescription("Open a file in the user's editor and jump to a line and column, in the current window or a new split or tab. Use this to direct the user to a location in a file that is not open yet."),
+		mcp.WithInputSchema[OpenLocationArgs](),
+	)
+
+	// Create list_lsp_clients tool
+	listLspClientsTool := mcp.NewTool(
+		"list_lsp_clients",
+		mcp.WithDescription("List the language servers attached to the current buffer with their id, name, root directory and filetypes. Use this when get_diagnostics is empty to tell clean code apart from a language server that is not running."),
+		mcp.WithInputSchema[ListLspClientsArgs](),
+	)
+
+	// Create lsp_hover tool
+	lspHoverTool := mcp.NewTool(
+		"lsp_hover",
+		mcp.WithDescription("Get the language server's hover documentation (type signature and docs) as markdown for a position in the current buffer, defaulting to the cursor. This is what the user sees when pressing K."),
+		mcp.WithInputSchema[LspPositionArgs](),
+	)
+
+	// Create lsp_definition tool
+	lspDefinitionTool := mcp.NewTool(
+		"lsp_definition",
+		mcp.WithDescription("Find where the symbol at a position in the current buffer (defaulting to the cursor) is defined, as reported by the language server. Returns every definition as a file path with 1-based line and column; this is what gd jumps to."),
+		mcp.WithInputSchema[LspPositionArgs](),
+	)
+
+	// Create lsp_references tool
+	lspReferencesTool := mcp.NewTool(
+		"lsp_references",
+		mcp.WithDescription("Find every reference to the symbol at a position in the current buffer (defaulting to the cursor) using the language server. Set populate_quickfix to also drop the references into the user's quickfix list so they can step through them."),
+		mcp.WithInputSchema[LspReferencesArgs](),
+	)
+
+	// Create search_buffer tool
+	searchBufferTool := mcp.NewTool(
+		"search_buffer",
+		mcp.WithDescription("Find every match of a plain string or Vim regex in the current buffer's live contents (including unsaved edits), with line, column and matched text. Set populate_quickfix to send the matches to the user's quickfix list."),
+		mcp.WithInputSchema[SearchBufferArgs](),
+	)
+
+	// Create get_registers tool
+	getRegistersTool := mcp.NewTool(
+		"get_registers",
+		mcp.WithDescription("Read the contents and types of Vim registers, by default the unnamed register, 0-9 and a-z. Use this when the user refers to what they just yanked or copied. Empty registers are omitted and contents over 4096 bytes are truncated with the original size reported."),
+		mcp.WithInputSchema[GetRegistersArgs](),
+	)
+
+	// Create get_marks tool
+	getMarksTool := mcp.NewTool(
+		"get_marks",
+		mcp.WithDescription("List the marks that are set: a-z and the '< '> '^ '. marks of the current buffer plus the global file marks A-Z, each with file, 1-based line and column. Use this to find navigation anchors the user has placed."),
+		mcp.WithInputSchema[GetMarksArgs](),
+	)
+
+	// Create get_buffer_info tool
+	getBufferInfoTool := mcp.NewTool(
+		"get_buffer_info",
+		mcp.WithDescription("Get the current buffer's filetype, absolute path, line count, modified flag, file encoding and line endings (fileformat) as JSON. Use this to choose language-appropriate analysis without querying options one by one."),
+		mcp.WithInputSchema[GetBufferInfoArgs](),
+	)
+
+	// Create apply_edits tool
+	applyEditsTool := mcp.NewTool(
+		"apply_edits",
+		mcp.WithDescription("Rewrite text in the current buffer by replacing 1-based ranges with new text. All edits are validated against the buffer first and applied bottom-up so they do not shift each other; overlapping edits are rejected. Requires --allow-write."),
+		mcp.WithInputSchema[ApplyEditsArgs](),
+	)
+
+	// Create insert_text tool
+	insertTextTool := mcp.NewTool(
+		"insert_text",
+		mcp.WithDescription("Insert text into the current buffer at the cursor or at a given 1-based line and column without replacing anything. Multi-line text is supported. Returns the position just after the inserted text, where the cursor is moved. Requires --allow-write."),
+		mcp.WithInputSchema[InsertTextArgs](),
+	)
+
+	// Create notify tool
+	notifyTool := mcp.NewTool(
+		"notify",
+		mcp.WithDescription("Show a short status message in the user's editor with vim.notify, e.g. 'Analysis complete, 3 issues found'. Use this instead of the quickfix list for messages that have no locations."),
+		mcp.WithInputSchema[NotifyArgs](),
+	)
+
+	// Create get_code_actions tool
+	getCodeActionsTool := mcp.NewTool(
+		"get_code_actions",
+		mcp.WithDescription("List the LSP code actions (quick-fixes such as importing a missing module, and refactorings) available at the cursor or a position in the current buffer, with their titles and kinds. Pass apply_index to apply one of the listed actions, which requires --allow-write. Use range_code_action for ranges or previews."),
+		mcp.WithInputSchema[GetCodeActionsArgs](),
+	)
+
+	// Create lsp_rename tool
+	lspRenameTool := mcp.NewTool(
+		"lsp_rename",
+		mcp.WithDescription("Rename the symbol at the cursor or a position across the project through the language server, like vim.lsp.buf.rename, and report how many files and edits were changed. Prefer this over text substitution. The changed buffers are left unsaved. Requires --allow-write."),
+		mcp.WithInputSchema[LspRenameArgs](),
+	)
+
+	// Create format_buffer tool
+	formatBufferTool := mcp.NewTool(
+		"format_buffer",
+		mcp.WithDescription("Format the current buffer, or a line range of it, with the attached language server's formatter and report whether the text changed. Use this to clean up code you just wrote. Requires --allow-write."),
+		mcp.WithInputSchema[FormatBufferArgs](),
+	)
+
+	// Create get_treesitter_context tool
+	getTreesitterContextTool := mcp.NewTool(
+		"get_treesitter_context",
+		mcp.WithDescription("Report the treesitter syntax node at the cursor or a position with its range, the chain of enclosing node types, and the enclosing function (with its text) and class. Use this for precise structural context such as 'inside function foo at lines 10-40'."),
+		mcp.WithInputSchema[GetTreesitterContextArgs](),
+	)
+
+	// Create save_buffer tool
+	saveBufferTool := mcp.NewTool(
+		"save_buffer",
+		mcp.WithDescription("Write the current buffer to its file with :write, or to another path (save-as), so that edits are persisted and the user's format-on-save and LSP hooks run. Reports Vim's error when the write fails. Requires --allow-write."),
+		mcp.WithInputSchema[SaveBufferArgs](),
+	)
+
+	// Create undo tool
+	undoTool := mcp.NewTool(
+		"undo",
+		mcp.WithDescription("Undo the last change (or count changes) in the current buffer, e.g. to roll back edits you applied. Returns the resulting changenr() and undo sequence numbers. Requires --allow-write."),
+		mcp.WithInputSchema[UndoRedoArgs](),
+	)
+
+	// Create redo tool
+	redoTool := mcp.NewTool(
+		"redo",
+		mcp.WithDescription("Redo the last undone change (or count changes) in the current buffer. Returns the resulting changenr() and undo sequence numbers. Requires --allow-write."),
+		mcp.WithInputSchema[UndoRedoArgs](),
+	)
+
+	// Create get_changes tool
+	getChangesTool := mcp.NewTool(
+		"get_changes",
+		mcp.WithDescription("List the positions of recent changes in the current buffer from its changelist (oldest first, as g; and g, walk them) with the text of each line, the current changelist position and changenr(). Use this to see what the user has been editing."),
+		mcp.WithInputSchema[GetChangesArgs](),
+	)
+
+	// Create get_project_root tool
+	getProjectRootTool := mcp.NewTool(
+		"get_project_root",
+		mcp.WithDescription("Return the project root for the current buffer and how it was found: the root directory of an attached LSP client, else the nearest ancestor containing .git, else Neovim's working directory. Use it as the anchor for relative paths."),
+		mcp.WithInputSchema[GetProjectRootArgs](),
+	)
+
+	// Create clear_quickfix tool
+	clearQuickfixTool := mcp.NewTool(
+		"clear_quickfix",
+		mcp.WithDescription("Clear stale results from the quickfix list (or the current window's location list with use_loclist), optionally closing its window."),
+		mcp.WithInputSchema[ClearQuickfixArgs](),
+	)
+
 	// Register tools with their handlers
 	s.AddTool(populateQuickfixTool, t.PopulateQuickfix)
 	s.AddTool(executeCommandTool, t.ExecuteCommand)
 	s.AddTool(getBufferContextTool, t.GetBufferContext)
 	s.AddTool(getDiagnosticsTool, t.GetDiagnostics)
+	s.AddTool(lineOffsetsTool, t.LineOffsets)
+	s.AddTool(commandInfoTool, t.CommandInfo)
+	s.AddTool(getLoclistTool, t.GetLoclist)
+	s.AddTool(populateLoclistTool, t.PopulateLoclist)
+	s.AddTool(loclistNavigateTool, t.LoclistNavigate)
+	s.AddTool(jobStatusTool, t.JobStatus)
+	s.AddTool(spellErrorsTool, t.SpellErrors)
+	s.AddTool(getArglistTool, t.GetArglist)
+	s.AddTool(setArglistTool, t.SetArglist)
+	s.AddTool(snapshotTool, t.Snapshot)
+	s.AddTool(multiBufferEditTool, t.MultiBufferEdit)
+	s.AddTool(getViewTool, t.GetView)
+	s.AddTool(setViewTool, t.SetView)
+	s.AddTool(selectionDiffTool, t.SelectionDiff)
+	s.AddTool(testResultsTool, t.TestResults)
+	s.AddTool(namespacesTool, t.Namespaces)
+	s.AddTool(filetypeProfileTool, t.FiletypeProfile)
+	s.AddTool(localRenameTool, t.LocalRename)
+	s.AddTool(serverCapabilitiesTool, t.ServerCapabilities)
+	s.AddTool(modelineSettingsTool, t.ModelineSettings)
+	s.AddTool(openQuickfixEntryTool, t.OpenQuickfixEntry)
+	s.AddTool(diagnosticConfigTool, t.DiagnosticConfig)
+	s.AddTool(relativePathTool, t.RelativePath)
+	s.AddTool(quickfixDoTool, t.QuickfixDo)
+	s.AddTool(syntaxTreeTool, t.SyntaxTree)
+	s.AddTool(counterpartFileTool, t.CounterpartFile)
+	s.AddTool(detectIndentTool, t.DetectIndent)
+	s.AddTool(setCmdlineTool, t.SetCmdline)
+	s.AddTool(functionSignaturesTool, t.FunctionSignatures)
+	s.AddTool(resolveInstanceTool, t.ResolveInstance)
+	s.AddTool(lspRequestTool, t.LspRequest)
+	s.AddTool(createCheckpointTool, t.CreateCheckpoint)
+	s.AddTool(restoreCheckpointTool, t.RestoreCheckpoint)
+	s.AddTool(groupDiagnosticsTool, t.GroupDiagnostics)
+	s.AddTool(readBufferDisplayTool, t.ReadBufferDisplay)
+	s.AddTool(detectRuntimeTool, t.DetectRuntime)
+	s.AddTool(watchBufferTool, t.WatchBuffer)
+	s.AddTool(unwatchBufferTool, t.UnwatchBuffer)
+	s.AddTool(rangeCodeActionTool, t.RangeCodeAction)
+	s.AddTool(gfTargetTool, t.GfTarget)
+	s.AddTool(layoutTreeTool, t.LayoutTree)
+	s.AddTool(quickfixWindowTool, t.QuickfixWindow)
+	s.AddTool(recordMacroTool, t.RecordMacro)
+	s.AddTool(playMacroTool, t.PlayMacro)
+	s.AddTool(findFilesTool, t.FindFiles)
+	s.AddTool(readBytesTool, t.ReadBytes)
+	s.AddTool(sessionErrorsTool, t.SessionErrors)
+	s.AddTool(foldConfigTool, t.FoldConfig)
+	s.AddTool(reviewProgressTool, t.ReviewProgress)
+	s.AddTool(verboseOptionTool, t.VerboseOption)
+	s.AddTool(convertPositionTool, t.ConvertPosition)
+	s.AddTool(watchEventTool, t.WatchEvent)
+	s.AddTool(unwatchEventTool, t.UnwatchEvent)
+	s.AddTool(getDocstringTool, t.GetDocstring)
+	s.AddTool(diagnoseTool, t.Diagnose)
+	s.AddTool(getBufferContentTool, t.GetBufferContent)
+	s.AddTool(listBuffersTool, t.ListBuffers)
+	s.AddTool(pingTool, t.Ping)
+	s.AddTool(setCursorTool, t.SetCursor)
+	s.AddTool(getVisualSelectionTool, t.GetVisualSelection)
+	s.AddTool(openLocationTool, t.OpenLocation)
+	s.AddTool(listLspClientsTool, t.ListLspClients)
+	s.AddTool(lspHoverTool, t.LspHover)
+	s.AddTool(lspDefinitionTool, t.LspDefinition)
+	s.AddTool(lspReferencesTool, t.LspReferences)
+	s.AddTool(searchBufferTool, t.SearchBuffer)
+	s.AddTool(getRegistersTool, t.GetRegisters)
+	s.AddTool(getMarksTool, t.GetMarks)
+	s.AddTool(getBufferInfoTool, t.GetBufferInfo)
+	s.AddTool(applyEditsTool, t.ApplyEdits)
+	s.AddTool(insertTextTool, t.InsertText)
+	s.AddTool(notifyTool, t.Notify)
+	s.AddTool(listNvimInstancesTool, t.ListNvimInstances)
+	s.AddTool(selectInstanceTool, t.SelectInstance)
+	s.AddTool(getCodeActionsTool, t.GetCodeActions)
+	s.AddTool(lspRenameTool, t.LspRename)
+	s.AddTool(formatBufferTool, t.FormatBuffer)
+	s.AddTool(getTreesitterContextTool, t.GetTreesitterContext)
+	s.AddTool(saveBufferTool, t.SaveBuffer)
+	s.AddTool(undoTool, t.Undo)
+	s.AddTool(redoTool, t.Redo)
+	s.AddTool(getChangesTool, t.GetChanges)
+	s.AddTool(getProjectRootTool, t.GetProjectRoot)
+	s.AddTool(clearQuickfixTool, t.ClearQuickfix)
 }
 
 // PopulateQuickfix populates Neovim's quickfix list with code analysis results or errors
 func (t *NvimToolbox) PopulateQuickfix(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-	if err := t.ensureConnection(); err != nil {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
 		return mcp.NewToolResultError(err.Error()), nil
 	}
 
@@ -76,35 +812,37 @@ func (t *NvimToolbox) PopulateQuickfix(ctx context.Context, request mcp.CallTool
 		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
 	}
 
-	// Build quickfix list from typed arguments
-	var qfList []QuickfixItem
-	for _, item := range args.Items {
-		qfEntry := QuickfixItem{
-			Filename: item.Filename,
-			Line:     item.Line,
-			Column:   item.Column,
-			Text:     item.Text,
-			Type:     item.Type,
-		}
-		qfList = append(qfList, qfEntry)
+	qfList, rejected := quickfixItemsFromArgs(args.Items)
+	if len(qfList) == 0 && len(rejected) > 0 {
+		return mcp.NewToolResultError("no valid quickfix items" + rejectedItemsNote(rejected)), nil
 	}
 
 	// Set quickfix list
-	if err := t.client.SetQuickfixList(qfList); err != nil {
+	if err := client.SetQuickfixList(qfList, args.Action, args.Title, args.UseLoclist); err != nil {
 		return mcp.NewToolResultError(fmt.Sprintf("failed to set quickfix list: %v", err)), nil
 	}
 
+	if args.UseLoclist {
+		if err := client.OpenLocationListWindow(0); err != nil {
+			slog.Warn("could not open location list window", "err", err)
+		}
+		return mcp.NewToolResultText(fmt.Sprintf("Successfully populated the current window's location list with %d items", len(qfList)) + rejectedItemsNote(rejected)), nil
+	}
+
 	// Open quickfix window
-	if err := t.client.OpenQuickfixWindow(); err != nil {
-		log.Printf("Warning: Could not open quickfix window: %v", err)
+	geometry, err := client.QuickfixWindow(args.Position, args.Height)
+	if err != nil {
+		slog.Warn("could not open quickfix window", "err", err)
+		return mcp.NewToolResultText(fmt.Sprintf("Successfully populated quickfix list with %d items", len(qfList)) + rejectedItemsNote(rejected)), nil
 	}
 
-	return mcp.NewToolResultText(fmt.Sprintf("Successfully populated quickfix list with %d items", len(qfList))), nil
+	return mcp.NewToolResultText(fmt.Sprintf("Successfully populated quickfix list with %d items\nWindow: %s", len(qfList), geometry) + rejectedItemsNote(rejected)), nil
 }
 
 // ExecuteCommand executes a Vim command in the connected Neovim instance
 func (t *NvimToolbox) ExecuteCommand(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-	if err := t.ensureConnection(); err != nil {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
 		return mcp.NewToolResultError(err.Error()), nil
 	}
 
@@ -113,7 +851,15 @@ func (t *NvimToolbox) ExecuteCommand(ctx context.Context, request mcp.CallToolRe
 		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
 	}
 
-	output, err := t.client.ExecuteCommand(args.Command)
+	if err := t.checkCommandPolicy(client, args.Command); err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	if args.Observe {
+		return t.executeCommandObserved(client, args.Command), nil
+	}
+
+	output, err := client.ExecuteCommand(args.Command)
 	if err != nil {
 		return mcp.NewToolResultError(fmt.Sprintf("failed to execute command: %v", err)), nil
 	}
@@ -121,9 +867,65 @@ func (t *NvimToolbox) ExecuteCommand(ctx context.Context, request mcp.CallToolRe
 	return mcp.NewToolResultText(output), nil
 }
 
+// executeCommandObserved runs a command between two editor state snapshots
+// and reports its side effects alongside the output, including when the
+// command itself fails partway
+func (t *NvimToolbox) executeCommandObserved(client *NvimClient, command string) *mcp.CallToolResult {
+	before, err := client.EditorState()
+	if err != nil {
+		return mcp.NewToolResultError(err.Error())
+	}
+
+	output, cmdErr := client.ExecuteCommand(command)
+
+	after, err := client.EditorState()
+	if err != nil {
+		return mcp.NewToolResultError(err.Error())
+	}
+
+	var changed, created []int
+	for key, tick := range after.Changedticks {
+		bufnr, _ := strconv.Atoi(key)
+		previous, existed := before.Changedticks[key]
+		if !existed {
+			created = append(created, bufnr)
+		} else if tick != previous {
+			changed = append(changed, bufnr)
+		}
+	}
+	sort.Ints(changed)
+	sort.Ints(created)
+
+	report := map[string]any{
+		"command":         command,
+		"output":          output,
+		"buffer_changed":  after.Bufnr == before.Bufnr && after.Changedtick != before.Changedtick,
+		"cursor_moved":    after.Bufnr != before.Bufnr || after.Line != before.Line || after.Col != before.Col,
+		"switched_buffer": after.Bufnr != before.Bufnr,
+		"switched_window": after.Winid != before.Winid,
+		"changed_buffers": changed,
+		"new_buffers":     created,
+		"before":          map[string]any{"bufnr": before.Bufnr, "name": before.Name, "line": before.Line, "col": before.Col, "changedtick": before.Changedtick},
+		"after":           map[string]any{"bufnr": after.Bufnr, "name": after.Name, "line": after.Line, "col": after.Col, "changedtick": after.Changedtick},
+	}
+	if cmdErr != nil {
+		report["error"] = cmdErr.Error()
+	}
+
+	encoded, err := json.Marshal(report)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to encode command report: %v", err))
+	}
+	if cmdErr != nil {
+		return mcp.NewToolResultError(string(encoded))
+	}
+	return mcp.NewToolResultText(string(encoded))
+}
+
 // GetBufferContext retrieves current buffer context including cursor position and visual selection
 func (t *NvimToolbox) GetBufferContext(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-	if err := t.ensureConnection(); err != nil {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
 		return mcp.NewToolResultError(err.Error()), nil
 	}
 
@@ -132,7 +934,15 @@ func (t *NvimToolbox) GetBufferContext(ctx context.Context, request mcp.CallTool
 		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
 	}
 
-	context, err := t.client.GetBufferContext()
+	var context string
+	switch args.Format {
+	case "", "text":
+		context, err = client.GetBufferContext()
+	case "json":
+		context, err = client.GetBufferContextJSON()
+	default:
+		return mcp.NewToolResultError(fmt.Sprintf("invalid format %q (expected text or json)", args.Format)), nil
+	}
 	if err != nil {
 		return mcp.NewToolResultError(fmt.Sprintf("failed to get buffer context: %v", err)), nil
 	}
@@ -140,9 +950,10 @@ func (t *NvimToolbox) GetBufferContext(ctx context.Context, request mcp.CallTool
 	return mcp.NewToolResultText(context), nil
 }
 
-// GetDiagnostics retrieves LSP diagnostics for the current buffer
+// GetDiagnostics retrieves LSP diagnostics for the current buffer or all buffers
 func (t *NvimToolbox) GetDiagnostics(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-	if err := t.ensureConnection(); err != nil {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
 		return mcp.NewToolResultError(err.Error()), nil
 	}
 
@@ -151,7 +962,27 @@ func (t *NvimToolbox) GetDiagnostics(ctx context.Context, request mcp.CallToolRe
 		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
 	}
 
-	diagnostics, err := t.client.GetDiagnostics()
+	for _, level := range []string{args.Severity, args.MinSeverity} {
+		if level != "" && !slices.Contains(diagnosticSeverities, level) {
+			return mcp.NewToolResultError(fmt.Sprintf("invalid severity %q (expected ERROR, WARN, INFO or HINT)", level)), nil
+		}
+	}
+	if args.Severity != "" && args.MinSeverity != "" {
+		return mcp.NewToolResultError("severity and min_severity cannot be combined"), nil
+	}
+	if args.Scope != "" && args.Scope != "current" && args.Scope != "all" {
+		return mcp.NewToolResultError(fmt.Sprintf("invalid scope %q (expected current or all)", args.Scope)), nil
+	}
+
+	var diagnostics string
+	switch args.Format {
+	case "", "text":
+		diagnostics, err = client.GetDiagnostics(args.Scope, args.Severity, args.MinSeverity)
+	case "json":
+		diagnostics, err = client.GetDiagnosticsJSON(args.Scope, args.Severity, args.MinSeverity)
+	default:
+		return mcp.NewToolResultError(fmt.Sprintf("invalid format %q (expected text or json)", args.Format)), nil
+	}
 	if err != nil {
 		return mcp.NewToolResultError(fmt.Sprintf("failed to get diagnostics: %v", err)), nil
 	}
@@ -159,39 +990,3432 @@ func (t *NvimToolbox) GetDiagnostics(ctx context.Context, request mcp.CallToolRe
 	return mcp.NewToolResultText(diagnostics), nil
 }
 
-// ensureConnection tries to reconnect to Neovim if not already connected
-func (t *NvimToolbox) ensureConnection() error {
-	if t.client.socketPath == "" {
-		client, err := NewNvimClient()
-		if err != nil {
-			return fmt.Errorf("no Neovim instance found: %w", err)
-		}
-		t.client = client
+// LineOffsets retrieves a page of the line-to-byte-offset table for a buffer
+func (t *NvimToolbox) LineOffsets(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
 	}
-	return nil
-}
 
-// Tool argument structs for typed schemas
-type QuickfixItemArg struct {
-	Filename string `json:"filename" jsonschema:"description=File path"`
-	Line     int    `json:"line" jsonschema:"description=Line number"`
-	Column   int    `json:"column,omitempty" jsonschema:"description=Column number (optional)"`
-	Text     string `json:"text" jsonschema:"description=Error or warning message"`
-	Type     string `json:"type,omitempty" jsonschema:"description=Type of entry (E for error W for warning I for info),enum=E,enum=W,enum=I"`
-}
+	var args LineOffsetsArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
 
-type PopulateQuickfixArgs struct {
-	Items []QuickfixItemArg `json:"items" jsonschema:"description=Array of quickfix items"`
-}
+	startLine := args.StartLine
+	if startLine < 1 {
+		startLine = 1
+	}
+	maxLines := args.MaxLines
+	if maxLines <= 0 || maxLines > maxLineOffsets {
+		maxLines = maxLineOffsets
+	}
 
-type ExecuteCommandArgs struct {
-	Command string `json:"command" jsonschema:"description=Vim command to execute (e.g. 'set number' 'vsplit' 'wq' etc.)"`
-}
+	offsets, err := client.LineOffsets(args.Bufnr, startLine, maxLines)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to get line offsets: %v", err)), nil
+	}
 
-type GetBufferContextArgs struct {
-	// No arguments needed - will return current line or visual selection
+	return mcp.NewToolResultText(offsets), nil
 }
 
-type GetDiagnosticsArgs struct {
-	// No arguments needed for now
+// CommandInfo parses and classifies a Vim command without executing it
+func (t *NvimToolbox) CommandInfo(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args CommandInfoArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	info, err := client.CommandInfo(args.Command)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to get command info: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(info), nil
+}
+
+// GetLoclist retrieves the location list of a window
+func (t *NvimToolbox) GetLoclist(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args GetLoclistArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	loclist, err := client.GetLocationList(args.Winid, args.AbsolutePaths)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to get location list: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(loclist), nil
+}
+
+// PopulateLoclist populates a window's location list with code analysis results
+func (t *NvimToolbox) PopulateLoclist(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args PopulateLoclistArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	locList, rejected := quickfixItemsFromArgs(args.Items)
+	if len(locList) == 0 && len(rejected) > 0 {
+		return mcp.NewToolResultError("no valid location list items" + rejectedItemsNote(rejected)), nil
+	}
+
+	if err := client.SetLocationList(args.Winid, locList); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to set location list: %v", err)), nil
+	}
+
+	// Open location list window; winid 0 is the current window
+	if err := client.OpenLocationListWindow(args.Winid); err != nil {
+		slog.Warn("could not open location list window", "err", err)
+	}
+
+	window := "the current window's"
+	if args.Winid != 0 {
+		window = fmt.Sprintf("window %d's", args.Winid)
+	}
+	return mcp.NewToolResultText(fmt.Sprintf("Successfully populated %s location list with %d items", window, len(locList)) + rejectedItemsNote(rejected)), nil
+}
+
+// LoclistNavigate moves a window through its location list
+func (t *NvimToolbox) LoclistNavigate(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args LoclistNavigateArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	position, err := client.NavigateLocationList(args.Winid, args.Direction, args.Index)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to navigate location list: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(position), nil
+}
+
+// JobStatus reports the state and recent output of a Neovim job
+func (t *NvimToolbox) JobStatus(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args JobStatusArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	maxLines := args.MaxLines
+	if maxLines <= 0 {
+		maxLines = 100
+	}
+
+	status, err := client.JobStatus(args.JobID, maxLines)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to get job status: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(status), nil
+}
+
+// SpellErrors retrieves spelling errors for a range of a buffer
+func (t *NvimToolbox) SpellErrors(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args SpellErrorsArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	if args.EndLine > 0 && args.StartLine > args.EndLine {
+		return mcp.NewToolResultError("start_line must not be greater than end_line"), nil
+	}
+
+	spellErrors, err := client.SpellErrors(args.Bufnr, args.StartLine, args.EndLine)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to get spelling errors: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(spellErrors), nil
+}
+
+// GetArglist retrieves the argument list and current index
+func (t *NvimToolbox) GetArglist(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args GetArglistArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	arglist, err := client.GetArglist()
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to get arglist: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(arglist), nil
+}
+
+// SetArglist replaces the argument list with the given files
+func (t *NvimToolbox) SetArglist(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args SetArglistArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	arglist, err := client.SetArglist(args.Files)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to set arglist: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(arglist), nil
+}
+
+// Snapshot retrieves the live editor state in a single batched call
+func (t *NvimToolbox) Snapshot(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args SnapshotArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	snapshot, err := client.Snapshot()
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to get snapshot: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(snapshot), nil
+}
+
+// MultiBufferEdit applies edits to several buffers, rolling back on failure
+func (t *NvimToolbox) MultiBufferEdit(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args MultiBufferEditArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	if err := t.requireWrite(); err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	edits := make(map[int][]TextEdit)
+	changedticks := make(map[int]int)
+	for _, buffer := range args.Buffers {
+		if _, exists := edits[buffer.Bufnr]; exists {
+			return mcp.NewToolResultError(fmt.Sprintf("buffer %d listed more than once", buffer.Bufnr)), nil
+		}
+		edits[buffer.Bufnr] = textEditsFromArgs(buffer.Edits)
+		changedticks[buffer.Bufnr] = buffer.Changedtick
+	}
+
+	result, err := client.MultiBufferEdit(edits, changedticks)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to apply edits: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(result), nil
+}
+
+// GetView saves the scroll and cursor state of a window
+func (t *NvimToolbox) GetView(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args GetViewArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	view, err := client.GetView(args.Winid)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to get view: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(view), nil
+}
+
+// SetView restores the scroll and cursor state of a window
+func (t *NvimToolbox) SetView(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args SetViewArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	view, err := client.SetView(args.Winid, args.View)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to set view: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(view), nil
+}
+
+// SelectionDiff diffs the visual selection against a proposed replacement
+func (t *NvimToolbox) SelectionDiff(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args SelectionDiffArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	diff, err := client.SelectionDiff(args.Replacement)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to diff selection: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(diff), nil
+}
+
+// TestResults retrieves test outcomes from neotest or the quickfix list
+func (t *NvimToolbox) TestResults(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args TestResultsArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	results, err := client.TestResults()
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to get test results: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(results), nil
+}
+
+// Namespaces lists or clears the namespaces owned by this server
+func (t *NvimToolbox) Namespaces(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args NamespacesArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	switch args.Action {
+	case "", "list":
+		namespaces, err := client.ListOwnedNamespaces()
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("failed to list namespaces: %v", err)), nil
+		}
+		if len(namespaces) == 0 {
+			return mcp.NewToolResultText("No namespaces owned by this server"), nil
+		}
+
+		var result strings.Builder
+		for _, ns := range namespaces {
+			result.WriteString(fmt.Sprintf("NAMESPACE:%s:%d\n", ns.Name, ns.ID))
+		}
+		return mcp.NewToolResultText(result.String()), nil
+	case "clear":
+		cleared, err := client.ClearNamespace(args.Name)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("failed to clear namespace: %v", err)), nil
+		}
+		if len(cleared) == 0 {
+			return mcp.NewToolResultText("No namespaces to clear"), nil
+		}
+		return mcp.NewToolResultText(fmt.Sprintf("Cleared namespaces: %s", strings.Join(cleared, ", "))), nil
+	default:
+		return mcp.NewToolResultError(fmt.Sprintf("invalid action %q (expected list or clear)", args.Action)), nil
+	}
+}
+
+// FiletypeProfile retrieves the filetype-specific settings of a buffer
+func (t *NvimToolbox) FiletypeProfile(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args FiletypeProfileArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	profile, err := client.FiletypeProfile(args.Bufnr)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to get filetype profile: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(profile), nil
+}
+
+// LocalRename renames a symbol within its scope in the current buffer
+func (t *NvimToolbox) LocalRename(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args LocalRenameArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	if !identifierPattern.MatchString(args.NewName) {
+		return mcp.NewToolResultError(fmt.Sprintf("%q is not a valid identifier", args.NewName)), nil
+	}
+
+	if !args.Preview {
+		if err := t.requireWrite(); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+	}
+
+	result, err := client.LocalRename(args.Line, args.Column, args.NewName, args.Preview)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to rename: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(result), nil
+}
+
+// ModelineSettings retrieves options set by a buffer's modeline
+func (t *NvimToolbox) ModelineSettings(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args ModelineSettingsArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	settings, err := client.ModelineSettings(args.Bufnr)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to get modeline settings: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(settings), nil
+}
+
+// OpenQuickfixEntry shows a quickfix entry in the requested kind of window
+func (t *NvimToolbox) OpenQuickfixEntry(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args OpenQuickfixEntryArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	result, err := client.OpenQuickfixEntry(args.Index, args.Split)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to open quickfix entry: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(result), nil
+}
+
+// DiagnosticConfig retrieves the effective vim.diagnostic presentation config
+func (t *NvimToolbox) DiagnosticConfig(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args DiagnosticConfigArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	config, err := client.DiagnosticConfig()
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to get diagnostic config: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(config), nil
+}
+
+// RelativePath converts a path to be relative to the project root
+func (t *NvimToolbox) RelativePath(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args RelativePathArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	path, err := client.RelativeToRoot(args.Path)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to resolve relative path: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(path), nil
+}
+
+// QuickfixDo runs a command at each quickfix entry
+func (t *NvimToolbox) QuickfixDo(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args QuickfixDoArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	if err := t.requireWrite(); err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+	if err := t.checkCommandPolicy(client, args.Command); err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	result, err := client.QuickfixDo(args.Command)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to run command over quickfix entries: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(result), nil
+}
+
+// SyntaxTree retrieves the treesitter tree for a range of a buffer
+func (t *NvimToolbox) SyntaxTree(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args SyntaxTreeArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	startLine := args.StartLine
+	if startLine < 1 {
+		startLine = 1
+	}
+	endLine := args.EndLine
+	if endLine < startLine || endLine-startLine >= maxSyntaxTreeLines {
+		endLine = startLine + maxSyntaxTreeLines - 1
+	}
+
+	tree, err := client.SyntaxTree(args.Bufnr, startLine, endLine, maxSyntaxTreeNodes)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to get syntax tree: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(tree), nil
+}
+
+// CounterpartFile finds the test or source counterpart of a buffer
+func (t *NvimToolbox) CounterpartFile(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args CounterpartFileArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	counterpart, err := client.CounterpartFile(args.Bufnr, args.Open)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to find counterpart file: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(counterpart), nil
+}
+
+// DetectIndent infers the indentation style used in a buffer
+func (t *NvimToolbox) DetectIndent(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args DetectIndentArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	indent, err := client.DetectIndent(args.Bufnr)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to detect indentation: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(indent), nil
+}
+
+// SetCmdline pre-fills or executes a command line
+func (t *NvimToolbox) SetCmdline(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args SetCmdlineArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	if args.Execute {
+		if err := t.requireWrite(); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		if err := t.checkCommandPolicy(client, args.Text); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+	}
+
+	output, err := client.SetCmdline(args.Text, args.Execute)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to set command line: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(output), nil
+}
+
+// FunctionSignatures retrieves the declared function signatures of a buffer
+func (t *NvimToolbox) FunctionSignatures(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args FunctionSignaturesArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	signatures, err := client.FunctionSignatures(args.Bufnr)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to get function signatures: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(signatures), nil
+}
+
+// ResolveInstance lists candidate Neovim instances or selects one
+func (t *NvimToolbox) ResolveInstance(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	var args ResolveInstanceArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	current := t.currentClient()
+	candidates := FindSocketCandidates()
+
+	if args.Socket == "" {
+		if len(candidates) == 0 {
+			return mcp.NewToolResultText("No live Neovim instances found"), nil
+		}
+
+		var result strings.Builder
+		if current.socketPath != "" && current.detection != "" {
+			result.WriteString(fmt.Sprintf("DECISION:%s:%s\n", current.socketPath, current.detection))
+		}
+		for _, candidate := range candidates {
+			marker := ""
+			if candidate.Path == current.socketPath {
+				marker = ":CURRENT"
+			}
+			result.WriteString(fmt.Sprintf("INSTANCE:%s:%s%s\n", candidate.Path, candidate.Cwd, marker))
+		}
+		return mcp.NewToolResultText(result.String()), nil
+	}
+
+	return t.selectInstance(args.Socket, "selected with resolve_instance")
+}
+
+// ListNvimInstances lists every live Neovim instance
+func (t *NvimToolbox) ListNvimInstances(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	var args ListNvimInstancesArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	type instance struct {
+		SocketCandidate
+		Current bool `json:"current"`
+	}
+	current := t.currentClient()
+	instances := []instance{}
+	for _, candidate := range ListNvimInstances() {
+		instances = append(instances, instance{candidate, candidate.Path == current.socketPath})
+	}
+
+	output, err := json.Marshal(instances)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to encode instances: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(string(output)), nil
+}
+
+// SelectInstance switches the session to another Neovim instance
+func (t *NvimToolbox) SelectInstance(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	var args SelectInstanceArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	if args.Socket == "" {
+		return mcp.NewToolResultError("socket cannot be empty"), nil
+	}
+
+	return t.selectInstance(args.Socket, "selected with select_instance")
+}
+
+// selectInstance connects the session to socket if it answers
+func (t *NvimToolbox) selectInstance(socket, detection string) (*mcp.CallToolResult, error) {
+	// The selected socket may not be one of the auto-detected candidates
+	// (e.g. a custom --listen path), so it is only required to be live
+	client := t.configure(newNvimClientForSocket(socket))
+	cwd, err := client.remoteExpr("getcwd()")
+	if err != nil {
+		client.Close()
+		return mcp.NewToolResultError(fmt.Sprintf("failed to connect to %s: %v", socket, err)), nil
+	}
+	client.detection = detection
+	t.useClient(client)
+
+	return mcp.NewToolResultText(fmt.Sprintf("Using Neovim instance %s (cwd: %s) for this session", socket, cwd)), nil
+}
+
+// LspRequest sends an arbitrary LSP request and returns the raw results
+func (t *NvimToolbox) LspRequest(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args LspRequestArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	var params json.RawMessage
+	if args.Params != nil {
+		encoded, err := json.Marshal(args.Params)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("failed to encode params: %v", err)), nil
+		}
+		params = encoded
+	}
+
+	result, err := client.LspRequest(args.Method, params, args.Bufnr)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to send LSP request: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(result), nil
+}
+
+// CreateCheckpoint records the undo state of a buffer
+func (t *NvimToolbox) CreateCheckpoint(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args CreateCheckpointArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	checkpoint, err := client.Checkpoint(args.Bufnr)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to create checkpoint: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(checkpoint), nil
+}
+
+// RestoreCheckpoint reverts a buffer to a recorded undo state
+func (t *NvimToolbox) RestoreCheckpoint(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args RestoreCheckpointArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	if err := t.requireWrite(); err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	state, err := client.RestoreCheckpoint(args.Bufnr, args.Seq)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to restore checkpoint: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(state), nil
+}
+
+// GroupDiagnostics clusters a buffer's diagnostics by source and code
+func (t *NvimToolbox) GroupDiagnostics(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args GroupDiagnosticsArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	groups, err := client.GroupDiagnostics(args.Bufnr)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to group diagnostics: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(groups), nil
+}
+
+// ReadBufferDisplay returns buffer lines with the user's line-number gutter
+func (t *NvimToolbox) ReadBufferDisplay(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args ReadBufferDisplayArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	if args.EndLine > 0 && args.EndLine < args.StartLine {
+		return mcp.NewToolResultError(fmt.Sprintf("end_line %d is before start_line %d", args.EndLine, args.StartLine)), nil
+	}
+
+	display, err := client.ReadBufferDisplay(args.StartLine, args.EndLine)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to read buffer display: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(display), nil
+}
+
+// DetectRuntime reports the likely interpreter and run command for a buffer
+func (t *NvimToolbox) DetectRuntime(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args DetectRuntimeArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	runtime, err := client.DetectRuntime(args.Bufnr)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to detect runtime: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(runtime), nil
+}
+
+// WatchBuffer starts sending change notifications for a buffer
+func (t *NvimToolbox) WatchBuffer(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args WatchBufferArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	bufnr, err := client.WatchBuffer(args.Bufnr)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to watch buffer: %v", err)), nil
+	}
+
+	t.watchMu.Lock()
+	if t.watched == nil {
+		t.watched = make(map[int]bool)
+	}
+	t.watched[bufnr] = true
+	t.watchMu.Unlock()
+
+	return mcp.NewToolResultText(fmt.Sprintf("Watching buffer %d; changes are announced as updates to %s%d (at most one per %v)",
+		bufnr, bufferURIPrefix, bufnr, bufferChangeInterval)), nil
+}
+
+// UnwatchBuffer stops change notifications for a buffer
+func (t *NvimToolbox) UnwatchBuffer(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args WatchBufferArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	bufnr := args.Bufnr
+	if bufnr == 0 {
+		if bufnr, err = client.CurrentBufnr(); err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("failed to unwatch buffer: %v", err)), nil
+		}
+	}
+
+	// A subscribed buffer stays attached for its subscribers
+	t.watchMu.Lock()
+	watched := t.watched[bufnr]
+	delete(t.watched, bufnr)
+	detach := watched && !t.watchingBuffer(bufnr)
+	if detach {
+		delete(t.pending, bufnr)
+	}
+	t.watchMu.Unlock()
+
+	if detach {
+		if err := client.UnwatchBuffer(bufnr); err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("failed to unwatch buffer: %v", err)), nil
+		}
+	}
+
+	if !watched {
+		return mcp.NewToolResultText(fmt.Sprintf("Buffer %d was not being watched", bufnr)), nil
+	}
+	return mcp.NewToolResultText(fmt.Sprintf("Stopped watching buffer %d", bufnr)), nil
+}
+
+// RangeCodeAction lists, previews or applies code actions for a range
+func (t *NvimToolbox) RangeCodeAction(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args RangeCodeActionArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	if args.Index > 0 && !args.Preview {
+		if err := t.requireWrite(); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+	}
+
+	endCol := args.EndCol
+	if endCol == 0 {
+		// Cover the whole end line; the position is clamped to the line end
+		endCol = maxColumn
+	}
+
+	result, err := client.RangeCodeAction(args.StartLine, args.StartCol, args.EndLine, endCol, args.Kind, args.Index, args.Preview, args.VerifyDiagnostics)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to run range code action: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(result), nil
+}
+
+// GfTarget resolves the file gf would open at a position
+func (t *NvimToolbox) GfTarget(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args GfTargetArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	target, err := client.GfTarget(args.Line, args.Col)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to resolve gf target: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(target), nil
+}
+
+// LayoutTree returns the window split structure of a tabpage
+func (t *NvimToolbox) LayoutTree(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args LayoutTreeArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	layout, err := client.LayoutTree(args.Tabpage)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to get layout tree: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(layout), nil
+}
+
+// QuickfixWindow opens the quickfix window at a given size and position
+func (t *NvimToolbox) QuickfixWindow(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args QuickfixWindowArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	geometry, err := client.QuickfixWindow(args.Position, args.Height)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to open quickfix window: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(geometry), nil
+}
+
+// RecordMacro stores keys in a register for later replay
+func (t *NvimToolbox) RecordMacro(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args RecordMacroArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	if err := t.requireWrite(); err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	result, err := client.SetMacro(args.Register, args.Keys)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to record macro: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(result), nil
+}
+
+// PlayMacro replays a register as a macro
+func (t *NvimToolbox) PlayMacro(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args PlayMacroArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	if err := t.requireWrite(); err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	// A macro can type Ex commands, so those go through the same policy as
+	// execute_command
+	keys, err := client.MacroContents(args.Register)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to play macro: %v", err)), nil
+	}
+	if quit := findMacroKeys(keys, macroQuitKeys); quit != "" {
+		return mcp.NewToolResultError(fmt.Sprintf("macro blocked by policy: %s quits Neovim", quit)), nil
+	}
+	if !t.config.AllowShell {
+		if escape := findMacroKeys(keys, macroShellKeys); escape != "" {
+			return mcp.NewToolResultError(fmt.Sprintf("macro blocked by policy: %s can run shell commands or other macros without a command line to check; restart the server with --allow-shell to enable it", escape)), nil
+		}
+	}
+	for _, command := range macroCommands(keys) {
+		if err := t.checkCommandPolicy(client, command); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+	}
+
+	result, err := client.PlayMacro(args.Register, args.Count)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to play macro: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(result), nil
+}
+
+// FindFiles lists project files matching a glob
+func (t *NvimToolbox) FindFiles(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args FindFilesArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	maxResults := args.MaxResults
+	if maxResults <= 0 || maxResults > maxFindResults {
+		maxResults = maxFindResults
+	}
+
+	found, err := client.FindFiles(args.Glob, maxResults)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to find files: %v", err)), nil
+	}
+
+	// The matches are relative to the project root, which may differ from
+	// the editor's cwd, so the lists get absolute paths
+	var paths []string
+	for _, file := range found.Files {
+		paths = append(paths, filepath.Join(found.Root, file))
+	}
+
+	switch args.Target {
+	case "arglist":
+		if _, err := client.SetArglist(paths); err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("failed to set arglist: %v", err)), nil
+		}
+	case "quickfix":
+		var items []QuickfixItem
+		for _, path := range paths {
+			items = append(items, QuickfixItem{Filename: path, Line: 1, Text: "matches " + args.Glob, Type: "I"})
+		}
+		if err := client.SetQuickfixList(items, "new", "find_files: "+args.Glob, false); err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("failed to set quickfix list: %v", err)), nil
+		}
+	}
+
+	encoded, err := json.Marshal(found)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to encode found files: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(string(encoded)), nil
+}
+
+// ReadBytes returns the exact text of a buffer range with its hash
+func (t *NvimToolbox) ReadBytes(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args ReadBytesArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	startLine := args.StartLine
+	if startLine < 1 {
+		startLine = 1
+	}
+
+	read, err := client.ReadBytes(args.Bufnr, startLine, args.StartCol, args.EndLine, args.EndCol)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to read bytes: %v", err)), nil
+	}
+
+	sum := sha256.Sum256([]byte(read.Text))
+	encoded, err := json.Marshal(map[string]any{
+		"bufnr":       read.Bufnr,
+		"start_line":  read.StartLine,
+		"start_col":   read.StartCol,
+		"end_line":    read.EndLine,
+		"end_col":     read.EndCol,
+		"changedtick": read.Changedtick,
+		"bytes":       len(read.Text),
+		"sha256":      hex.EncodeToString(sum[:]),
+		"text":        read.Text,
+	})
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to encode bytes: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(string(encoded)), nil
+}
+
+// SessionErrors returns, and optionally clears, the session's error ledger
+func (t *NvimToolbox) SessionErrors(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	var args SessionErrorsArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	t.errMu.Lock()
+	entries := append([]SessionError{}, t.errors...)
+	if args.Clear {
+		t.errors = nil
+	}
+	t.errMu.Unlock()
+
+	byCategory := make(map[string]int)
+	for _, entry := range entries {
+		byCategory[entry.Category]++
+	}
+
+	encoded, err := json.Marshal(map[string]any{
+		"count":       len(entries),
+		"by_category": byCategory,
+		"errors":      entries,
+		"cleared":     args.Clear,
+	})
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to encode session errors: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(string(encoded)), nil
+}
+
+// FoldConfig reports folding options and per-line fold levels
+func (t *NvimToolbox) FoldConfig(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args FoldConfigArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	config, err := client.FoldConfig(args.Bufnr, args.StartLine, args.EndLine)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to get fold config: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(config), nil
+}
+
+// ReviewProgress locates a line within the buffer's symbol outline
+func (t *NvimToolbox) ReviewProgress(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args ReviewProgressArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	progress, err := client.ReviewProgress(args.Line)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to get review progress: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(progress), nil
+}
+
+// VerboseOption reports where an option or mapping was last set
+func (t *NvimToolbox) VerboseOption(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args VerboseOptionArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	info, err := client.VerboseOption(args.Name, args.Mode)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to get verbose info: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(info), nil
+}
+
+// ConvertPosition translates positions between Vim and LSP conventions
+func (t *NvimToolbox) ConvertPosition(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args ConvertPositionArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	var position string
+	switch args.From {
+	case "vim":
+		position, err = client.VimToLsp(args.Bufnr, args.Line, args.Column, args.Encoding)
+	case "lsp":
+		position, err = client.LspToVim(args.Bufnr, args.Line, args.Column, args.Encoding)
+	default:
+		return mcp.NewToolResultError(fmt.Sprintf("invalid from %q (expected vim or lsp)", args.From)), nil
+	}
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to convert position: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(position), nil
+}
+
+// WatchEvent registers an autocommand that reports when it fires
+func (t *NvimToolbox) WatchEvent(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args WatchEventArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	event := args.Event
+	if event == "" {
+		event = "BufWritePost"
+	}
+	pattern := args.Pattern
+	if pattern == "" {
+		pattern = "*"
+	}
+
+	id, err := client.WatchEvent(event, pattern, args.Once)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to watch event: %v", err)), nil
+	}
+
+	t.watchMu.Lock()
+	if t.eventWatches == nil {
+		t.eventWatches = make(map[int]bool)
+	}
+	t.eventWatches[id] = true
+	t.watchMu.Unlock()
+
+	return mcp.NewToolResultText(fmt.Sprintf("Watching %s %s as watch %d; events are announced as updates to %s", event, pattern, id, eventsURI)), nil
+}
+
+// UnwatchEvent removes an autocommand created by watch_event
+func (t *NvimToolbox) UnwatchEvent(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args UnwatchEventArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	watched, err := client.UnwatchEvent(args.ID)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to unwatch event: %v", err)), nil
+	}
+
+	t.watchMu.Lock()
+	delete(t.eventWatches, args.ID)
+	t.watchMu.Unlock()
+
+	if !watched {
+		return mcp.NewToolResultText(fmt.Sprintf("Watch %d does not exist", args.ID)), nil
+	}
+	return mcp.NewToolResultText(fmt.Sprintf("Removed watch %d", args.ID)), nil
+}
+
+// GetDocstring returns the documentation attached to a declaration
+func (t *NvimToolbox) GetDocstring(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args GetDocstringArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	docstring, err := client.GetDocstring(args.Line, args.Col)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to get docstring: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(docstring), nil
+}
+
+// Diagnose bundles editor and server state into one troubleshooting report
+func (t *NvimToolbox) Diagnose(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	t.errMu.Lock()
+	recent := t.errors
+	if len(recent) > maxDiagnoseErrors {
+		recent = recent[len(recent)-maxDiagnoseErrors:]
+	}
+	recent = append([]SessionError{}, recent...)
+	t.errMu.Unlock()
+
+	report := map[string]any{
+		"server": map[string]any{
+			"capabilities":  t.Capabilities(),
+			"recent_errors": recent,
+		},
+	}
+
+	// The report is still useful without a connection; that is often the
+	// very problem being diagnosed
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		report["connection"] = map[string]any{"connected": false, "error": err.Error(), "candidates": FindSocketCandidates()}
+	} else {
+		report["connection"] = map[string]any{
+			"connected": true,
+			"socket":    client.socketPath,
+			"transport": "msgpack-rpc",
+			"detection": client.detection,
+		}
+		editor, err := client.Diagnose()
+		if err != nil {
+			report["editor_error"] = err.Error()
+		} else {
+			report["editor"] = json.RawMessage(editor)
+		}
+	}
+
+	encoded, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to encode report: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(string(encoded)), nil
+}
+
+// GetBufferContent returns the current buffer's lines with line numbers
+func (t *NvimToolbox) GetBufferContent(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args GetBufferContentArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	if args.EndLine > 0 && args.EndLine < args.StartLine {
+		return mcp.NewToolResultError(fmt.Sprintf("end_line %d is before start_line %d", args.EndLine, args.StartLine)), nil
+	}
+
+	// offset and limit page through the buffer as an alternative to an
+	// explicit line range
+	startLine, endLine := args.StartLine, args.EndLine
+	if args.Offset > 0 || args.Limit > 0 {
+		if args.StartLine > 0 || args.EndLine > 0 {
+			return mcp.NewToolResultError("offset and limit cannot be combined with start_line and end_line"), nil
+		}
+		if args.Offset < 0 || args.Limit < 0 {
+			return mcp.NewToolResultError("offset and limit cannot be negative"), nil
+		}
+		startLine = args.Offset + 1
+		if args.Limit > 0 {
+			endLine = args.Offset + args.Limit
+		}
+	}
+
+	content, err := client.GetBufferContent(startLine, endLine)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to get buffer content: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(content), nil
+}
+
+// ListBuffers reports the open buffers and their state
+func (t *NvimToolbox) ListBuffers(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args ListBuffersArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	buffers, err := client.ListBuffers(args.IncludeUnlisted)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to list buffers: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(buffers), nil
+}
+
+// Ping reports whether the Neovim instance is reachable
+func (t *NvimToolbox) Ping(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	var args PingArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	// An unreachable instance is a normal answer here, not a tool failure
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultText(fmt.Sprintf("disconnected: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(fmt.Sprintf("connected: %s (%s)", client.socketPath, client.detection)), nil
+}
+
+// SetCursor moves the cursor in the current window
+func (t *NvimToolbox) SetCursor(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args SetCursorArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	cursor, err := client.SetCursor(args.Line, args.Col, args.Center)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to set cursor: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(cursor), nil
+}
+
+// GetVisualSelection returns the last visual selection in the current buffer
+func (t *NvimToolbox) GetVisualSelection(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args GetVisualSelectionArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	selection, err := client.GetVisualSelection()
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to get visual selection: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(selection), nil
+}
+
+// OpenLocation opens a file at a position
+func (t *NvimToolbox) OpenLocation(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args OpenLocationArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	location, err := client.OpenLocation(args.Path, args.Line, args.Col, args.Split)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to open location: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(location), nil
+}
+
+// ListLspClients reports the LSP clients attached to the current buffer
+func (t *NvimToolbox) ListLspClients(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args ListLspClientsArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	clients, err := client.ListLspClients()
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to list LSP clients: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(clients), nil
+}
+
+// LspHover returns hover documentation at a position
+func (t *NvimToolbox) LspHover(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args LspPositionArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	hover, err := client.LspHover(args.Line, args.Col)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to get hover: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(hover), nil
+}
+
+// LspDefinition returns the definition locations of the symbol at a position
+func (t *NvimToolbox) LspDefinition(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args LspPositionArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	definitions, err := client.LspDefinition(args.Line, args.Col)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to get definition: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(definitions), nil
+}
+
+// LspReferences lists references to the symbol at a position
+func (t *NvimToolbox) LspReferences(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args LspReferencesArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	references, err := client.LspReferences(args.Line, args.Col, args.IncludeDeclaration)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to get references: %v", err)), nil
+	}
+	if !args.PopulateQuickfix {
+		return mcp.NewToolResultText(references), nil
+	}
+
+	var found struct {
+		References []struct {
+			File    string `json:"file"`
+			Line    int    `json:"line"`
+			Col     int    `json:"col"`
+			EndLine int    `json:"end_line"`
+			EndCol  int    `json:"end_col"`
+			Text    string `json:"text"`
+		} `json:"references"`
+	}
+	if err := json.Unmarshal([]byte(references), &found); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to parse references: %v", err)), nil
+	}
+	if len(found.References) == 0 {
+		return mcp.NewToolResultText(references + "\nNo references to put in the quickfix list"), nil
+	}
+
+	var items []QuickfixItem
+	for _, ref := range found.References {
+		items = append(items, QuickfixItem{Filename: ref.File, Line: ref.Line, Column: ref.Col, EndLine: ref.EndLine, EndCol: ref.EndCol, Text: ref.Text})
+	}
+	title := fmt.Sprintf("References (%d)", len(items))
+	if err := client.SetQuickfixList(items, "new", title, false); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to set quickfix list: %v", err)), nil
+	}
+	if err := client.OpenQuickfixWindow(); err != nil {
+		slog.Warn("could not open quickfix window", "err", err)
+	}
+
+	return mcp.NewToolResultText(fmt.Sprintf("%s\nPopulated quickfix list with %d references", references, len(items))), nil
+}
+
+// SearchBuffer lists pattern matches in the current buffer
+func (t *NvimToolbox) SearchBuffer(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args SearchBufferArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	matches, err := client.SearchBuffer(args.Pattern, args.Regex, args.CaseSensitive)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to search buffer: %v", err)), nil
+	}
+	if !args.PopulateQuickfix {
+		return mcp.NewToolResultText(matches), nil
+	}
+
+	var found struct {
+		File    string `json:"file"`
+		Matches []struct {
+			Line     int    `json:"line"`
+			Col      int    `json:"col"`
+			EndCol   int    `json:"end_col"`
+			LineText string `json:"line_text"`
+		} `json:"matches"`
+	}
+	if err := json.Unmarshal([]byte(matches), &found); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to parse matches: %v", err)), nil
+	}
+	if len(found.Matches) == 0 {
+		return mcp.NewToolResultText(matches + "\nNo matches to put in the quickfix list"), nil
+	}
+
+	var items []QuickfixItem
+	for _, match := range found.Matches {
+		items = append(items, QuickfixItem{Filename: found.File, Line: match.Line, Column: match.Col, EndLine: match.Line, EndCol: match.EndCol, Text: strings.TrimSpace(match.LineText)})
+	}
+	if err := client.SetQuickfixList(items, "new", "search: "+args.Pattern, false); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to set quickfix list: %v", err)), nil
+	}
+	if err := client.OpenQuickfixWindow(); err != nil {
+		slog.Warn("could not open quickfix window", "err", err)
+	}
+
+	return mcp.NewToolResultText(fmt.Sprintf("%s\nPopulated quickfix list with %d matches", matches, len(items))), nil
+}
+
+// GetRegisters returns the contents of registers
+func (t *NvimToolbox) GetRegisters(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args GetRegistersArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	registers, err := client.GetRegisters(args.Names)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to get registers: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(registers), nil
+}
+
+// GetMarks returns the positions of the set marks
+func (t *NvimToolbox) GetMarks(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args GetMarksArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	marks, err := client.GetMarks()
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to get marks: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(marks), nil
+}
+
+// GetBufferInfo returns basic facts about the current buffer
+func (t *NvimToolbox) GetBufferInfo(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args GetBufferInfoArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	info, err := client.GetBufferInfo()
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to get buffer info: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(info), nil
+}
+
+// ApplyEdits applies text edits to the current buffer
+func (t *NvimToolbox) ApplyEdits(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args ApplyEditsArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	if err := t.requireWrite(); err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	result, err := client.ApplyEdits(textEditsFromArgs(args.Edits))
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to apply edits: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(result), nil
+}
+
+// InsertText inserts text into the current buffer
+func (t *NvimToolbox) InsertText(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args InsertTextArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	if err := t.requireWrite(); err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	result, err := client.InsertText(args.Line, args.Col, args.Text)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to insert text: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(result), nil
+}
+
+// Notify displays a message in the editor
+func (t *NvimToolbox) Notify(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args NotifyArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	result, err := client.Notify(args.Message, args.Level)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to notify: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(result), nil
+}
+
+// GetCodeActions lists or applies code actions at a position
+func (t *NvimToolbox) GetCodeActions(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args GetCodeActionsArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	if args.ApplyIndex > 0 {
+		if err := t.requireWrite(); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+	}
+
+	result, err := client.GetCodeActions(args.Line, args.Col, args.ApplyIndex, args.VerifyDiagnostics)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to get code actions: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(result), nil
+}
+
+// LspRename renames a symbol through the language server
+func (t *NvimToolbox) LspRename(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args LspRenameArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	if !identifierPattern.MatchString(args.NewName) {
+		return mcp.NewToolResultError(fmt.Sprintf("%q is not a valid identifier", args.NewName)), nil
+	}
+
+	if err := t.requireWrite(); err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	result, err := client.LspRename(args.Line, args.Col, args.NewName)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to rename: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(result), nil
+}
+
+// FormatBuffer formats the current buffer with the language server
+func (t *NvimToolbox) FormatBuffer(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args FormatBufferArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	if args.EndLine > 0 && args.StartLine == 0 {
+		return mcp.NewToolResultError("end_line requires start_line"), nil
+	}
+
+	if err := t.requireWrite(); err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var rangeStart, rangeEnd *int
+	if args.StartLine > 0 {
+		rangeStart = &args.StartLine
+	}
+	if args.EndLine > 0 {
+		rangeEnd = &args.EndLine
+	}
+
+	result, err := client.FormatBuffer(rangeStart, rangeEnd)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to format buffer: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(result), nil
+}
+
+// GetTreesitterContext reports the syntax node and enclosing scopes at a position
+func (t *NvimToolbox) GetTreesitterContext(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args GetTreesitterContextArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	result, err := client.GetTreesitterContext(args.Line, args.Col)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to get treesitter context: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(result), nil
+}
+
+// SaveBuffer writes the current buffer
+func (t *NvimToolbox) SaveBuffer(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args SaveBufferArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	if err := t.requireWrite(); err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	result, err := client.SaveBuffer(args.Path, args.Force)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to save buffer: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(result), nil
+}
+
+// Undo undoes changes in the current buffer
+func (t *NvimToolbox) Undo(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	return t.undoRedo(ctx, request, (*NvimClient).Undo)
+}
+
+// Redo redoes undone changes in the current buffer
+func (t *NvimToolbox) Redo(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	return t.undoRedo(ctx, request, (*NvimClient).Redo)
+}
+
+// undoRedo is the shared handler body of undo and redo
+func (t *NvimToolbox) undoRedo(ctx context.Context, request mcp.CallToolRequest, step func(c *NvimClient, count int) (string, error)) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args UndoRedoArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	if err := t.requireWrite(); err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	result, err := step(client, args.Count)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	return mcp.NewToolResultText(result), nil
+}
+
+// GetChanges returns the current buffer's changelist
+func (t *NvimToolbox) GetChanges(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args GetChangesArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	changes, err := client.GetChangelist()
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to get changes: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(changes), nil
+}
+
+// GetProjectRoot returns the project root of the current buffer
+func (t *NvimToolbox) GetProjectRoot(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args GetProjectRootArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	root, err := client.GetProjectRoot()
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to get project root: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(root), nil
+}
+
+// ClearQuickfix empties the quickfix or location list
+func (t *NvimToolbox) ClearQuickfix(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	var args ClearQuickfixArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	cleared, err := client.ClearQuickfix(args.CloseWindow, args.UseLoclist)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to clear list: %v", err)), nil
+	}
+
+	list := "quickfix list"
+	if args.UseLoclist {
+		list = "location list"
+	}
+	result := fmt.Sprintf("Cleared %d items from the %s", cleared, list)
+	if args.CloseWindow {
+		result += " and closed its window"
+	}
+
+	return mcp.NewToolResultText(result), nil
+}
+
+// ServerCapabilities reports which operation categories are enabled
+func (t *NvimToolbox) ServerCapabilities(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	var args ServerCapabilitiesArgs
+	if err := request.BindArguments(&args); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to bind arguments: %v", err)), nil
+	}
+
+	capabilities, err := json.Marshal(t.Capabilities())
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("failed to encode capabilities: %v", err)), nil
+	}
+
+	return mcp.NewToolResultText(string(capabilities)), nil
+}
+
+// Capabilities describes what the running server permits
+type Capabilities struct {
+	Read          bool          `json:"read"`
+	Write         bool          `json:"write"`
+	Lua           bool          `json:"lua"`
+	Shell         bool          `json:"shell"`
+	LspActions    bool          `json:"lsp_actions"`
+	CommandPolicy CommandPolicy `json:"command_policy"`
+}
+
+// CommandPolicy describes how execute_command filters commands
+type CommandPolicy struct {
+	Blocked  []string `json:"blocked"`
+	Denylist []string `json:"denylist"`
+	SafeMode bool     `json:"safe_mode"`
+}
+
+// Capabilities returns the operation categories enabled by the server config
+func (t *NvimToolbox) Capabilities() Capabilities {
+	policy := CommandPolicy{Blocked: []string{}, Denylist: []string{}, SafeMode: t.config.SafeMode}
+	for _, pattern := range t.config.CommandDenylist {
+		policy.Denylist = append(policy.Denylist, pattern.String())
+	}
+	policy.Blocked = append(policy.Blocked, "commands that quit Neovim")
+	if !t.config.AllowShell || !t.config.AllowLua {
+		policy.Blocked = append(policy.Blocked, "commands that cannot be classified, such as user commands or :execute with a computed string (enable with --allow-shell and --allow-lua)")
+	}
+	if t.config.SafeMode {
+		policy.Blocked = append(policy.Blocked, "commands that are not read-only (safe mode)")
+	} else if !t.config.AllowWrite {
+		policy.Blocked = append(policy.Blocked, "commands that are not read-only (enable with --allow-write)")
+	}
+	if !t.config.AllowShell {
+		policy.Blocked = append(policy.Blocked, "shell commands (enable with --allow-shell)")
+	}
+	if !t.config.AllowLua {
+		policy.Blocked = append(policy.Blocked, "lua code, including luaeval(), v:lua and :=expr (enable with --allow-lua)")
+	}
+
+	return Capabilities{
+		Read:  true,
+		Write: t.config.AllowWrite,
+		Lua:   t.config.AllowLua,
+		Shell: t.config.AllowShell,
+		// LSP actions such as code actions and renames edit buffers
+		LspActions:    t.config.AllowWrite,
+		CommandPolicy: policy,
+	}
+}
+
+// requireWrite returns an error when buffer-modifying tools are disabled
+func (t *NvimToolbox) requireWrite() error {
+	if !t.config.AllowWrite {
+		return fmt.Errorf("write access is disabled; restart the server with --allow-write to enable it")
+	}
+	return nil
+}
+
+// checkCommandPolicy rejects commands that match the denylist, quit Neovim,
+// cannot be classified, belong to a disabled category, or are not read-only
+// in safe mode or without write access
+func (t *NvimToolbox) checkCommandPolicy(client *NvimClient, command string) error {
+	for _, pattern := range t.config.CommandDenylist {
+		if pattern.MatchString(command) {
+			return fmt.Errorf("command blocked by policy: %s matches the command denylist (%s)", command, pattern)
+		}
+	}
+
+	details, err := client.ClassifyCommand(command)
+	if err != nil {
+		return fmt.Errorf("failed to check command policy: %v", err)
+	}
+
+	if details.Quits {
+		finding := details.Finding("quit")
+		return fmt.Errorf("command blocked by policy: %s %s", finding.Command, finding.Reason)
+	}
+
+	// Commands the classifier cannot follow may do anything, so they only
+	// run once both shell and Lua code are allowed
+	if details.Unresolved && !(t.config.AllowShell && t.config.AllowLua) {
+		finding := details.Finding("unknown")
+		return fmt.Errorf("command blocked by policy: %s %s; restart the server with --allow-shell and --allow-lua to run it", finding.Command, finding.Reason)
+	}
+
+	if details.Shell && !t.config.AllowShell {
+		finding := details.Finding("shell")
+		return fmt.Errorf("command blocked by policy: %s (%s); restart the server with --allow-shell to enable it", finding.Command, finding.Reason)
+	}
+
+	if details.Lua && !t.config.AllowLua {
+		finding := details.Finding("lua")
+		return fmt.Errorf("command blocked by policy: %s (%s); restart the server with --allow-lua to enable it", finding.Command, finding.Reason)
+	}
+
+	if details.Classification != "read-only" {
+		if t.config.SafeMode {
+			return fmt.Errorf("command blocked by policy: safe mode only allows read-only commands and %s is %s (%s)", details.Command, details.Classification, details.Reason)
+		}
+		if err := t.requireWrite(); err != nil {
+			return fmt.Errorf("command blocked by policy: %s is %s (%s); %v", details.Command, details.Classification, details.Reason, err)
+		}
+	}
+
+	return nil
+}
+
+// macroShellKeys reach a shell filter (!), Ex mode (Q, gQ), the command-line
+// window (q:) or another register (@) without a command line macroCommands
+// can extract. Like macroCommands, matches inside inserted text only ever
+// make the check stricter.
+var macroShellKeys = []string{"!", "Q", "q:", "@"}
+
+// macroQuitKeys quit Neovim from normal mode
+var macroQuitKeys = []string{"ZZ", "ZQ"}
+
+// findMacroKeys returns the first of the given key sequences a macro
+// contains, or "" when it contains none
+func findMacroKeys(keys string, sequences []string) string {
+	for _, sequence := range sequences {
+		if strings.Contains(keys, sequence) {
+			return sequence
+		}
+	}
+	return ""
+}
+
+// macroCommands extracts the Ex command lines typed by a macro, i.e. the
+// text between each ':' and the following carriage return or newline. Text
+// inserted in insert mode can produce false positives, which only ever
+// make the policy check stricter.
+func macroCommands(keys string) []string {
+	var commands []string
+	for {
+		start := strings.IndexByte(keys, ':')
+		if start < 0 {
+			return commands
+		}
+		keys = keys[start+1:]
+		end := strings.IndexAny(keys, "\r\n")
+		if end < 0 {
+			end = len(keys)
+		}
+		if command := strings.TrimSpace(keys[:end]); command != "" {
+			commands = append(commands, command)
+		}
+		keys = keys[end:]
+	}
+}
+
+// textEditsFromArgs converts typed tool arguments into client text edits
+func textEditsFromArgs(edits []TextEditArg) []TextEdit {
+	var textEdits []TextEdit
+	for _, edit := range edits {
+		textEdits = append(textEdits, TextEdit{
+			StartLine: edit.StartLine,
+			StartCol:  edit.StartCol,
+			EndLine:   edit.EndLine,
+			EndCol:    edit.EndCol,
+			NewText:   edit.NewText,
+		})
+	}
+	return textEdits
+}
+
+// quickfixItemsFromArgs converts typed tool arguments into client quickfix
+// items, returning the reasons for any it had to reject
+func quickfixItemsFromArgs(items []QuickfixItemArg) ([]QuickfixItem, []string) {
+	var qfList []QuickfixItem
+	var rejected []string
+	for i, item := range items {
+		qfEntry := QuickfixItem{
+			Filename: item.Filename,
+			Bufnr:    item.Bufnr,
+			Line:     item.Line,
+			Column:   item.Column,
+			EndLine:  item.EndLine,
+			EndCol:   item.EndCol,
+			Text:     item.Text,
+			Type:     item.Type,
+		}
+		if err := qfEntry.Validate(); err != nil {
+			location := item.Filename
+			if location == "" && item.Bufnr != 0 {
+				location = fmt.Sprintf("buffer %d", item.Bufnr)
+			}
+			rejected = append(rejected, fmt.Sprintf("item %d (%s:%d): %v", i+1, location, item.Line, err))
+			continue
+		}
+		qfList = append(qfList, qfEntry)
+	}
+	return qfList, rejected
+}
+
+// rejectedItemsNote lists rejected quickfix items for a tool result
+func rejectedItemsNote(rejected []string) string {
+	if len(rejected) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("\nRejected %d items:\n- %s", len(rejected), strings.Join(rejected, "\n- "))
+}
+
+// RegisterResources exposes Neovim buffers and watched events as MCP resources
+func (t *NvimToolbox) RegisterResources(s *server.MCPServer) {
+	bufferTemplate := mcp.NewResourceTemplate(
+		bufferURIPrefix+"{bufnr}",
+		"Neovim buffer",
+		mcp.WithTemplateDescription("Full text of a loaded Neovim buffer, typed by its filetype. Subscribe to it, or use watch_buffer, to be notified when it changes."),
+		mcp.WithTemplateMIMEType("text/plain"),
+	)
+
+	s.AddResourceTemplate(bufferTemplate, t.ReadBufferResource)
+
+	eventsResource := mcp.NewResource(
+		eventsURI,
+		"Neovim events",
+		mcp.WithResourceDescription("Most recent autocommand events fired by watch_event watches, oldest first."),
+		mcp.WithMIMEType("application/json"),
+	)
+
+	s.AddResource(eventsResource, t.ReadEventsResource)
+}
+
+// RefreshBufferResources is a resources/list hook that registers an
+// nvim://buffer/<bufnr> resource for every loaded, listed buffer and drops
+// those for buffers that are gone
+func (t *NvimToolbox) RefreshBufferResources(ctx context.Context, id any, request *mcp.ListResourcesRequest) {
+	if t.server == nil {
+		return
+	}
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return
+	}
+
+	output, err := client.ListBuffers(false)
+	if err != nil {
+		slog.Warn("could not list buffers for resources", "err", err)
+		return
+	}
+	var buffers []struct {
+		Bufnr    int    `json:"bufnr"`
+		Path     string `json:"path"`
+		Filetype string `json:"filetype"`
+		Loaded   bool   `json:"loaded"`
+	}
+	if err := json.Unmarshal([]byte(output), &buffers); err != nil {
+		slog.Warn("could not parse buffers for resources", "err", err)
+		return
+	}
+
+	current := make(map[string]mcp.Resource)
+	for _, buffer := range buffers {
+		if !buffer.Loaded {
+			continue
+		}
+		uri := fmt.Sprintf("%s%d", bufferURIPrefix, buffer.Bufnr)
+		name, description := filepath.Base(buffer.Path), buffer.Path
+		if buffer.Path == "" {
+			name, description = "[No Name]", fmt.Sprintf("Unnamed buffer %d", buffer.Bufnr)
+		}
+		current[uri] = mcp.NewResource(uri, name,
+			mcp.WithResourceDescription(description),
+			mcp.WithMIMEType(bufferMIMEType(buffer.Filetype)),
+		)
+	}
+
+	// Every add or delete sends a list_changed notification, so only real
+	// changes touch the server's registry
+	t.resourceMu.Lock()
+	defer t.resourceMu.Unlock()
+
+	var stale []string
+	for uri := range t.bufferResources {
+		if _, ok := current[uri]; !ok {
+			stale = append(stale, uri)
+		}
+	}
+	if len(stale) > 0 {
+		t.server.DeleteResources(stale...)
+	}
+
+	registered := make(map[string]string, len(current))
+	for uri, resource := range current {
+		signature := resource.Name + "\x00" + resource.Description + "\x00" + resource.MIMEType
+		if t.bufferResources[uri] != signature {
+			t.server.AddResource(resource, t.ReadBufferResource)
+		}
+		registered[uri] = signature
+	}
+	t.bufferResources = registered
+}
+
+// bufferMIMEType maps a Neovim filetype to the MIME type of its resource
+func bufferMIMEType(filetype string) string {
+	if mimeType, ok := filetypeMIMETypes[filetype]; ok {
+		return mimeType
+	}
+	return "text/plain"
+}
+
+// ReadBufferResource returns the contents of an nvim://buffer/<bufnr> resource
+func (t *NvimToolbox) ReadBufferResource(ctx context.Context, request mcp.ReadResourceRequest) ([]mcp.ResourceContents, error) {
+	client, err := t.ensureConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	bufnr, err := strconv.Atoi(strings.TrimPrefix(request.Params.URI, bufferURIPrefix))
+	if err != nil || bufnr <= 0 {
+		return nil, fmt.Errorf("invalid buffer resource URI %q", request.Params.URI)
+	}
+
+	snapshot, err := client.BufferText(bufnr)
+	if err != nil {
+		return nil, err
+	}
+
+	return []mcp.ResourceContents{
+		mcp.TextResourceContents{
+			Meta:     &mcp.Meta{AdditionalFields: map[string]any{"changedtick": snapshot.Changedtick, "filetype": snapshot.Filetype}},
+			URI:      request.Params.URI,
+			MIMEType: bufferMIMEType(snapshot.Filetype),
+			Text:     snapshot.Text,
+		},
+	}, nil
+}
+
+// watchHandlers routes the notifications of the session's clients to the
+// toolbox's watches
+func (t *NvimToolbox) watchHandlers() WatchHandlers {
+	return WatchHandlers{
+		BufferChanged:  t.bufferChanged,
+		BufferDetached: t.bufferDetached,
+		EventFired:     t.eventFired,
+		Reconnected:    t.rewatch,
+	}
+}
+
+// SubscribeResource starts announcing updates of the resource at uri to a
+// session. A subscribed buffer is watched for as long as it has subscribers,
+// as if it had been passed to watch_buffer.
+func (t *NvimToolbox) SubscribeResource(ctx context.Context, sessionID, uri string) error {
+	bufnr, err := subscribableResource(uri)
+	if err != nil {
+		return err
+	}
+	if bufnr > 0 {
+		client, err := t.ensureConnection(ctx)
+		if err != nil {
+			return err
+		}
+		if _, err := client.WatchBuffer(bufnr); err != nil {
+			return err
+		}
+	}
+
+	t.watchMu.Lock()
+	defer t.watchMu.Unlock()
+	if t.subscriptions == nil {
+		t.subscriptions = make(map[string]map[string]bool)
+	}
+	if t.subscriptions[uri] == nil {
+		t.subscriptions[uri] = make(map[string]bool)
+	}
+	t.subscriptions[uri][sessionID] = true
+	return nil
+}
+
+// UnsubscribeResource stops announcing updates of the resource at uri to a
+// session, and ends the watch on a buffer nothing else watches
+func (t *NvimToolbox) UnsubscribeResource(ctx context.Context, sessionID, uri string) error {
+	bufnr, err := subscribableResource(uri)
+	if err != nil {
+		return err
+	}
+
+	t.watchMu.Lock()
+	delete(t.subscriptions[uri], sessionID)
+	if len(t.subscriptions[uri]) == 0 {
+		delete(t.subscriptions, uri)
+	}
+	detach := bufnr > 0 && !t.watchingBuffer(bufnr)
+	if detach {
+		delete(t.pending, bufnr)
+	}
+	t.watchMu.Unlock()
+
+	if detach {
+		if err := t.currentClient().WithContext(ctx).UnwatchBuffer(bufnr); err != nil {
+			slog.Warn("could not stop watching buffer", "bufnr", bufnr, "err", err)
+		}
+	}
+	return nil
+}
+
+// subscribableResource checks that uri names the events resource or a
+// buffer resource, and returns the buffer's number for the latter
+func subscribableResource(uri string) (int, error) {
+	if uri == eventsURI {
+		return 0, nil
+	}
+	if rest, ok := strings.CutPrefix(uri, bufferURIPrefix); ok {
+		if bufnr, err := strconv.Atoi(rest); err == nil && bufnr > 0 {
+			return bufnr, nil
+		}
+	}
+	return 0, fmt.Errorf("cannot subscribe to resource %q", uri)
+}
+
+// watchingBuffer reports whether bufnr is watched by watch_buffer or a
+// subscription. The caller must hold watchMu.
+func (t *NvimToolbox) watchingBuffer(bufnr int) bool {
+	return t.watched[bufnr] || len(t.subscriptions[fmt.Sprintf("%s%d", bufferURIPrefix, bufnr)]) > 0
+}
+
+// subscribers returns the sessions subscribed to uri. The caller must hold
+// watchMu.
+func (t *NvimToolbox) subscribers(uri string) []string {
+	sessions := make([]string, 0, len(t.subscriptions[uri]))
+	for sessionID := range t.subscriptions[uri] {
+		sessions = append(sessions, sessionID)
+	}
+	return sessions
+}
+
+// bufferChanged marks a watched buffer as changed. Changes are coalesced
+// into one notification per buffer per bufferChangeInterval, which bounds
+// the event rate no matter how fast the user types.
+func (t *NvimToolbox) bufferChanged(bufnr int) {
+	t.watchMu.Lock()
+	defer t.watchMu.Unlock()
+
+	if !t.watchingBuffer(bufnr) {
+		return
+	}
+	if t.pending == nil {
+		t.pending = make(map[int]bool)
+	}
+	t.pending[bufnr] = true
+	if t.flush == nil {
+		t.flush = time.AfterFunc(bufferChangeInterval, t.flushBufferChanges)
+	}
+}
+
+// flushBufferChanges announces every buffer changed since the last flush
+func (t *NvimToolbox) flushBufferChanges() {
+	t.watchMu.Lock()
+	updates := make(map[string][]string, len(t.pending))
+	for bufnr := range t.pending {
+		uri := fmt.Sprintf("%s%d", bufferURIPrefix, bufnr)
+		updates[uri] = t.subscribers(uri)
+	}
+	t.pending, t.flush = nil, nil
+	t.watchMu.Unlock()
+
+	for uri, sessions := range updates {
+		t.notifyResourceUpdated(uri, sessions)
+	}
+}
+
+// bufferDetached ends the watch and the subscriptions on a buffer Neovim
+// stopped reporting, and announces it once more so that subscribers notice
+// the buffer is gone
+func (t *NvimToolbox) bufferDetached(bufnr int) {
+	uri := fmt.Sprintf("%s%d", bufferURIPrefix, bufnr)
+	t.watchMu.Lock()
+	sessions := t.subscribers(uri)
+	delete(t.watched, bufnr)
+	delete(t.pending, bufnr)
+	delete(t.subscriptions, uri)
+	t.watchMu.Unlock()
+
+	t.notifyResourceUpdated(uri, sessions)
+}
+
+// rewatch restores the watches after the connection they reported on was
+// dropped. Buffers are attached again, or detached if that fails, and event
+// watches are pointed at the new connection.
+func (t *NvimToolbox) rewatch() {
+	t.watchMu.Lock()
+	buffers := make(map[int]bool, len(t.watched))
+	for bufnr := range t.watched {
+		buffers[bufnr] = true
+	}
+	for uri := range t.subscriptions {
+		if bufnr, err := subscribableResource(uri); err == nil && bufnr > 0 {
+			buffers[bufnr] = true
+		}
+	}
+	events := len(t.eventWatches)
+	t.watchMu.Unlock()
+
+	client := t.currentClient()
+	if events > 0 {
+		if err := client.RedirectEvents(); err != nil {
+			slog.Warn("could not redirect event watches", "err", err)
+		}
+	}
+	for bufnr := range buffers {
+		if _, err := client.WatchBuffer(bufnr); err != nil {
+			slog.Warn("could not watch buffer again", "bufnr", bufnr, "err", err)
+			t.bufferDetached(bufnr)
+		}
+	}
+}
+
+// notifyResourceUpdated tells sessions that the resource at uri changed;
+// they read it again to see how
+func (t *NvimToolbox) notifyResourceUpdated(uri string, sessions []string) {
+	if t.server == nil {
+		return
+	}
+	for _, sessionID := range sessions {
+		if err := t.server.SendNotificationToSpecificClient(sessionID, "notifications/resources/updated", map[string]any{"uri": uri}); err != nil {
+			slog.Debug("could not announce resource update", "uri", uri, "session", sessionID, "err", err)
+		}
+	}
+}
+
+// eventFired records an event reported by a watch_event watch for the
+// events resource and announces it
+func (t *NvimToolbox) eventFired(event FiredEvent) {
+	t.watchMu.Lock()
+	if !t.eventWatches[event.ID] {
+		t.watchMu.Unlock()
+		return
+	}
+	if event.Once {
+		delete(t.eventWatches, event.ID)
+	}
+	t.recentEvents = append(t.recentEvents, event)
+	if len(t.recentEvents) > maxRecentEvents {
+		t.recentEvents = t.recentEvents[len(t.recentEvents)-maxRecentEvents:]
+	}
+	sessions := t.subscribers(eventsURI)
+	t.watchMu.Unlock()
+
+	t.notifyResourceUpdated(eventsURI, sessions)
+}
+
+// ReadEventsResource returns the events recently fired by watch_event watches
+func (t *NvimToolbox) ReadEventsResource(ctx context.Context, request mcp.ReadResourceRequest) ([]mcp.ResourceContents, error) {
+	t.watchMu.Lock()
+	events := append([]FiredEvent{}, t.recentEvents...)
+	t.watchMu.Unlock()
+
+	encoded, err := json.Marshal(map[string]any{"events": events})
+	if err != nil {
+		return nil, err
+	}
+
+	return []mcp.ResourceContents{
+		mcp.TextResourceContents{
+			URI:      eventsURI,
+			MIMEType: "application/json",
+			Text:     string(encoded),
+		},
+	}, nil
+}
+
+// SessionError is one failed tool call recorded in the session ledger
+type SessionError struct {
+	Time      time.Time `json:"time"`
+	Tool      string    `json:"tool"`
+	Arguments string    `json:"arguments"`
+	Category  string    `json:"category"`
+	Message   string    `json:"message"`
+}
+
+// RecordErrors is tool handler middleware that adds every failed call to the
+// session's error ledger
+func (t *NvimToolbox) RecordErrors(next server.ToolHandlerFunc) server.ToolHandlerFunc {
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		result, err := next(ctx, request)
+
+		var message string
+		switch {
+		case err != nil:
+			message = err.Error()
+		case result != nil && result.IsError:
+			for _, content := range result.Content {
+				if text, ok := content.(mcp.TextContent); ok {
+					message = text.Text
+					break
+				}
+			}
+		default:
+			return result, err
+		}
+
+		arguments, _ := json.Marshal(request.GetArguments())
+		summary := string(arguments)
+		if len(summary) > maxErrorArgumentsLength {
+			summary = cutAtRune(summary, maxErrorArgumentsLength) + "..."
+		}
+
+		t.errMu.Lock()
+		t.errors = append(t.errors, SessionError{
+			Time:      time.Now(),
+			Tool:      request.Params.Name,
+			Arguments: summary,
+			Category:  errorCategory(message),
+			Message:   message,
+		})
+		if len(t.errors) > maxSessionErrors {
+			t.errors = t.errors[len(t.errors)-maxSessionErrors:]
+		}
+		t.errMu.Unlock()
+
+		return result, err
+	}
+}
+
+// LimitOutput is tool handler middleware that truncates result text longer
+// than --max-output-bytes
+func (t *NvimToolbox) LimitOutput(next server.ToolHandlerFunc) server.ToolHandlerFunc {
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		result, err := next(ctx, request)
+		if result == nil || t.config.MaxOutputBytes <= 0 {
+			return result, err
+		}
+
+		for i, content := range result.Content {
+			if text, ok := content.(mcp.TextContent); ok && len(text.Text) > t.config.MaxOutputBytes {
+				text.Text = truncateOutput(text.Text, t.config.MaxOutputBytes)
+				result.Content[i] = text
+			}
+		}
+		return result, err
+	}
+}
+
+// truncateOutput cuts text to at most limit bytes without splitting a UTF-8
+// sequence and says how much was dropped
+func truncateOutput(text string, limit int) string {
+	kept := cutAtRune(text, limit)
+	return fmt.Sprintf("%s\n... (truncated, %d more bytes)", kept, len(text)-len(kept))
+}
+
+// cutAtRune returns the longest prefix of text that is at most limit bytes
+// and does not end inside a UTF-8 sequence
+func cutAtRune(text string, limit int) string {
+	if len(text) <= limit {
+		return text
+	}
+	cut := limit
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	return text[:cut]
+}
+
+// errorCategory sorts a tool error message into a coarse category by the
+// wording the handlers use
+func errorCategory(message string) string {
+	switch {
+	case strings.HasPrefix(message, "failed to bind arguments"):
+		return "arguments"
+	case strings.HasPrefix(message, "write access is disabled"), strings.HasPrefix(message, "command blocked by policy"):
+		return "policy"
+	case strings.HasPrefix(message, "no Neovim instance found"), strings.Contains(message, "multiple Neovim instances"),
+		strings.Contains(message, "failed to connect"), strings.Contains(message, "is not responding"):
+		return "connection"
+	case strings.Contains(message, "not loaded"), strings.Contains(message, "does not exist"),
+		strings.Contains(message, "invalid"):
+		return "invalid_target"
+	default:
+		return "nvim"
+	}
+}
+
+// ensureConnection returns the session's client, reconnecting first if it is
+// not connected or the instance went away (e.g. Neovim was closed and
+// reopened). An instance that is merely slow to answer is not replaced. Calls
+// made through the returned client stop waiting once ctx is done.
+func (t *NvimToolbox) ensureConnection(ctx context.Context) (*NvimClient, error) {
+	client := t.currentClient().WithContext(ctx)
+	if client.socketPath != "" {
+		err := client.Ping()
+		if err == nil {
+			return client, nil
+		}
+		if errors.Is(err, errRPCTimeout) {
+			return nil, fmt.Errorf("Neovim at %s is not responding: %w", client.socketPath, err)
+		}
+	}
+
+	// Concurrent handlers reconnect one at a time; those that waited use
+	// the connection the first one made
+	t.reconnectMu.Lock()
+	defer t.reconnectMu.Unlock()
+	if current := t.currentClient().WithContext(ctx); current.clientState != client.clientState && current.socketPath != "" && current.Ping() == nil {
+		return current, nil
+	}
+
+	// A restarted Neovim takes a moment to listen again, so detection is
+	// retried; an ambiguous match or a timeout will not resolve itself and
+	// fails at once
+	var err error
+	for attempt := 0; ; attempt++ {
+		var client *NvimClient
+		client, err = NewNvimClient(t.config.Socket)
+		if err == nil {
+			t.configure(client)
+			if err = client.WithContext(ctx).Ping(); err == nil {
+				t.useClient(client)
+				return client.WithContext(ctx), nil
+			}
+			client.Close()
+		}
+
+		var ambiguous *AmbiguousSocketError
+		if errors.As(err, &ambiguous) || errors.Is(err, errRPCTimeout) || attempt == len(reconnectBackoff) {
+			break
+		}
+		slog.Debug("reconnect attempt failed", "attempt", attempt+1, "retry_in", reconnectBackoff[attempt], "err", err)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("no Neovim instance found: %w", ctx.Err())
+		case <-time.After(reconnectBackoff[attempt]):
+		}
+	}
+
+	return nil, fmt.Errorf("no Neovim instance found: %w", err)
+}
+
+// reconnectBackoff is how long ensureConnection waits before each retry
+var reconnectBackoff = []time.Duration{200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond}
+
+// currentClient returns the session's client without checking that it is
+// still connected
+func (t *NvimToolbox) currentClient() *NvimClient {
+	t.clientMu.Lock()
+	defer t.clientMu.Unlock()
+	return t.client
+}
+
+// configure applies the session's settings to a new client before its
+// first call
+func (t *NvimToolbox) configure(client *NvimClient) *NvimClient {
+	client.timeout = t.config.RPCTimeout
+	client.handlers = t.watchHandlers()
+	return client
+}
+
+// useClient makes client the session's connection. The previous client is
+// closed once no call is using it any more.
+func (t *NvimToolbox) useClient(client *NvimClient) {
+	client.timeout = t.config.RPCTimeout
+	t.clientMu.Lock()
+	previous := t.client
+	t.client = client
+	t.clientMu.Unlock()
+	previous.Close()
+
+	// Watches live in the previous instance, so they end with it
+	t.detachWatches()
+}
+
+// detachWatches forgets every buffer and event watch, and the subscriptions
+// to buffers, whose numbers mean other buffers in the new instance. Each
+// subscribed buffer is announced once more, as if it had been unloaded; the
+// events resource is unchanged, so it is not.
+func (t *NvimToolbox) detachWatches() {
+	t.watchMu.Lock()
+	updates := make(map[string][]string)
+	for uri := range t.subscriptions {
+		if uri != eventsURI {
+			updates[uri] = t.subscribers(uri)
+			delete(t.subscriptions, uri)
+		}
+	}
+	t.watched, t.pending, t.eventWatches = nil, nil, nil
+	t.watchMu.Unlock()
+
+	for uri, sessions := range updates {
+		t.notifyResourceUpdated(uri, sessions)
+	}
+}
+
+// Tool argument structs for typed schemas
+type QuickfixItemArg struct {
+	Filename string `json:"filename,omitempty" jsonschema:"description=File path (omit when bufnr is given)"`
+	Bufnr    int    `json:"bufnr,omitempty" jsonschema:"description=Buffer number instead of a filename (for unsaved or unnamed buffers)"`
+	Line     int    `json:"line" jsonschema:"description=Line number"`
+	Column   int    `json:"column,omitempty" jsonschema:"description=Column number (optional)"`
+	EndLine  int    `json:"end_line,omitempty" jsonschema:"description=Last line of the range to highlight (optional; defaults to a single point)"`
+	EndCol   int    `json:"end_col,omitempty" jsonschema:"description=Column just past the end of the range (optional)"`
+	Text     string `json:"text" jsonschema:"description=Error or warning message"`
+	Type     string `json:"type,omitempty" jsonschema:"description=Type of entry (E for error W for warning I for info N for note),enum=E,enum=W,enum=I,enum=N"`
+}
+
+type PopulateQuickfixArgs struct {
+	Items      []QuickfixItemArg `json:"items" jsonschema:"description=Array of quickfix items"`
+	Height     int               `json:"height,omitempty" jsonschema:"description=Window height (width for left/right) in lines; defaults to Vim's copen height"`
+	Position   string            `json:"position,omitempty" jsonschema:"description=Where to open the quickfix window (defaults to Vim's copen placement),enum=bottom,enum=top,enum=left,enum=right"`
+	Action     string            `json:"action,omitempty" jsonschema:"description=How to combine with the current quickfix list: replace its items (default) or append to them or push a new list onto the quickfix stack,enum=replace,enum=append,enum=new"`
+	Title      string            `json:"title,omitempty" jsonschema:"description=Title shown for the list in :copen and :chistory (defaults to MCP: <N> items)"`
+	UseLoclist bool              `json:"use_loclist,omitempty" jsonschema:"description=Populate the current window's location list and open it with lopen instead of the quickfix list (height and position are ignored)"`
+}
+
+type ExecuteCommandArgs struct {
+	Command string `json:"command" jsonschema:"description=Vim command to execute (e.g. 'set number' 'vsplit' 'wq' etc.)"`
+	Observe bool   `json:"observe,omitempty" jsonschema:"description=Also report side effects: whether buffers changed or were created and whether the cursor moved"`
+}
+
+type GetBufferContextArgs struct {
+	Format string `json:"format,omitempty" jsonschema:"description=Output format: FILE_PATH:/CURSOR:/... lines (default) or a json object with file_path and cursor and mode and changedtick plus current_line or visual_selection and selected_text,enum=text,enum=json"`
+}
+
+type GetDiagnosticsArgs struct {
+	Format      string `json:"format,omitempty" jsonschema:"description=Output format: text lines of DIAGNOSTIC:line:col:severity:message (default) or a json list,enum=text,enum=json"`
+	MinSeverity string `json:"min_severity,omitempty" jsonschema:"description=Only report diagnostics at this severity or worse,enum=ERROR,enum=WARN,enum=INFO,enum=HINT"`
+	Severity    string `json:"severity,omitempty" jsonschema:"description=Only report diagnostics of exactly this severity,enum=ERROR,enum=WARN,enum=INFO,enum=HINT"`
+	Scope       string `json:"scope,omitempty" jsonschema:"description=Report the current buffer (default) or every buffer grouped by file name,enum=current,enum=all"`
+}
+
+// maxLineOffsets caps how many lines a single line_offsets call returns
+const maxLineOffsets = 5000
+
+type LineOffsetsArgs struct {
+	Bufnr     int `json:"bufnr,omitempty" jsonschema:"description=Buffer number (0 or omitted for the current buffer)"`
+	StartLine int `json:"start_line,omitempty" jsonschema:"description=First line to report (1-based; defaults to 1)"`
+	MaxLines  int `json:"max_lines,omitempty" jsonschema:"description=Maximum number of lines to report (defaults to and capped at 5000)"`
+}
+
+type CommandInfoArgs struct {
+	Command string `json:"command" jsonschema:"description=Vim command to classify (e.g. '%s/foo/bar/g' 'ls' '!make')"`
+}
+
+type GetLoclistArgs struct {
+	Winid         int  `json:"winid,omitempty" jsonschema:"description=Window ID whose location list to read (0 or omitted for the current window)"`
+	AbsolutePaths bool `json:"absolute_paths,omitempty" jsonschema:"description=Report absolute file paths instead of paths relative to the project root"`
+}
+
+type PopulateLoclistArgs struct {
+	Winid int               `json:"winid,omitempty" jsonschema:"description=Window ID whose location list to set (0 or omitted for the current window)"`
+	Items []QuickfixItemArg `json:"items" jsonschema:"description=Array of location list items"`
+}
+
+type LoclistNavigateArgs struct {
+	Winid     int    `json:"winid,omitempty" jsonschema:"description=Window ID whose location list to navigate (0 or omitted for the current window)"`
+	Direction string `json:"direction,omitempty" jsonschema:"description=Where to move in the list,enum=next,enum=prev,enum=first,enum=last"`
+	Index     int    `json:"index,omitempty" jsonschema:"description=Jump directly to this 1-based entry (overrides direction)"`
+}
+
+type JobStatusArgs struct {
+	JobID    int `json:"job_id" jsonschema:"description=Job ID as returned by jobstart() or b:terminal_job_id"`
+	MaxLines int `json:"max_lines,omitempty" jsonschema:"description=Maximum number of trailing output lines to return (defaults to 100)"`
+}
+
+type SpellErrorsArgs struct {
+	Bufnr     int `json:"bufnr,omitempty" jsonschema:"description=Buffer number (0 or omitted for the current buffer)"`
+	StartLine int `json:"start_line,omitempty" jsonschema:"description=First line to scan (1-based; defaults to 1)"`
+	EndLine   int `json:"end_line,omitempty" jsonschema:"description=Last line to scan (inclusive; defaults to the end of the buffer)"`
+}
+
+type GetArglistArgs struct {
+	// No arguments needed
+}
+
+type SetArglistArgs struct {
+	Files []string `json:"files" jsonschema:"description=File paths for the new argument list (an empty array clears it)"`
+}
+
+type SnapshotArgs struct {
+	// No arguments needed
+}
+
+type TextEditArg struct {
+	StartLine int    `json:"start_line" jsonschema:"description=Start line (1-based)"`
+	StartCol  int    `json:"start_col" jsonschema:"description=Start column (1-based byte column)"`
+	EndLine   int    `json:"end_line" jsonschema:"description=End line (1-based)"`
+	EndCol    int    `json:"end_col" jsonschema:"description=End column (1-based and exclusive; equal to start_col on the same line to insert)"`
+	NewText   string `json:"new_text" jsonschema:"description=Replacement text (may contain newlines)"`
+}
+
+type BufferEditsArg struct {
+	Bufnr       int           `json:"bufnr" jsonschema:"description=Buffer number to edit"`
+	Changedtick int           `json:"changedtick,omitempty" jsonschema:"description=Expected b:changedtick; the whole transaction is rejected if the buffer has changed since"`
+	Edits       []TextEditArg `json:"edits" jsonschema:"description=Non-overlapping edits for this buffer"`
+}
+
+type MultiBufferEditArgs struct {
+	Buffers []BufferEditsArg `json:"buffers" jsonschema:"description=Edits grouped by buffer"`
+}
+
+type GetViewArgs struct {
+	Winid int `json:"winid,omitempty" jsonschema:"description=Window ID (0 or omitted for the current window)"`
+}
+
+type SetViewArgs struct {
+	Winid int            `json:"winid,omitempty" jsonschema:"description=Window ID (0 or omitted for the current window)"`
+	View  map[string]any `json:"view" jsonschema:"description=View object exactly as returned by get_view"`
+}
+
+type SelectionDiffArgs struct {
+	Replacement string `json:"replacement" jsonschema:"description=Proposed text to replace the selection with"`
+}
+
+type TestResultsArgs struct {
+	// No arguments needed
+}
+
+type NamespacesArgs struct {
+	Action string `json:"action,omitempty" jsonschema:"description=What to do (defaults to list),enum=list,enum=clear"`
+	Name   string `json:"name,omitempty" jsonschema:"description=Namespace to clear (omit to clear all namespaces owned by this server)"`
+}
+
+type FiletypeProfileArgs struct {
+	Bufnr int `json:"bufnr,omitempty" jsonschema:"description=Buffer number (0 or omitted for the current buffer)"`
+}
+
+// identifierPattern matches names that are valid identifiers in most languages
+var identifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+type LocalRenameArgs struct {
+	Line    int    `json:"line,omitempty" jsonschema:"description=Line of the symbol (1-based; defaults to the cursor)"`
+	Column  int    `json:"column,omitempty" jsonschema:"description=Column of the symbol (1-based; defaults to the cursor)"`
+	NewName string `json:"new_name" jsonschema:"description=New name for the symbol"`
+	Preview bool   `json:"preview,omitempty" jsonschema:"description=Only report the lines that would change without editing the buffer"`
+}
+
+type ServerCapabilitiesArgs struct {
+	// No arguments needed
+}
+
+type ModelineSettingsArgs struct {
+	Bufnr int `json:"bufnr,omitempty" jsonschema:"description=Buffer number (0 or omitted for the current buffer)"`
+}
+
+type OpenQuickfixEntryArgs struct {
+	Index int    `json:"index" jsonschema:"description=1-based index of the quickfix entry"`
+	Split string `json:"split,omitempty" jsonschema:"description=Where to show the entry (defaults to none meaning the current window),enum=none,enum=horizontal,enum=vertical,enum=tab,enum=preview"`
+}
+
+type DiagnosticConfigArgs struct {
+	// No arguments needed
+}
+
+type RelativePathArgs struct {
+	Path string `json:"path,omitempty" jsonschema:"description=Path to convert (defaults to the current buffer's file)"`
+}
+
+type QuickfixDoArgs struct {
+	Command string `json:"command" jsonschema:"description=Vim command to run at each quickfix entry (e.g. 's/foo/bar/g')"`
+}
+
+// Limits for syntax_tree output
+const (
+	maxSyntaxTreeLines = 200
+	maxSyntaxTreeNodes = 2000
+)
+
+type SyntaxTreeArgs struct {
+	Bufnr     int `json:"bufnr,omitempty" jsonschema:"description=Buffer number (0 or omitted for the current buffer)"`
+	StartLine int `json:"start_line,omitempty" jsonschema:"description=First line of the range (1-based; defaults to 1)"`
+	EndLine   int `json:"end_line,omitempty" jsonschema:"description=Last line of the range (inclusive; capped at 200 lines from start_line)"`
+}
+
+type CounterpartFileArgs struct {
+	Bufnr int  `json:"bufnr,omitempty" jsonschema:"description=Buffer number (0 or omitted for the current buffer)"`
+	Open  bool `json:"open,omitempty" jsonschema:"description=Open the counterpart in the current window if it exists"`
+}
+
+type DetectIndentArgs struct {
+	Bufnr int `json:"bufnr,omitempty" jsonschema:"description=Buffer number (0 or omitted for the current buffer)"`
+}
+
+type SetCmdlineArgs struct {
+	Text    string `json:"text" jsonschema:"description=Command line text without the leading colon"`
+	Execute bool   `json:"execute,omitempty" jsonschema:"description=Run the command instead of leaving it for the user to confirm"`
+}
+
+type FunctionSignaturesArgs struct {
+	Bufnr int `json:"bufnr,omitempty" jsonschema:"description=Buffer number (0 or omitted for the current buffer)"`
+}
+
+type ResolveInstanceArgs struct {
+	Socket string `json:"socket,omitempty" jsonschema:"description=Socket path of the instance to use (omit to list candidates)"`
+}
+
+type LspRequestArgs struct {
+	Method string         `json:"method" jsonschema:"description=LSP method name (e.g. textDocument/typeDefinition)"`
+	Params map[string]any `json:"params,omitempty" jsonschema:"description=Request parameters (defaults to the text document position at the cursor)"`
+	Bufnr  int            `json:"bufnr,omitempty" jsonschema:"description=Buffer whose LSP clients should handle the request (0 or omitted for the current buffer)"`
+}
+
+type CreateCheckpointArgs struct {
+	Bufnr int `json:"bufnr,omitempty" jsonschema:"description=Buffer number (0 or omitted for the current buffer)"`
+}
+
+type RestoreCheckpointArgs struct {
+	Bufnr int `json:"bufnr,omitempty" jsonschema:"description=Buffer number (0 or omitted for the current buffer)"`
+	Seq   int `json:"seq" jsonschema:"description=Undo sequence number (seq_cur) returned by create_checkpoint"`
+}
+
+type GroupDiagnosticsArgs struct {
+	Bufnr int `json:"bufnr,omitempty" jsonschema:"description=Buffer number (0 or omitted for the current buffer)"`
+}
+
+type ReadBufferDisplayArgs struct {
+	StartLine int `json:"start_line,omitempty" jsonschema:"description=First line to read (1-based; defaults to 1)"`
+	EndLine   int `json:"end_line,omitempty" jsonschema:"description=Last line to read inclusive (defaults to the end of the buffer; at most 1000 lines per call)"`
+}
+
+type DetectRuntimeArgs struct {
+	Bufnr int `json:"bufnr,omitempty" jsonschema:"description=Buffer number (0 or omitted for the current buffer)"`
+}
+
+const (
+	// bufferURIPrefix is the URI scheme under which buffers are exposed as resources
+	bufferURIPrefix = "nvim://buffer/"
+	// bufferChangeInterval bounds how often change notifications are sent
+	bufferChangeInterval = 500 * time.Millisecond
+	// eventsURI is the resource listing events fired by watch_event watches
+	eventsURI = "nvim://events"
+	// maxRecentEvents bounds how many fired events the events resource keeps
+	maxRecentEvents = 100
+)
+
+// filetypeMIMETypes maps common filetypes to MIME types for buffer
+// resources; anything else is served as text/plain
+var filetypeMIMETypes = map[string]string{
+	"c":          "text/x-c",
+	"cpp":        "text/x-c++",
+	"css":        "text/css",
+	"go":         "text/x-go",
+	"html":       "text/html",
+	"java":       "text/x-java",
+	"javascript": "text/javascript",
+	"json":       "application/json",
+	"lua":        "text/x-lua",
+	"markdown":   "text/markdown",
+	"python":     "text/x-python",
+	"ruby":       "text/x-ruby",
+	"rust":       "text/x-rust",
+	"sh":         "text/x-shellscript",
+	"toml":       "application/toml",
+	"typescript": "text/typescript",
+	"xml":        "application/xml",
+	"yaml":       "application/yaml",
+}
+
+type WatchBufferArgs struct {
+	Bufnr int `json:"bufnr,omitempty" jsonschema:"description=Buffer number (0 or omitted for the current buffer)"`
+}
+
+// maxColumn stands in for "end of line" when a range has no end column
+const maxColumn = 1 << 20
+
+type RangeCodeActionArgs struct {
+	StartLine int    `json:"start_line" jsonschema:"description=First line of the range (1-based)"`
+	StartCol  int    `json:"start_col,omitempty" jsonschema:"description=Start column (1-based byte column; defaults to 1)"`
+	EndLine   int    `json:"end_line" jsonschema:"description=Last line of the range (1-based)"`
+	EndCol    int    `json:"end_col,omitempty" jsonschema:"description=End column (1-based and exclusive; defaults to the end of the line)"`
+	Kind      string `json:"kind,omitempty" jsonschema:"description=Only return actions of this kind or a sub-kind (e.g. refactor.extract)"`
+	Index     int    `json:"index,omitempty" jsonschema:"description=Action to preview or apply from the listing (omit to list actions)"`
+	Preview   bool   `json:"preview,omitempty" jsonschema:"description=Show the chosen action's edits as a diff instead of applying them"`
+
+	VerifyDiagnostics bool `json:"verify_diagnostics,omitempty" jsonschema:"description=When applying: wait for the LSP to republish and report which diagnostics were resolved and which appeared"`
+}
+
+type GfTargetArgs struct {
+	Line int `json:"line,omitempty" jsonschema:"description=Line in the current buffer (1-based; defaults to the cursor line)"`
+	Col  int `json:"col,omitempty" jsonschema:"description=Column (1-based; defaults to 1 when line is given)"`
+}
+
+type LayoutTreeArgs struct {
+	Tabpage int `json:"tabpage,omitempty" jsonschema:"description=Tabpage number (1-based; 0 or omitted for the current tabpage)"`
+}
+
+type QuickfixWindowArgs struct {
+	Height   int    `json:"height,omitempty" jsonschema:"description=Window height (width for left/right) in lines; defaults to Vim's copen height"`
+	Position string `json:"position,omitempty" jsonschema:"description=Where to open the quickfix window (defaults to Vim's copen placement),enum=bottom,enum=top,enum=left,enum=right"`
+}
+
+type RecordMacroArgs struct {
+	Register string `json:"register" jsonschema:"description=Register to store the macro in (a-z; A-Z appends)"`
+	Keys     string `json:"keys" jsonschema:"description=Keys to store in mapping notation (e.g. 0f=r:<Esc>j)"`
+}
+
+type PlayMacroArgs struct {
+	Register string `json:"register" jsonschema:"description=Register to play (a-z or 0-9)"`
+	Count    int    `json:"count,omitempty" jsonschema:"description=Number of times to play the macro (defaults to 1)"`
+}
+
+// maxFindResults caps how many paths a single find_files call returns
+const maxFindResults = 1000
+
+type FindFilesArgs struct {
+	Glob       string `json:"glob" jsonschema:"description=Glob relative to the project root (e.g. **/*.go or config/*.yaml)"`
+	MaxResults int    `json:"max_results,omitempty" jsonschema:"description=Maximum number of paths to return (defaults to and capped at 1000)"`
+	Target     string `json:"target,omitempty" jsonschema:"description=Also load the matches into the arglist or the quickfix list,enum=arglist,enum=quickfix"`
+}
+
+type ReadBytesArgs struct {
+	Bufnr     int `json:"bufnr,omitempty" jsonschema:"description=Buffer number (0 or omitted for the current buffer)"`
+	StartLine int `json:"start_line,omitempty" jsonschema:"description=First line of the range (1-based; defaults to 1)"`
+	StartCol  int `json:"start_col,omitempty" jsonschema:"description=Start column (1-based byte column; defaults to 1)"`
+	EndLine   int `json:"end_line,omitempty" jsonschema:"description=Last line of the range (1-based; defaults to the last line)"`
+	EndCol    int `json:"end_col,omitempty" jsonschema:"description=End column (1-based and exclusive; defaults to the end of the line)"`
+}
+
+const (
+	// maxSessionErrors bounds the ledger; older entries are dropped first
+	maxSessionErrors = 200
+	// maxErrorArgumentsLength truncates the recorded arguments summary
+	maxErrorArgumentsLength = 200
+)
+
+type SessionErrorsArgs struct {
+	Clear bool `json:"clear,omitempty" jsonschema:"description=Clear the ledger after reading it"`
+}
+
+type FoldConfigArgs struct {
+	Bufnr     int `json:"bufnr,omitempty" jsonschema:"description=Buffer number (0 or omitted for the current buffer)"`
+	StartLine int `json:"start_line,omitempty" jsonschema:"description=First line to report fold levels for (1-based; defaults to 1)"`
+	EndLine   int `json:"end_line,omitempty" jsonschema:"description=Last line to report (defaults to the end of the buffer; at most 500 lines per call)"`
+}
+
+type ReviewProgressArgs struct {
+	Line int `json:"line,omitempty" jsonschema:"description=Line in the current buffer (1-based; defaults to the cursor line)"`
+}
+
+type VerboseOptionArgs struct {
+	Name string `json:"name" jsonschema:"description=Option name (e.g. textwidth) or mapping lhs (e.g. <leader>f) when mode is set"`
+	Mode string `json:"mode,omitempty" jsonschema:"description=Look up a mapping in this mode instead of an option,enum=n,enum=v,enum=x,enum=s,enum=o,enum=i,enum=c,enum=t,enum=l"`
+}
+
+type ConvertPositionArgs struct {
+	From     string `json:"from" jsonschema:"description=Convention of the given position,enum=vim,enum=lsp"`
+	Line     int    `json:"line" jsonschema:"description=Line (1-based for vim; 0-based for lsp)"`
+	Column   int    `json:"column" jsonschema:"description=Column (1-based byte column for vim; 0-based character offset for lsp)"`
+	Bufnr    int    `json:"bufnr,omitempty" jsonschema:"description=Buffer number (0 or omitted for the current buffer)"`
+	Encoding string `json:"encoding,omitempty" jsonschema:"description=LSP position encoding (defaults to the attached client's),enum=utf-8,enum=utf-16,enum=utf-32"`
+}
+
+type WatchEventArgs struct {
+	Event   string `json:"event,omitempty" jsonschema:"description=Autocommand event to watch (defaults to BufWritePost)"`
+	Pattern string `json:"pattern,omitempty" jsonschema:"description=Autocommand pattern such as *.go (defaults to *)"`
+	Once    bool   `json:"once,omitempty" jsonschema:"description=Remove the watch after it fires once"`
+}
+
+type UnwatchEventArgs struct {
+	ID int `json:"id" jsonschema:"description=Watch id returned by watch_event"`
+}
+
+type GetDocstringArgs struct {
+	Line int `json:"line,omitempty" jsonschema:"description=Line in the current buffer (1-based; defaults to the cursor)"`
+	Col  int `json:"col,omitempty" jsonschema:"description=Column (1-based; defaults to 1 when line is given)"`
+}
+
+// maxDiagnoseErrors is how many recent session errors diagnose includes
+const maxDiagnoseErrors = 10
+
+type DiagnoseArgs struct {
+	// No arguments needed
+}
+
+type GetBufferContentArgs struct {
+	StartLine int `json:"start_line,omitempty" jsonschema:"description=First line to read (1-based; defaults to 1)"`
+	EndLine   int `json:"end_line,omitempty" jsonschema:"description=Last line to read inclusive (defaults to the end of the buffer)"`
+	Offset    int `json:"offset,omitempty" jsonschema:"description=Number of lines to skip from the top (alternative to start_line for paging)"`
+	Limit     int `json:"limit,omitempty" jsonschema:"description=Maximum number of lines to return (use with offset to read a large file in chunks)"`
+}
+
+type ListBuffersArgs struct {
+	IncludeUnlisted bool `json:"include_unlisted,omitempty" jsonschema:"description=Also list unlisted and scratch buffers"`
+}
+
+type PingArgs struct {
+	// No arguments needed
+}
+
+type SetCursorArgs struct {
+	Line   int  `json:"line" jsonschema:"description=Line to move to (1-based)"`
+	Col    int  `json:"col,omitempty" jsonschema:"description=Byte column to move to (1-based; defaults to 1)"`
+	Center bool `json:"center,omitempty" jsonschema:"description=Center the view on the new cursor line (like zz)"`
+}
+
+type GetVisualSelectionArgs struct {
+	// No arguments needed
+}
+
+type OpenLocationArgs struct {
+	Path  string `json:"path" jsonschema:"description=File to open (relative paths resolve against Neovim's working directory)"`
+	Line  int    `json:"line,omitempty" jsonschema:"description=Line to jump to (1-based; defaults to 1)"`
+	Col   int    `json:"col,omitempty" jsonschema:"description=Byte column to jump to (1-based; defaults to 1)"`
+	Split string `json:"split,omitempty" jsonschema:"description=Where to open the file (defaults to none which reuses the current window),enum=none,enum=horizontal,enum=vertical,enum=tab"`
+}
+
+type ListLspClientsArgs struct {
+	// No arguments needed
+}
+
+type LspPositionArgs struct {
+	Line int `json:"line,omitempty" jsonschema:"description=Line in the current buffer (1-based; defaults to the cursor)"`
+	Col  int `json:"col,omitempty" jsonschema:"description=Byte column (1-based; defaults to 1 when line is given)"`
+}
+
+type LspReferencesArgs struct {
+	Line               int  `json:"line,omitempty" jsonschema:"description=Line in the current buffer (1-based; defaults to the cursor)"`
+	Col                int  `json:"col,omitempty" jsonschema:"description=Byte column (1-based; defaults to 1 when line is given)"`
+	IncludeDeclaration bool `json:"include_declaration,omitempty" jsonschema:"description=Also include the declaration itself"`
+	PopulateQuickfix   bool `json:"populate_quickfix,omitempty" jsonschema:"description=Push the references onto the quickfix stack as a new list and open it"`
+}
+
+type SearchBufferArgs struct {
+	Pattern          string `json:"pattern" jsonschema:"description=Text or Vim regex to search for"`
+	Regex            bool   `json:"regex,omitempty" jsonschema:"description=Treat pattern as a Vim regex instead of plain text"`
+	CaseSensitive    bool   `json:"case_sensitive,omitempty" jsonschema:"description=Match case exactly (searches ignore case by default)"`
+	PopulateQuickfix bool   `json:"populate_quickfix,omitempty" jsonschema:"description=Push the matches onto the quickfix stack as a new list and open it"`
+}
+
+type GetRegistersArgs struct {
+	Names string `json:"names,omitempty" jsonschema:"description=Register names to read as one string such as 0a+ (defaults to the unnamed register and 0-9 and a-z)"`
+}
+
+type GetMarksArgs struct {
+	// No arguments needed
+}
+
+type GetBufferInfoArgs struct {
+	// No arguments needed
+}
+
+type ApplyEditsArgs struct {
+	Edits []TextEditArg `json:"edits" jsonschema:"description=Non-overlapping edits for the current buffer"`
+}
+
+type InsertTextArgs struct {
+	Text string `json:"text" jsonschema:"description=Text to insert (may contain newlines)"`
+	Line int    `json:"line,omitempty" jsonschema:"description=Line to insert at (1-based; defaults to the cursor)"`
+	Col  int    `json:"col,omitempty" jsonschema:"description=Byte column to insert before (1-based; one past the end appends to the line; defaults to 1 when line is given)"`
+}
+
+type NotifyArgs struct {
+	Message string `json:"message" jsonschema:"description=Message to display"`
+	Level   string `json:"level,omitempty" jsonschema:"description=Log level (defaults to info),enum=info,enum=warn,enum=error"`
+}
+
+type ListNvimInstancesArgs struct {
+	// No arguments needed
+}
+
+type SelectInstanceArgs struct {
+	Socket string `json:"socket" jsonschema:"description=Socket path or host:port of the instance to use"`
+}
+
+type GetCodeActionsArgs struct {
+	Line       int `json:"line,omitempty" jsonschema:"description=Line in the current buffer (1-based; defaults to the cursor)"`
+	Col        int `json:"col,omitempty" jsonschema:"description=Byte column (1-based; defaults to 1 when line is given)"`
+	ApplyIndex int `json:"apply_index,omitempty" jsonschema:"description=Index of the listed action to apply (omit to only list the actions)"`
+
+	VerifyDiagnostics bool `json:"verify_diagnostics,omitempty" jsonschema:"description=When applying: wait for the LSP to republish and report which diagnostics were resolved and which appeared"`
+}
+
+type LspRenameArgs struct {
+	Line    int    `json:"line,omitempty" jsonschema:"description=Line of the symbol (1-based; defaults to the cursor)"`
+	Col     int    `json:"col,omitempty" jsonschema:"description=Byte column of the symbol (1-based; defaults to 1 when line is given)"`
+	NewName string `json:"new_name" jsonschema:"description=New name for the symbol"`
+}
+
+type FormatBufferArgs struct {
+	StartLine int `json:"start_line,omitempty" jsonschema:"description=First line to format (1-based; omit to format the whole buffer)"`
+	EndLine   int `json:"end_line,omitempty" jsonschema:"description=Last line to format (1-based and inclusive; defaults to start_line)"`
+}
+
+type GetTreesitterContextArgs struct {
+	Line int `json:"line,omitempty" jsonschema:"description=Line in the current buffer (1-based; defaults to the cursor)"`
+	Col  int `json:"col,omitempty" jsonschema:"description=Byte column (1-based; defaults to 1 when line is given)"`
+}
+
+type SaveBufferArgs struct {
+	Path  string `json:"path,omitempty" jsonschema:"description=Write to this path instead of the buffer's file (relative to Neovim's working directory)"`
+	Force bool   `json:"force,omitempty" jsonschema:"description=Use write! to overwrite an existing file or ignore readonly"`
+}
+
+type UndoRedoArgs struct {
+	Count int `json:"count,omitempty" jsonschema:"description=Number of changes to step through (defaults to 1)"`
+}
+
+type GetChangesArgs struct {
+	// No arguments needed
+}
+
+type GetProjectRootArgs struct {
+	// No arguments needed
+}
+
+type ClearQuickfixArgs struct {
+	CloseWindow bool `json:"close_window,omitempty" jsonschema:"description=Also close the quickfix (or location list) window"`
+	UseLoclist  bool `json:"use_loclist,omitempty" jsonschema:"description=Clear the current window's location list instead of the quickfix list"`
 }